@@ -0,0 +1,122 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+	"k8s.io/klog/v2/textlogger"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var captureMaxBytes int64
+
+// runCapture watches the pods of the configuration logs and snapshots their logs
+// when they terminate or are deleted, so logs of pods gone before the next
+// collection are not lost. Use collect --capture-dir to include them in a bundle.
+func runCapture(args []string) int {
+	fs := pflag.NewFlagSet("capture", pflag.ExitOnError)
+	initConfigFlags(fs)
+	initNamespacesFlag(fs)
+	initRequestFlags(fs)
+	fs.StringVar(&captureDirectory,
+		"capture-dir", "",
+		"Directory of the capture buffer. Each captured pod is stored in <time>-<namespace>-<pod>-<uid>")
+	fs.Int64Var(&captureMaxBytes,
+		"capture-max-bytes", utils.DefaultCaptureMaxBytes,
+		"Maximum size of the capture buffer. Oldest captured pods are removed when exceeded")
+	fs.StringVar(&kubeContext,
+		"context", "",
+		"Context, in the kubeconfig, of the cluster to watch. Default is the current context. "+
+			"In-cluster configuration is used otherwise")
+	initPreflightFlag(fs)
+	fs.StringVar(&metricsBindAddress,
+		"metrics-bind-address", "",
+		"Address (e.g. :8080) metrics are served on, at /metrics. Disabled by default")
+	fs.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
+	fs.AddGoFlagSet(flag.CommandLine)
+	_ = fs.Parse(args)
+
+	config := textlogger.NewConfig(textlogger.Verbosity(1))
+	logger := textlogger.NewLogger(config)
+
+	if captureDirectory == "" {
+		logger.Info("directory of the capture buffer is not defined")
+		return 1
+	}
+
+	source, err := getConfigurationSource()
+	if err != nil {
+		logger.Info(err.Error())
+		return 1
+	}
+
+	buffer, err := utils.NewCaptureBuffer(captureDirectory, captureMaxBytes)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to open capture buffer: %v", err))
+		return 1
+	}
+
+	ctx, stop := collectionContext(0)
+	defer stop()
+
+	scheme, restConfig, err := initializeManagementClusterAccess()
+	if err != nil {
+		logger.Info(err.Error())
+		return 1
+	}
+
+	options := append([]utils.Option{utils.WithLogger(logger), utils.WithNamespaces(namespaces...)},
+		requestOptions()...)
+	metrics, err := startMetrics(logger)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to create metrics: %v", err))
+		return 1
+	}
+	if metrics != nil {
+		options = append(options, utils.WithMetrics(metrics.metrics))
+	}
+	collector, err := utils.NewCollector(scheme, restConfig, options...)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get collector instance: %v", err))
+		return 1
+	}
+
+	configuration, err := utils.ReadConfiguration(ctx, source, collector.GetClient(), logger)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get configuration: %v", err))
+		return 1
+	}
+
+	if preflight {
+		permissions := utils.CapturePermissions(configuration, namespaces)
+		if exitCode := checkPermissions(ctx, collector, permissions, "k8s-collector rbac --capture", logger); exitCode != 0 {
+			return exitCode
+		}
+	}
+
+	if err := collector.RunCapture(ctx, configuration.Logs, buffer); err != nil {
+		logger.Info(fmt.Sprintf("capture failed: %v", err))
+		return 1
+	}
+
+	return 0
+}
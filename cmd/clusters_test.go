@@ -0,0 +1,60 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Clusters", func() {
+	var clusters []utils.Cluster
+	var messages []string
+	var logger logr.Logger
+
+	BeforeEach(func() {
+		clusters = []utils.Cluster{
+			{Name: "sveltos:mgmt/broken", Err: errors.New("failed to get kubeconfig: secret not found")},
+		}
+		messages = nil
+		logger = funcr.New(func(_, args string) { messages = append(messages, args) }, funcr.Options{})
+	})
+
+	source := func() utils.ConfigurationSource {
+		return utils.NewReaderSource("config", strings.NewReader("logs:\n- namespace: kube-system\n"))
+	}
+
+	It("runPlan reports clusters that cannot be accessed as failed", func() {
+		dryRunOutput = "text"
+		Expect(runPlan(context.TODO(), newTestCollector(), source(), clusters, logger)).To(Equal(1))
+		Expect(messages).To(ContainElement(ContainSubstring("secret not found")))
+	})
+
+	It("runPreflight reports clusters that cannot be accessed as failed", func() {
+		Expect(runPreflight(context.TODO(), newTestCollector(), source(), &utils.StatusTarget{},
+			clusters, logger)).To(Equal(1))
+		Expect(messages).To(ContainElement(ContainSubstring("secret not found")))
+	})
+})
@@ -0,0 +1,485 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	cliflag "k8s.io/component-base/cli/flag"
+	"k8s.io/klog/v2/textlogger"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// reportTimeout bounds reporting the summary, which happens even after the
+	// collection context is done
+	reportTimeout = 10 * time.Second
+)
+
+var (
+	configMapName    string
+	configSecretName string
+	configFile       string
+	configKeys       []string
+	profiles         []string
+	directory        string
+	kubeContext      string
+	namespaces       []string
+	captureDirectory string
+
+	clusterKubeconfigs       []string
+	clusterContexts          []string
+	clusterKubeconfigSecrets []string
+	clusterSelector          string
+	clusterNamespace         string
+	clusterConcurrency       int
+
+	statusConfigMap string
+	statusJob       string
+
+	timeout          time.Duration
+	listTimeout      time.Duration
+	logStreamTimeout time.Duration
+
+	retryAttempts   int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+
+	preflight        bool
+	dryRun           bool
+	dryRunProbeBytes int64
+	dryRunOutput     string
+)
+
+// runCollect collects resources and logs. This is what the k8s-collector Job runs.
+func runCollect(args []string) int {
+	fs := pflag.NewFlagSet("collect", pflag.ExitOnError)
+	initFlags(fs)
+	fs.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
+	fs.AddGoFlagSet(flag.CommandLine)
+	_ = fs.Parse(args)
+
+	config := textlogger.NewConfig(textlogger.Verbosity(1))
+	logger := textlogger.NewLogger(config)
+
+	if directory == "" && !dryRun {
+		logger.Info("directory where to store logs and resources is not defined")
+		return 1
+	}
+
+	configSource, err := getConfigurationSource()
+	if err != nil {
+		logger.Info(err.Error())
+		return 1
+	}
+
+	ctx, stop := collectionContext(timeout)
+	defer stop()
+
+	scheme, restConfig, err := initializeManagementClusterAccess()
+	if err != nil {
+		logger.Info(err.Error())
+		return 1
+	}
+
+	options := append([]utils.Option{utils.WithConfigurationSource(configSource), utils.WithLogger(logger),
+		utils.WithNamespaces(namespaces...)}, requestOptions()...)
+	var metrics *collectorMetrics
+	if !dryRun {
+		options = append(options, utils.WithDirectory(directory))
+		if captureDirectory != "" {
+			options = append(options, utils.WithCaptureDirectory(captureDirectory))
+		}
+
+		metrics, err = startMetrics(logger)
+		if err != nil {
+			logger.Info(fmt.Sprintf("failed to create metrics: %v", err))
+			return 1
+		}
+		if metrics != nil {
+			options = append(options, utils.WithMetrics(metrics.metrics))
+		}
+	}
+	collector, err := utils.NewCollector(scheme, restConfig, options...)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get collector instance: %v", err))
+		return 1
+	}
+
+	clusters, err := getClusters(ctx, collector, logger)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get clusters: %v", err))
+		return 1
+	}
+
+	statusTarget := &utils.StatusTarget{ConfigMap: statusConfigMap, Job: statusJob}
+	if preflight {
+		if exitCode := runPreflight(ctx, collector, configSource, statusTarget, clusters, logger); exitCode != 0 {
+			return exitCode
+		}
+	}
+
+	if dryRun {
+		return runPlan(ctx, collector, configSource, clusters, logger)
+	}
+
+	if len(clusters) > 0 {
+		err = collector.CollectFromClusters(ctx, clusters, clusterConcurrency)
+	} else {
+		err = collector.CollectResouces(ctx)
+	}
+
+	reportSummary(ctx, collector, statusTarget, metrics, logger)
+
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to collect data: %v", err))
+		return 1
+	}
+
+	return 0
+}
+
+// reportSummary logs the summary of the collection, updates metrics and reports it to
+// statusTarget. Failing to report does not fail the collection.
+func reportSummary(ctx context.Context, collector *utils.Collector, statusTarget *utils.StatusTarget,
+	metrics *collectorMetrics, logger logr.Logger) {
+
+	summary := collector.Summary()
+	if summary == nil {
+		return
+	}
+
+	// Report even if collection was interrupted
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), reportTimeout)
+	defer cancel()
+
+	logger.Info(summary.Message())
+	metrics.observeRun(ctx, summary, logger)
+	if statusTarget.IsEmpty() {
+		return
+	}
+	if err := utils.ReportSummary(ctx, collector.GetClient(), statusTarget, summary); err != nil {
+		logger.Info(err.Error())
+	}
+}
+
+// collectionContext returns the context of the collection. It is canceled on SIGTERM
+// or SIGINT and, if timeout is greater than 0, when timeout expires. Its cause
+// reports why.
+func collectionContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		select {
+		case sig := <-signals:
+			cancel(fmt.Errorf("received signal %s", sig))
+		case <-ctx.Done():
+		}
+	}()
+
+	cancelTimeout := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("timeout of %s exceeded", timeout))
+	}
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancelTimeout()
+		cancel(nil)
+	}
+}
+
+// initializeManagementClusterAccess returns the scheme and the configuration to access
+// the cluster selected by --kubeconfig and --context (in-cluster configuration by default).
+func initializeManagementClusterAccess() (*runtime.Scheme, *rest.Config, error) {
+	scheme, err := getScheme()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get scheme %w", err)
+	}
+
+	restConfig, err := ctrlconfig.GetConfigWithContext(kubeContext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get access to the cluster: %w", err)
+	}
+	restConfig.QPS = 100
+	restConfig.Burst = 100
+
+	return scheme, restConfig, nil
+}
+
+// getConfigurationSource returns the source configuration is loaded from.
+// Exactly one source must be specified.
+func getConfigurationSource() (utils.ConfigurationSource, error) {
+	var sources []utils.ConfigurationSource
+	if configMapName != "" {
+		sources = append(sources, utils.NewConfigMapSource(configMapName))
+	}
+	if configSecretName != "" {
+		sources = append(sources, utils.NewSecretSource(configSecretName))
+	}
+	if configFile != "" {
+		sources = append(sources, utils.NewFileSource(configFile))
+	}
+	if len(profiles) > 0 {
+		sources = append(sources, utils.NewProfileSource(profiles))
+	}
+
+	if len(sources) != 1 {
+		return nil, fmt.Errorf("exactly one of config-map, config-secret, config-file and profile must be set")
+	}
+
+	if len(configKeys) > 0 {
+		return utils.SelectKeys(sources[0], configKeys), nil
+	}
+
+	return sources[0], nil
+}
+
+// getClusters returns the clusters to collect from. An empty list means collecting
+// from the cluster the collector has access to.
+func getClusters(ctx context.Context, collector *utils.Collector, logger logr.Logger,
+) ([]utils.Cluster, error) {
+
+	clusters := make([]utils.Cluster, 0)
+
+	for _, kubeconfig := range clusterKubeconfigs {
+		cluster, err := utils.ClusterFromKubeconfig(kubeconfig, "")
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, *cluster)
+	}
+
+	for _, kubeContext := range clusterContexts {
+		cluster, err := utils.ClusterFromKubeconfig("", kubeContext)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, *cluster)
+	}
+
+	for _, ref := range clusterKubeconfigSecrets {
+		cluster, err := utils.ClusterFromKubeconfigSecret(ctx, collector.GetClient(), ref)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, *cluster)
+	}
+
+	if clusterSelector != "" {
+		managedClusters, err := utils.ClustersFromSelector(ctx, collector.GetClient(), clusterNamespace,
+			clusterSelector, logger)
+		if err != nil {
+			return nil, err
+		}
+		if len(managedClusters) == 0 {
+			return nil, fmt.Errorf("no ready cluster matches selector %q", clusterSelector)
+		}
+		clusters = append(clusters, managedClusters...)
+	}
+
+	return clusters, nil
+}
+
+// initConfigFlags registers the flags selecting the configuration source.
+func initConfigFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&configMapName,
+		"config-map", "",
+		"Name of the ConfigMap containing the configuration. Either <name> or <namespace>/<name>. "+
+			"If namespace is not specified, COLLECTOR_NAMESPACE is used")
+
+	fs.StringVar(&configSecretName,
+		"config-secret", "",
+		"Name of the Secret containing the configuration. Either <name> or <namespace>/<name>. "+
+			"If namespace is not specified, COLLECTOR_NAMESPACE is used")
+
+	fs.StringVar(&configFile,
+		"config-file", "",
+		"File (or directory, one file per key) containing the configuration. Use - to read from stdin")
+
+	fs.StringSliceVar(&configKeys,
+		"config-keys", nil,
+		"Comma separated, ordered list of configuration keys to merge. By default all keys are merged "+
+			"in alphabetical order")
+
+	fs.StringSliceVar(&profiles,
+		"profile", nil,
+		fmt.Sprintf("Built-in profile to collect. Can be repeated or comma separated. Available profiles: %s",
+			strings.Join(utils.ProfileNames(), ", ")))
+}
+
+// initStatusFlags registers the flags selecting where the collection summary is reported.
+func initStatusFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&statusConfigMap,
+		"status-config-map", "",
+		"ConfigMap (<name> or <namespace>/<name>) the collection summary is written to, in the summary.yaml key. "+
+			"If namespace is not specified, COLLECTOR_NAMESPACE is used")
+
+	fs.StringVar(&statusJob,
+		"job", "",
+		"Job (<name> or <namespace>/<name>) running the collector. It is annotated with the collection status "+
+			"and an Event is emitted on it. If namespace is not specified, COLLECTOR_NAMESPACE is used")
+}
+
+// initNamespacesFlag registers the flag restricting the collector to a set of namespaces.
+func initNamespacesFlag(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&namespaces,
+		"namespaces", nil,
+		"Comma separated list of namespaces. If set, resources and logs are only collected (and listed) "+
+			"in these namespaces, cluster-scoped resources are skipped and forbidden requests do not fail "+
+			"the collection. Only Roles in these namespaces are needed")
+}
+
+// initPreflightFlag registers the flag verifying all needed permissions are granted
+// before starting.
+func initPreflightFlag(fs *pflag.FlagSet) {
+	fs.BoolVar(&preflight,
+		"preflight", false,
+		"Before starting, verify (with SelfSubjectAccessReviews) all needed permissions are granted. "+
+			"Nothing starts if any is missing")
+}
+
+// initRequestFlags registers the flags bounding and retrying requests and log streams.
+func initRequestFlags(fs *pflag.FlagSet) {
+	const defaultListTimeout = time.Minute
+	fs.DurationVar(&listTimeout,
+		"list-timeout", defaultListTimeout,
+		"Maximum duration of each list (or get) request. 0 means no timeout")
+
+	const defaultLogStreamTimeout = 5 * time.Minute
+	fs.DurationVar(&logStreamTimeout,
+		"log-stream-timeout", defaultLogStreamTimeout,
+		"Maximum time spent collecting each container log. When expired, logs received so far are kept and "+
+			"the container is reported as timed out in the summary. 0 means no timeout")
+
+	defaultRetryPolicy := utils.DefaultRetryPolicy()
+	fs.IntVar(&retryAttempts,
+		"retry-attempts", defaultRetryPolicy.MaxAttempts,
+		"Maximum number of attempts of requests (and log streams) failing with transient errors, like 429, 5xx "+
+			"or connection resets. 1 disables retries")
+
+	fs.DurationVar(&retryBackoff,
+		"retry-backoff", defaultRetryPolicy.Backoff,
+		"Wait before the first retry. It doubles at each retry. Retry-After suggested by the server, if any, is honored")
+
+	fs.DurationVar(&retryMaxBackoff,
+		"retry-max-backoff", defaultRetryPolicy.MaxBackoff,
+		"Maximum wait between retries")
+}
+
+// requestOptions returns the collector options set by the flags registered by initRequestFlags.
+func requestOptions() []utils.Option {
+	return []utils.Option{utils.WithListTimeout(listTimeout), utils.WithLogStreamTimeout(logStreamTimeout),
+		utils.WithRetryPolicy(utils.RetryPolicy{MaxAttempts: retryAttempts, Backoff: retryBackoff, MaxBackoff: retryMaxBackoff})}
+}
+
+func initFlags(fs *pflag.FlagSet) {
+	initConfigFlags(fs)
+	initNamespacesFlag(fs)
+	initStatusFlags(fs)
+	initRequestFlags(fs)
+
+	fs.StringVar(&directory,
+		"dir", "",
+		"Name of the directory where logs and resources will be stored")
+
+	fs.StringVar(&captureDirectory,
+		"capture-dir", "",
+		"Directory of a capture buffer (see k8s-collector capture). Pods captured when they terminated "+
+			"are included in captured/")
+
+	fs.StringVar(&kubeContext,
+		"context", "",
+		"Context, in the kubeconfig, of the cluster to access. Default is the current context. "+
+			"Use --kubeconfig to select the kubeconfig file. In-cluster configuration is used otherwise")
+
+	initPreflightFlag(fs)
+
+	fs.StringSliceVar(&clusterKubeconfigs,
+		"cluster-kubeconfig", nil,
+		"Kubeconfig file of a cluster to collect from (current context is used). Can be repeated. "+
+			"Data is stored in clusters/<file name without extension>, suffixed with -<n> if already used")
+
+	fs.StringSliceVar(&clusterContexts,
+		"cluster-context", nil,
+		"Context, in the default kubeconfig, of a cluster to collect from. Can be repeated. "+
+			"Data is stored in clusters/<context name>")
+
+	fs.StringSliceVar(&clusterKubeconfigSecrets,
+		"cluster-kubeconfig-secret", nil,
+		"Secret (<name> or <namespace>/<name>) containing the kubeconfig of a cluster to collect from. "+
+			"Can be repeated. Data is stored in clusters/<secret name>")
+
+	fs.StringVar(&clusterSelector,
+		"sveltos-cluster-selector", "",
+		"Label selector. Collect from all ready SveltosClusters and Cluster API Clusters matching it. "+
+			"Kubeconfigs are read from the clusters' Secrets in the management cluster. "+
+			"Data is stored in clusters/<type>_<namespace>_<name>")
+
+	fs.StringVar(&clusterNamespace,
+		"sveltos-cluster-namespace", "",
+		"If set, only clusters in this namespace are matched by sveltos-cluster-selector")
+
+	fs.BoolVar(&dryRun,
+		"dry-run", false,
+		"Print what would be collected (discovery mappings, matching objects, pods and containers, "+
+			"estimated log sizes) without collecting or storing anything")
+
+	const defaultDryRunProbeBytes = 1024 * 1024
+	fs.Int64Var(&dryRunProbeBytes,
+		"dry-run-probe-bytes", defaultDryRunProbeBytes,
+		"With dry-run, read at most this many bytes of each container log (limitBytes) to estimate "+
+			"log sizes. 0 disables log size estimation")
+
+	fs.StringVar(&dryRunOutput,
+		"dry-run-output", "text",
+		"With dry-run, format of the plan: text or yaml")
+
+	fs.DurationVar(&timeout,
+		"timeout", 0,
+		"Maximum duration of the whole collection. When expired (or on SIGTERM), entries not collected yet are skipped, "+
+			"and partial output and the summary are stored. 0 means no timeout")
+
+	fs.StringVar(&metricsBindAddress,
+		"metrics-bind-address", "",
+		"Address (e.g. :8080) metrics are served on, at /metrics, while collecting. Disabled by default")
+
+	fs.StringVar(&pushgatewayURL,
+		"pushgateway-url", "",
+		"URL of a Prometheus Pushgateway. At the end of the collection, metrics are pushed to it (job k8s-collector), "+
+			"replacing the ones of the previous run")
+
+	const defaultClusterConcurrency = 4
+	fs.IntVar(&clusterConcurrency,
+		"cluster-concurrency", defaultClusterConcurrency,
+		"Maximum number of clusters collected in parallel")
+}
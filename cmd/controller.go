@@ -0,0 +1,113 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+	"k8s.io/klog/v2/textlogger"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var (
+	triggerDedupWindow time.Duration
+	triggerMaxPerHour  int
+)
+
+// runController runs the collector as a long running controller: the evidence of
+// pod crashes and failed Jobs is collected as soon as they happen, instead of when
+// someone runs the collection Job.
+func runController(args []string) int {
+	fs := pflag.NewFlagSet("controller", pflag.ExitOnError)
+	initNamespacesFlag(fs)
+	initRequestFlags(fs)
+	fs.StringVar(&directory,
+		"dir", "",
+		"Name of the directory where the evidence of each failure is stored, in triggers/<time>-<kind>-<namespace>-<name>")
+	fs.StringVar(&kubeContext,
+		"context", "",
+		"Context, in the kubeconfig, of the cluster to watch. Default is the current context. "+
+			"In-cluster configuration is used otherwise")
+	initPreflightFlag(fs)
+	fs.StringVar(&metricsBindAddress,
+		"metrics-bind-address", "",
+		"Address (e.g. :8080) metrics are served on, at /metrics. Disabled by default")
+
+	defaultPolicy := utils.DefaultTriggerPolicy()
+	fs.DurationVar(&triggerDedupWindow,
+		"dedup-window", defaultPolicy.DedupWindow,
+		"The same failure (same reason, object and container) triggers at most one collection in this window")
+	fs.IntVar(&triggerMaxPerHour,
+		"max-collections-per-hour", defaultPolicy.MaxPerHour,
+		"Maximum number of collections triggered in any hour. Failures exceeding it are not collected. 0 means no limit")
+	fs.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
+	fs.AddGoFlagSet(flag.CommandLine)
+	_ = fs.Parse(args)
+
+	config := textlogger.NewConfig(textlogger.Verbosity(1))
+	logger := textlogger.NewLogger(config)
+
+	if directory == "" {
+		logger.Info("directory where to store evidence of failures is not defined")
+		return 1
+	}
+
+	ctx, stop := collectionContext(0)
+	defer stop()
+
+	scheme, restConfig, err := initializeManagementClusterAccess()
+	if err != nil {
+		logger.Info(err.Error())
+		return 1
+	}
+
+	options := append([]utils.Option{utils.WithDirectory(directory), utils.WithLogger(logger),
+		utils.WithNamespaces(namespaces...)}, requestOptions()...)
+	metrics, err := startMetrics(logger)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to create metrics: %v", err))
+		return 1
+	}
+	if metrics != nil {
+		options = append(options, utils.WithMetrics(metrics.metrics))
+	}
+	collector, err := utils.NewCollector(scheme, restConfig, options...)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get collector instance: %v", err))
+		return 1
+	}
+
+	if preflight {
+		permissions := utils.TriggerPermissions(namespaces)
+		if exitCode := checkPermissions(ctx, collector, permissions, "k8s-collector rbac --controller", logger); exitCode != 0 {
+			return exitCode
+		}
+	}
+
+	policy := utils.TriggerPolicy{DedupWindow: triggerDedupWindow, MaxPerHour: triggerMaxPerHour}
+	if err := collector.RunTriggers(ctx, policy); err != nil {
+		logger.Info(fmt.Sprintf("controller failed: %v", err))
+		return 1
+	}
+
+	return 0
+}
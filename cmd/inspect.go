@@ -0,0 +1,138 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	cliflag "k8s.io/component-base/cli/flag"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+	"github.com/spf13/pflag"
+)
+
+// runInspect summarises the data collected in a directory.
+func runInspect(args []string) int {
+	fs := pflag.NewFlagSet("inspect", pflag.ExitOnError)
+	fs.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
+	var output string
+	fs.StringVarP(&output, "output", "o", "text", "Output format: text or yaml")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: k8s-collector inspect [flags] DIR\n\n"+
+			"Summarises the data collected in DIR.\n\n%s", fs.FlagUsages())
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 || (output != "text" && output != "yaml") {
+		fs.Usage()
+		return 2
+	}
+
+	summary, err := utils.InspectBundle(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if output == "yaml" {
+		if err := printYAML(summary); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, tabwriterPadding, ' ', 0)
+	printSummary(w, summary, "")
+	for i := range summary.Clusters {
+		cluster := &summary.Clusters[i]
+		status := "Unknown"
+		if cluster.Status != nil {
+			status = fmt.Sprintf("%s in %s", cluster.Status.Status, cluster.Status.Duration)
+		}
+		fmt.Fprintf(w, "\nCluster %s: %s\n", cluster.Name, status)
+		if cluster.Status != nil && cluster.Status.FailureMessage != "" {
+			fmt.Fprintf(w, "  Failure:\t%s\n", cluster.Status.FailureMessage)
+		}
+		printSummary(w, cluster.Summary, "  ")
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func printSummary(w io.Writer, summary *utils.BundleSummary, indent string) {
+	kinds := make([]string, 0, len(summary.Resources))
+	total := 0
+	for kind, count := range summary.Resources {
+		kinds = append(kinds, kind)
+		total += count
+	}
+	sort.Strings(kinds)
+
+	fmt.Fprintf(w, "%sResources:\t%d\n", indent, total)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "%s  %s\t%d\n", indent, kind, summary.Resources[kind])
+	}
+	fmt.Fprintf(w, "%sLogs:\t%d (%d bytes)\n", indent, summary.Logs, summary.LogBytes)
+	fmt.Fprintf(w, "%sNamespaces:\t%s\n", indent, strings.Join(summary.Namespaces, ", "))
+	if len(summary.Applications) > 0 {
+		fmt.Fprintf(w, "%sApplications:\t%s\n", indent, strings.Join(summary.Applications, ", "))
+	}
+	if summary.Captured > 0 {
+		fmt.Fprintf(w, "%sCaptured pods:\t%d\n", indent, summary.Captured)
+	}
+}
+
+// runDiff lists resources and applications that differ between the data collected
+// in two directories. As diff(1), it returns 0 if there is no difference, 1 if
+// there are differences and 2 on error.
+func runDiff(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: k8s-collector diff OLD_DIR NEW_DIR")
+		return 2
+	}
+
+	diff, err := utils.DiffBundles(args[0], args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for _, p := range diff.Removed {
+		fmt.Fprintf(os.Stdout, "- %s\n", p)
+	}
+	for _, p := range diff.Added {
+		fmt.Fprintf(os.Stdout, "+ %s\n", p)
+	}
+	for _, p := range diff.Changed {
+		fmt.Fprintf(os.Stdout, "~ %s\n", p)
+	}
+
+	if diff.IsEmpty() {
+		return 0
+	}
+	return 1
+}
@@ -17,71 +17,75 @@ limitations under the License.
 package main
 
 import (
-	"context"
-	"flag"
 	"fmt"
-	"log"
 	"os"
+	"strings"
 
+	"gopkg.in/yaml.v3"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/rest"
-	cliflag "k8s.io/component-base/cli/flag"
 	"k8s.io/klog/v2"
-	"k8s.io/klog/v2/textlogger"
-	ctrl "sigs.k8s.io/controller-runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 
-	"github.com/gianlucam76/k8s_collector/pkg/utils"
-	"github.com/spf13/pflag"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
 )
 
-var (
-	configMapName string
-	directory     string
-)
+const (
+	defaultCommand = "collect"
+	yamlIndent     = 2
 
-func main() {
-	klog.InitFlags(nil)
+	usage = `k8s-collector collects resources and logs from Kubernetes clusters.
 
-	initFlags(pflag.CommandLine)
-	pflag.CommandLine.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
-	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
-	pflag.Parse()
+Usage:
+  k8s-collector [collect] [flags]       collect resources and logs (default command)
+  k8s-collector validate [flags] FILE   validate configuration files
+  k8s-collector inspect [flags] DIR     summarise the data collected in a directory
+  k8s-collector diff OLD_DIR NEW_DIR    compare resources collected in two directories
+  k8s-collector profiles [NAME]         list built-in profiles, or show one
+  k8s-collector rbac [flags]            generate the minimal RBAC to collect a configuration
+  k8s-collector controller [flags]      collect evidence of pod crashes and failed Jobs as they happen
+  k8s-collector capture [flags]         capture logs of pods when they terminate or are deleted
 
-	config := textlogger.NewConfig(textlogger.Verbosity(1))
-	logger := textlogger.NewLogger(config)
+Use "k8s-collector <command> --help" for the flags of a command.
+`
+)
 
-	if directory == "" {
-		logger.Info("directory where to store logs and resources is not defined")
-		panic(1)
-	}
+// commands maps each subcommand to its implementation. A command returns
+// the process exit code.
+var commands = map[string]func(args []string) int{
+	"collect":    runCollect,
+	"validate":   runValidate,
+	"inspect":    runInspect,
+	"diff":       runDiff,
+	"profiles":   runProfiles,
+	"rbac":       runRBAC,
+	"controller": runController,
+	"capture":    runCapture,
+}
 
-	ctx := context.Background()
-	scheme, restConfig := initializeManagementClusterAccess()
-	collector, err := utils.GetCollectorInstance(scheme, restConfig, directory, configMapName)
-	if err != nil {
-		logger.Info("failed to get collector instance: %v", err)
-	}
+func main() {
+	klog.InitFlags(nil)
 
-	err = collector.CollectResouces(ctx, logger)
-	if err != nil {
-		logger.Info(fmt.Sprintf("failed to collect data: %v", err))
-		os.Exit(1)
+	// Without a command (for instance when run as a Job with only flags) collect
+	name := defaultCommand
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-}
 
-func initializeManagementClusterAccess() (*runtime.Scheme, *rest.Config) {
-	scheme, err := getScheme()
-	if err != nil {
-		werr := fmt.Errorf("failed to get scheme %w", err)
-		log.Fatal(werr)
+	if name == "help" {
+		fmt.Fprint(os.Stdout, usage)
+		os.Exit(0)
 	}
 
-	restConfig := ctrl.GetConfigOrDie()
-	restConfig.QPS = 100
-	restConfig.Burst = 100
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
 
-	return scheme, restConfig
+	os.Exit(command(args))
 }
 
 func getScheme() (*runtime.Scheme, error) {
@@ -89,15 +93,24 @@ func getScheme() (*runtime.Scheme, error) {
 	if err := clientgoscheme.AddToScheme(scheme); err != nil {
 		return nil, err
 	}
+	if err := apiextensionsv1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := clusterv1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := libsveltosv1beta1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
 	return scheme, nil
 }
 
-func initFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&configMapName,
-		"config-map", "",
-		"Name of the ConfigMap containing the configuration")
-
-	fs.StringVar(&directory,
-		"dir", "",
-		"Name of the directory where logs and resources will be stored")
+// printYAML writes content, in YAML format, to standard output.
+func printYAML(content interface{}) error {
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(yamlIndent)
+	if err := encoder.Encode(content); err != nil {
+		return err
+	}
+	return encoder.Close()
 }
@@ -0,0 +1,104 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+const (
+	// pushgatewayJob is the job label of metrics pushed to the Pushgateway
+	pushgatewayJob = "k8s-collector"
+
+	metricsReadHeaderTimeout = 10 * time.Second
+)
+
+var (
+	metricsBindAddress string
+	pushgatewayURL     string
+)
+
+// collectorMetrics are the metrics of a collector and the registry they are gathered from.
+type collectorMetrics struct {
+	registry *prometheus.Registry
+	metrics  *utils.Metrics
+}
+
+// startMetrics creates the collector metrics and, if metricsBindAddress is set, serves
+// them on /metrics. Returns nil if metrics are neither served nor pushed.
+func startMetrics(logger logr.Logger) (*collectorMetrics, error) {
+	if metricsBindAddress == "" && pushgatewayURL == "" {
+		return nil, nil
+	}
+
+	registry := prometheus.NewRegistry()
+	metrics, err := utils.NewMetrics(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	if metricsBindAddress != "" {
+		registry.MustRegister(collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		server := &http.Server{
+			Addr:              metricsBindAddress,
+			Handler:           mux,
+			ReadHeaderTimeout: metricsReadHeaderTimeout,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Info(fmt.Sprintf("failed to serve metrics: %v", err))
+			}
+		}()
+		logger.Info(fmt.Sprintf("serving metrics on %s/metrics", metricsBindAddress))
+	}
+
+	return &collectorMetrics{registry: registry, metrics: metrics}, nil
+}
+
+// observeRun updates the metrics of a whole collection and, if pushgatewayURL is
+// set, pushes all metrics to the Pushgateway. Pushed metrics replace the ones
+// pushed by the previous run.
+func (m *collectorMetrics) observeRun(ctx context.Context, summary *utils.Summary, logger logr.Logger) {
+	if m == nil {
+		return
+	}
+
+	m.metrics.ObserveRun(summary, time.Now())
+
+	if pushgatewayURL == "" {
+		return
+	}
+	if err := push.New(pushgatewayURL, pushgatewayJob).Gatherer(m.registry).PushContext(ctx); err != nil {
+		logger.Info(fmt.Sprintf("failed to push metrics to %s: %v", pushgatewayURL, err))
+	}
+}
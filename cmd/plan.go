@@ -0,0 +1,223 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+// clusterPlan is the plan of a cluster, when collecting from multiple clusters.
+type clusterPlan struct {
+	Cluster string      `json:"cluster" yaml:"cluster"`
+	Plan    *utils.Plan `json:"plan,omitempty" yaml:"plan,omitempty"`
+	// Error reports why the collection from the cluster cannot be planned.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// runPlan prints what collecting would do, without collecting anything.
+// Clusters that cannot be accessed are reported as failed, the others are planned.
+func runPlan(ctx context.Context, collector *utils.Collector, source utils.ConfigurationSource,
+	clusters []utils.Cluster, logger logr.Logger) int {
+
+	if dryRunOutput != "text" && dryRunOutput != "yaml" {
+		logger.Info(fmt.Sprintf("unsupported dry-run output %q", dryRunOutput))
+		return 2
+	}
+
+	config, err := utils.ReadConfiguration(ctx, source, collector.GetClient(), logger)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get configuration: %v", err))
+		return 1
+	}
+
+	if len(clusters) == 0 {
+		plan, err := collector.Plan(ctx, config, dryRunProbeBytes)
+		if err != nil {
+			logger.Info(fmt.Sprintf("failed to plan collection: %v", err))
+			return 1
+		}
+		return printPlans([]clusterPlan{{Plan: plan}})
+	}
+
+	exitCode := 0
+	plans := make([]clusterPlan, 0, len(clusters))
+	for i := range clusters {
+		plan, err := planCluster(ctx, collector, &clusters[i], config, logger)
+		if err != nil {
+			logger.Info(fmt.Sprintf("failed to plan collection from cluster %s: %v", clusters[i].Name, err))
+			plans = append(plans, clusterPlan{Cluster: clusters[i].Name, Error: err.Error()})
+			exitCode = 1
+			continue
+		}
+		plans = append(plans, clusterPlan{Cluster: clusters[i].Name, Plan: plan})
+	}
+
+	if printPlans(plans) != 0 {
+		return 1
+	}
+	return exitCode
+}
+
+// planCluster returns the plan of the collection from cluster.
+func planCluster(ctx context.Context, collector *utils.Collector, cluster *utils.Cluster,
+	config *utils.Configuration, logger logr.Logger) (*utils.Plan, error) {
+
+	if cluster.Err != nil {
+		return nil, cluster.Err
+	}
+
+	clusterCollector, err := utils.NewCollector(collector.GetScheme(), cluster.Config,
+		utils.WithLogger(logger.WithValues("cluster", cluster.Name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to access cluster: %w", err)
+	}
+	return clusterCollector.Plan(ctx, config, dryRunProbeBytes)
+}
+
+func printPlans(plans []clusterPlan) int {
+	var err error
+	switch {
+	case dryRunOutput == "yaml" && len(plans) == 1 && plans[0].Cluster == "":
+		err = printYAML(plans[0].Plan)
+	case dryRunOutput == "yaml":
+		err = printYAML(plans)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, tabwriterPadding, ' ', 0)
+		for i := range plans {
+			if plans[i].Cluster != "" {
+				fmt.Fprintf(w, "Cluster %s\n\n", plans[i].Cluster)
+			}
+			if plans[i].Error != "" {
+				fmt.Fprintf(w, "%s: %s\n\n", utils.ClusterFailed, plans[i].Error)
+				continue
+			}
+			printPlan(w, plans[i].Plan)
+		}
+		err = w.Flush()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printPlan(w io.Writer, plan *utils.Plan) {
+	if len(plan.Resources) > 0 {
+		fmt.Fprintln(w, "GROUP/VERSION/KIND\tRESOURCE\tNAMESPACED\tSELECTOR\tOBJECTS\tNAMESPACES\tNOTE")
+		for i := range plan.Resources {
+			r := &plan.Resources[i]
+			note := r.Application
+			if !r.Served {
+				note = "not served"
+			}
+			if r.Skipped != "" {
+				note = "skipped: " + r.Skipped
+			}
+			if r.Error != "" {
+				note = r.Error
+			}
+			fmt.Fprintf(w, "%s/%s/%s\t%s\t%t\t%s\t%d\t%d\t%s\n", r.Group, r.Version, r.Kind, r.Resource,
+				r.Namespaced, selector(r.LabelSelector, r.FieldSelector), r.Objects, len(r.Namespaces), note)
+		}
+		fmt.Fprintln(w)
+	}
+
+	atLeast := false
+	if len(plan.Logs) > 0 {
+		fmt.Fprintln(w, "NAMESPACE\tSELECTOR\tPODS\tCONTAINERS\tESTIMATED SIZE\tNOTE")
+		for i := range plan.Logs {
+			l := &plan.Logs[i]
+			note := l.Application
+			if l.FollowSeconds > 0 {
+				note = fmt.Sprintf("follow %s", time.Duration(l.FollowSeconds)*time.Second)
+			}
+			if l.Skipped != "" {
+				note = "skipped: " + l.Skipped
+			}
+			if l.Error != "" {
+				note = l.Error
+			}
+			size := byteSize(l.EstimatedBytes)
+			for j := range l.Containers {
+				if l.Containers[j].AtLeast {
+					size = ">= " + size
+					atLeast = true
+					break
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", valueOrAll(l.Namespace), l.LabelSelector, l.Pods,
+				len(l.Containers), size, note)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(plan.Applications) > 0 {
+		fmt.Fprintln(w, "NAMESPACE\tINSTANCE\tHELM RELEASE\tREVISION\tMANIFEST OBJECTS\tNOTE")
+		for i := range plan.Applications {
+			app := &plan.Applications[i]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", valueOrAll(app.Namespace), app.Instance, app.HelmRelease,
+				app.HelmReleaseRevision, app.ManifestObjects, app.Error)
+		}
+		fmt.Fprintln(w)
+	}
+
+	size := byteSize(plan.EstimatedLogBytes)
+	if atLeast {
+		size = "at least " + size
+	}
+	fmt.Fprintf(w, "Total: %d objects, %d containers, %s of logs\n\n", plan.Objects, plan.Containers, size)
+}
+
+func selector(labelSelector, fieldSelector string) string {
+	if labelSelector != "" && fieldSelector != "" {
+		return labelSelector + "," + fieldSelector
+	}
+	return labelSelector + fieldSelector
+}
+
+func valueOrAll(namespace string) string {
+	if namespace == "" {
+		return "<all>"
+	}
+	return namespace
+}
+
+// byteSize returns size in human readable format (e.g. 1.5 MiB).
+func byteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+const (
+	tabwriterPadding = 2
+)
+
+// runProfiles lists built-in profiles or, when a name is given, prints the
+// content of that profile with all its includes resolved.
+func runProfiles(args []string) int {
+	switch len(args) {
+	case 0:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, tabwriterPadding, ' ', 0)
+		fmt.Fprintln(w, "NAME\tDESCRIPTION")
+		for _, name := range utils.ProfileNames() {
+			fmt.Fprintf(w, "%s\t%s\n", name, utils.ProfileDescription(name))
+		}
+		if err := w.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	case 1:
+		profile, err := utils.GetProfile(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := printYAML(profile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: k8s-collector profiles [NAME]")
+		return 2
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-logr/logr"
+	cliflag "k8s.io/component-base/cli/flag"
+	"sigs.k8s.io/yaml"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+	"github.com/spf13/pflag"
+)
+
+// runPreflight verifies the collector has all permissions needed to collect,
+// from the cluster it accesses or from each of clusters. It reports all missing
+// permissions, and the clusters that cannot be accessed, and returns 1 if any is
+// missing or any cluster failed.
+func runPreflight(ctx context.Context, collector *utils.Collector, source utils.ConfigurationSource,
+	statusTarget *utils.StatusTarget, clusters []utils.Cluster, logger logr.Logger) int {
+
+	config, err := utils.ReadConfiguration(ctx, source, collector.GetClient(), logger)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get configuration: %v", err))
+		return 1
+	}
+
+	exitCode := 0
+	targets := map[string]*utils.Collector{"": collector}
+	if len(clusters) > 0 {
+		targets = make(map[string]*utils.Collector, len(clusters))
+		for i := range clusters {
+			// A cluster that cannot be accessed does not prevent verifying the others
+			if clusters[i].Err != nil {
+				logger.Info(fmt.Sprintf("failed to access cluster %s: %v", clusters[i].Name, clusters[i].Err))
+				exitCode = 1
+				continue
+			}
+			target, err := utils.NewCollector(collector.GetScheme(), clusters[i].Config,
+				utils.WithNamespaces(namespaces...))
+			if err != nil {
+				logger.Info(fmt.Sprintf("failed to access cluster %s: %v", clusters[i].Name, err))
+				exitCode = 1
+				continue
+			}
+			targets[clusters[i].Name] = target
+		}
+	}
+
+	for name, target := range targets {
+		l := logger
+		if name != "" {
+			l = logger.WithValues("cluster", name)
+		}
+
+		missing, err := target.Preflight(ctx, config)
+		if err != nil {
+			l.Info(fmt.Sprintf("failed to verify permissions: %v", err))
+			return 1
+		}
+		if logMissingPermissions(missing, l) {
+			exitCode = 1
+		}
+	}
+
+	// Summary is reported to the cluster the collector runs in
+	missing, err := collector.CheckPermissions(ctx, statusTarget.Permissions())
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to verify permissions: %v", err))
+		return 1
+	}
+	if logMissingPermissions(missing, logger) {
+		exitCode = 1
+	}
+
+	if exitCode != 0 {
+		logRBACHint("k8s-collector rbac", logger)
+	}
+	return exitCode
+}
+
+// checkPermissions verifies the collector is granted permissions. It reports all
+// missing permissions and returns 1 if any is missing. rbacCommand is the command
+// generating them.
+func checkPermissions(ctx context.Context, collector *utils.Collector, permissions []utils.Permission,
+	rbacCommand string, logger logr.Logger) int {
+
+	missing, err := collector.CheckPermissions(ctx, permissions)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to verify permissions: %v", err))
+		return 1
+	}
+	if !logMissingPermissions(missing, logger) {
+		return 0
+	}
+
+	logRBACHint(rbacCommand, logger)
+	return 1
+}
+
+// logMissingPermissions logs each missing permission. It returns true if any is missing.
+func logMissingPermissions(missing []utils.Permission, logger logr.Logger) bool {
+	for i := range missing {
+		if missing[i].Reason != "" {
+			logger.Info(fmt.Sprintf("missing permission: %s (needed by %s)", &missing[i], missing[i].Reason))
+		} else {
+			logger.Info(fmt.Sprintf("missing permission: %s", &missing[i]))
+		}
+	}
+	return len(missing) > 0
+}
+
+// logRBACHint suggests rbacCommand to generate missing permissions.
+func logRBACHint(rbacCommand string, logger logr.Logger) {
+	logger.Info(fmt.Sprintf("not all needed permissions are granted. Use %q to generate them "+
+		"or --preflight=false to start anyhow", rbacCommand))
+}
+
+// runRBAC prints the ClusterRole, Roles and bindings granting a service account
+// the permissions needed to collect a configuration.
+func runRBAC(args []string) int {
+	fs := pflag.NewFlagSet("rbac", pflag.ExitOnError)
+	initConfigFlags(fs)
+	initNamespacesFlag(fs)
+	initStatusFlags(fs)
+	var name, serviceAccount string
+	var offline, controller, capture bool
+	fs.StringVar(&name, "name", "k8s-collector", "Name of the generated RBAC objects")
+	fs.StringVar(&serviceAccount, "service-account", "default/k8s-collector",
+		"Service account (<namespace>/<name>) permissions are granted to")
+	fs.BoolVar(&offline, "offline", false,
+		"Do not access any cluster. Resource names are guessed from Kinds instead of using discovery. "+
+			"Only config-file and profile can be used")
+	fs.BoolVar(&controller, "controller", false,
+		"Generate the RBAC of controller mode (k8s-collector controller) instead of the one needed to collect "+
+			"a configuration")
+	fs.BoolVar(&capture, "capture", false,
+		"Generate the RBAC of capture mode (k8s-collector capture), watching the pods of the configuration logs, "+
+			"instead of the one needed to collect the configuration")
+	fs.StringVar(&kubeContext, "context", "", "Context, in the kubeconfig, of the cluster used for discovery")
+	fs.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
+	fs.AddGoFlagSet(flag.CommandLine)
+	_ = fs.Parse(args)
+
+	namespace, serviceAccountName := parseServiceAccount(serviceAccount)
+	if namespace == "" || serviceAccountName == "" {
+		fmt.Fprintf(os.Stderr, "invalid service account %q: must be <namespace>/<name>\n", serviceAccount)
+		return 2
+	}
+
+	var permissions []utils.Permission
+	if controller {
+		permissions = utils.TriggerPermissions(namespaces)
+	} else {
+		source, err := getConfigurationSource()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		permissions, err = getPermissions(source, offline, capture)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !capture {
+			statusTarget := &utils.StatusTarget{ConfigMap: statusConfigMap, Job: statusJob}
+			permissions = append(permissions, statusTarget.Permissions()...)
+		}
+	}
+
+	for _, object := range utils.RBACObjects(permissions, name, namespace, serviceAccountName) {
+		content, err := yaml.Marshal(object)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "---\n%s", content)
+	}
+
+	return 0
+}
+
+// getPermissions returns the permissions needed to load and collect the configuration,
+// or to capture its logs when capture is set.
+func getPermissions(source utils.ConfigurationSource, offline, capture bool) ([]utils.Permission, error) {
+	ctx := context.Background()
+	logger := logr.Discard()
+
+	if offline {
+		if configMapName != "" || configSecretName != "" {
+			return nil, fmt.Errorf("config-map and config-secret cannot be used with offline")
+		}
+		config, err := utils.ReadConfiguration(ctx, source, nil, logger)
+		if err != nil {
+			return nil, err
+		}
+		if capture {
+			return utils.CapturePermissions(config, namespaces), nil
+		}
+		if utils.CollectsHelmReleases(config) {
+			fmt.Fprintln(os.Stderr, "warning: Helm release manifests are not read with offline: "+
+				"permissions to get their objects are not included")
+		}
+		return utils.RequiredNamespacedPermissions(config, nil, namespaces)
+	}
+
+	scheme, restConfig, err := initializeManagementClusterAccess()
+	if err != nil {
+		return nil, err
+	}
+	collector, err := utils.NewCollector(scheme, restConfig, utils.WithNamespaces(namespaces...))
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := utils.ReadConfiguration(ctx, source, collector.GetClient(), logger)
+	if err != nil {
+		return nil, err
+	}
+	if capture {
+		return append(utils.SourcePermissions(source), utils.CapturePermissions(config, namespaces)...), nil
+	}
+
+	mapper, err := collector.GetRESTMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := utils.RequiredNamespacedPermissions(config, mapper, namespaces)
+	if err != nil {
+		return nil, err
+	}
+	manifestPermissions, err := collector.ManifestPermissions(ctx, config, mapper)
+	if err != nil {
+		return nil, err
+	}
+	permissions = append(permissions, manifestPermissions...)
+
+	return append(utils.SourcePermissions(source), permissions...), nil
+}
+
+func parseServiceAccount(ref string) (namespace, name string) {
+	namespace, name, _ = strings.Cut(ref, "/")
+	return namespace, name
+}
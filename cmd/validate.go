@@ -0,0 +1,68 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/go-logr/logr"
+	cliflag "k8s.io/component-base/cli/flag"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+	"github.com/spf13/pflag"
+)
+
+// runValidate validates configuration files (or directories, one file per key)
+// without accessing any cluster. It returns 1 if any configuration is invalid.
+func runValidate(args []string) int {
+	fs := pflag.NewFlagSet("validate", pflag.ExitOnError)
+	fs.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
+	var keys []string
+	fs.StringSliceVar(&keys,
+		"config-keys", nil,
+		"Comma separated, ordered list of configuration keys to merge. By default all keys are merged "+
+			"in alphabetical order")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: k8s-collector validate [flags] FILE...\n\n"+
+			"Validates configuration files. Use - to read from stdin.\n\n%s", fs.FlagUsages())
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	exitCode := 0
+	for _, filename := range fs.Args() {
+		var source utils.ConfigurationSource = utils.NewFileSource(filename)
+		if len(keys) > 0 {
+			source = utils.SelectKeys(source, keys)
+		}
+
+		if _, err := utils.ReadConfiguration(context.Background(), source, nil, logr.Discard()); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s: valid\n", filename)
+	}
+
+	return exitCode
+}
@@ -0,0 +1,458 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+const (
+	instanceLabel = "app.kubernetes.io/instance"
+
+	helmReleaseSecretType = "helm.sh/release.v1"
+	helmReleaseKey        = "release"
+	helmStatusDeployed    = "deployed"
+
+	// helmReleaseKind is the kind of skipped Helm releases
+	helmReleaseKind = "HelmRelease"
+
+	secretKind = "Secret"
+
+	redactedValue = "<redacted>"
+)
+
+var (
+	// applicationResources are the resources collected for every application
+	// using the app.kubernetes.io/instance label.
+	// Secrets are intentionally not part of this list.
+	applicationResources = []schema.GroupVersionKind{
+		{Group: "", Version: "v1", Kind: "Pod"},
+		{Group: "", Version: "v1", Kind: "Service"},
+		{Group: "", Version: "v1", Kind: "ConfigMap"},
+		{Group: "", Version: "v1", Kind: "ServiceAccount"},
+		{Group: "", Version: "v1", Kind: "PersistentVolumeClaim"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+		{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+		{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+		{Group: "batch", Version: "v1", Kind: "Job"},
+		{Group: "batch", Version: "v1", Kind: "CronJob"},
+		{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"},
+		{Group: "autoscaling", Version: "v2", Kind: "HorizontalPodAutoscaler"},
+		{Group: "policy", Version: "v1", Kind: "PodDisruptionBudget"},
+	}
+
+	// sensitiveKeys are the (normalized) substrings identifying Helm values to redact.
+	sensitiveKeys = []string{
+		"password", "passwd", "secret", "token", "apikey", "privatekey",
+		"credential", "accesskey", "certificate",
+	}
+)
+
+// helmRelease contains the fields of a Helm release the collector uses.
+type helmRelease struct {
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace"`
+	Version   int                    `json:"version"`
+	Manifest  string                 `json:"manifest"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Info      struct {
+		Status string `json:"status"`
+	} `json:"info"`
+	Chart struct {
+		Metadata struct {
+			Name       string `json:"name"`
+			Version    string `json:"version"`
+			AppVersion string `json:"appVersion,omitempty"`
+		} `json:"metadata"`
+	} `json:"chart"`
+}
+
+// collectApplication collects all resources and logs belonging to an application.
+func (a *Collector) collectApplication(ctx context.Context, app *Application, logger logr.Logger) error {
+	instance := applicationInstance(app)
+	if instance == "" {
+		return fmt.Errorf("application must define either helmRelease or instance")
+	}
+
+	logger = logger.WithValues("application", fmt.Sprintf("%s/%s", app.Namespace, instance))
+	logger.Info("collecting application")
+
+	// Objects of the Helm release manifest usually carry the instance label too:
+	// they are collected once
+	var collected map[string]bool
+	if app.HelmRelease != "" {
+		var err error
+		collected, err = a.collectHelmRelease(ctx, app.Namespace, app.HelmRelease, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Logs are collected with the logs of the other entries (see logEntries)
+	resources, _ := applicationEntries(app)
+	for i := range resources {
+		if err := a.dumpResources(ctx, &resources[i], collected, logger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applicationInstance returns the value of the app.kubernetes.io/instance label
+// of the application resources.
+func applicationInstance(app *Application) string {
+	if app.Instance != "" {
+		return app.Instance
+	}
+	return app.HelmRelease
+}
+
+// objectKey identifies an object among the objects collected for an application.
+// Version is not part of the key: the same object is served in every version of its kind.
+func objectKey(gk schema.GroupKind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", gk.Group, gk.Kind, namespace, name)
+}
+
+// applicationEntries returns the resources and logs collected for an application
+// using the app.kubernetes.io/instance label.
+func applicationEntries(app *Application) ([]Resource, *Log) {
+	labelFilters := []libsveltosv1alpha1.LabelFilter{
+		{Key: instanceLabel, Operation: libsveltosv1alpha1.OperationEqual, Value: applicationInstance(app)},
+	}
+
+	resources := make([]Resource, len(applicationResources))
+	for i := range applicationResources {
+		gvk := &applicationResources[i]
+		resources[i] = Resource{
+			Namespace:    app.Namespace,
+			Group:        gvk.Group,
+			Version:      gvk.Version,
+			Kind:         gvk.Kind,
+			LabelFilters: labelFilters,
+		}
+	}
+
+	log := &Log{
+		Namespace:    app.Namespace,
+		LabelFilters: labelFilters,
+		SinceSeconds: app.SinceSeconds,
+	}
+
+	return resources, log
+}
+
+// collectHelmRelease decodes the latest revision of an Helm release, stores its
+// manifest and (redacted) values and collects every resource in the manifest.
+// It returns the keys (see objectKey) of the collected resources.
+func (a *Collector) collectHelmRelease(ctx context.Context, namespace, releaseName string,
+	logger logr.Logger) (map[string]bool, error) {
+
+	if _, reason := a.entryNamespaces(namespace); reason != "" {
+		a.skip(SkippedEntry{Kind: helmReleaseKind, Namespace: namespace, Name: releaseName, Reason: reason}, logger)
+		return nil, nil
+	}
+
+	release, err := a.getHelmRelease(ctx, namespace, releaseName)
+	if err != nil {
+		if a.isSkippable(err) {
+			a.skipForbidden(helmReleaseKind, namespace, releaseName, err, logger)
+			return nil, nil
+		}
+		return nil, err
+	}
+	if release == nil {
+		logger.Info(fmt.Sprintf("helm release %s not found", releaseName))
+		return nil, nil
+	}
+
+	logger.Info(fmt.Sprintf("found helm release %s/%s revision %d", release.Namespace, release.Name,
+		release.Version))
+
+	objects, err := parseManifest(release.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.storeHelmRelease(release, objects); err != nil {
+		return nil, err
+	}
+
+	mapper, err := a.restMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	collected := make(map[string]bool, len(objects))
+	for i := range objects {
+		u := objects[i]
+		objectNamespace := u.GetNamespace()
+		if objectNamespace == "" {
+			objectNamespace = release.Namespace
+		}
+		current, err := a.getNamedResource(ctx, mapper, u.GroupVersionKind(), objectNamespace, u.GetName(), logger)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			continue
+		}
+		if err := a.storeManifestObject(current, logger); err != nil {
+			return nil, err
+		}
+		collected[objectKey(current.GroupVersionKind().GroupKind(), current.GetNamespace(), current.GetName())] = true
+	}
+
+	return collected, nil
+}
+
+// storeManifestObject stores an object of an Helm release manifest, as found in
+// the cluster. Secret data is redacted, as it is in manifest.yaml.
+func (a *Collector) storeManifestObject(u *unstructured.Unstructured, logger logr.Logger) error {
+	if u.GetKind() == secretKind {
+		redactSecret(u)
+	}
+	return a.dumpObject(u, logger)
+}
+
+// getHelmRelease returns the latest revision of the Helm release, preferring the
+// deployed one. Returns nil if no release is found.
+// In namespaced mode, an empty namespace means all the collector namespaces.
+// An empty namespace is ambiguous when releases with that name exist in several namespaces.
+func (a *Collector) getHelmRelease(ctx context.Context, namespace, releaseName string,
+) (*helmRelease, error) {
+
+	namespaces, _ := a.entryNamespaces(namespace)
+	secrets := make([]corev1.Secret, 0)
+	for _, ns := range namespaces {
+		list := &corev1.SecretList{}
+		options := []client.ListOption{
+			client.MatchingLabels{"owner": "helm", "name": releaseName},
+		}
+		if ns != "" {
+			options = append(options, client.InNamespace(ns))
+		}
+		err := a.doRequest(ctx, fmt.Sprintf("list Helm release %s secrets in namespace %q", releaseName, ns),
+			func(ctx context.Context) error {
+				return a.client.List(ctx, list, options...)
+			})
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, list.Items...)
+	}
+
+	var latest *corev1.Secret
+	latestVersion := -1
+	latestDeployed := false
+	releaseNamespaces := make(map[string]bool)
+	for i := range secrets {
+		secret := &secrets[i]
+		if secret.Type != helmReleaseSecretType {
+			continue
+		}
+		version, err := strconv.Atoi(secret.Labels["version"])
+		if err != nil {
+			continue
+		}
+		releaseNamespaces[secret.Namespace] = true
+		deployed := secret.Labels["status"] == helmStatusDeployed
+		if latestDeployed && !deployed {
+			continue
+		}
+		if (deployed && !latestDeployed) || version > latestVersion {
+			latest = secret
+			latestVersion = version
+			latestDeployed = deployed
+		}
+	}
+
+	if latest == nil {
+		return nil, nil
+	}
+	if len(releaseNamespaces) > 1 {
+		return nil, fmt.Errorf("ambiguous Helm release %s: found in namespaces %s, set the application namespace",
+			releaseName, strings.Join(sortedKeys(releaseNamespaces), ", "))
+	}
+
+	return decodeHelmRelease(latest.Data[helmReleaseKey])
+}
+
+// decodeHelmRelease decodes the content of a sh.helm.release.v1 Secret.
+// Release is JSON, gzipped and then base64 encoded.
+func decodeHelmRelease(data []byte) (*helmRelease, error) {
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	gzipMagic := []byte{0x1f, 0x8b, 0x08}
+	if bytes.HasPrefix(b, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		b, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	release := &helmRelease{}
+	if err := json.Unmarshal(b, release); err != nil {
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// parseManifest returns the resources contained in a multi-document YAML manifest.
+func parseManifest(manifest string) ([]*unstructured.Unstructured, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+
+	objects := make([]*unstructured.Unstructured, 0)
+	for {
+		u := &unstructured.Unstructured{}
+		if err := decoder.Decode(&u.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if len(u.Object) == 0 {
+			continue
+		}
+		objects = append(objects, u)
+	}
+
+	return objects, nil
+}
+
+// storeHelmRelease stores release information, manifest and values in the
+// applications/<release namespace>/<release name> directory.
+// Secret data in the manifest and sensitive values are redacted.
+func (a *Collector) storeHelmRelease(release *helmRelease, objects []*unstructured.Unstructured) error {
+	dir := path.Join("applications", release.Namespace, release.Name)
+
+	info := map[string]interface{}{
+		"name":         release.Name,
+		"namespace":    release.Namespace,
+		"revision":     release.Version,
+		"status":       release.Info.Status,
+		"chart":        release.Chart.Metadata.Name,
+		"chartVersion": release.Chart.Metadata.Version,
+		"appVersion":   release.Chart.Metadata.AppVersion,
+	}
+	if err := a.writeYAML(path.Join(dir, "release.yaml"), info); err != nil {
+		return err
+	}
+
+	values := redactValues(release.Config)
+	if err := a.writeYAML(path.Join(dir, "values.yaml"), values); err != nil {
+		return err
+	}
+
+	var manifest bytes.Buffer
+	for i := range objects {
+		u := objects[i].DeepCopy()
+		if u.GetKind() == secretKind {
+			redactSecret(u)
+		}
+		data, err := yaml.Marshal(u.Object)
+		if err != nil {
+			return err
+		}
+		manifest.WriteString("---\n")
+		manifest.Write(data)
+	}
+
+	return a.writeFile(path.Join(dir, "manifest.yaml"), manifest.Bytes())
+}
+
+// redactSecret replaces every value in Secret data and stringData.
+func redactSecret(u *unstructured.Unstructured) {
+	for _, field := range []string{"data", "stringData"} {
+		data, found, err := unstructured.NestedMap(u.Object, field)
+		if err != nil || !found {
+			continue
+		}
+		for k := range data {
+			data[k] = redactedValue
+		}
+		_ = unstructured.SetNestedMap(u.Object, data, field)
+	}
+}
+
+// redactValues returns a copy of Helm values where every scalar value whose key
+// looks sensitive (password, token, ...) is redacted.
+func redactValues(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		result[k] = redactValue(k, v)
+	}
+	return result
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return redactValues(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i := range v {
+			result[i] = redactValue(key, v[i])
+		}
+		return result
+	default:
+		if value != nil && isSensitiveKey(key) {
+			return redactedValue
+		}
+		return value
+	}
+}
+
+func isSensitiveKey(key string) bool {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", "_", "", ".", "").Replace(key))
+	for i := range sensitiveKeys {
+		if strings.Contains(normalized, sensitiveKeys[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package utils_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var (
+	helmManifest = `---
+# Source: nginx/templates/serviceaccount.yaml
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: nginx
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+  namespace: web
+`
+)
+
+// helmReleaseSecret returns the Secret Helm stores revision version of a release in.
+func helmReleaseSecret(namespace, name string, version int) *corev1.Secret {
+	release, err := json.Marshal(map[string]interface{}{
+		"name": name, "namespace": namespace, "version": version, "manifest": helmManifest,
+		"info": map[string]interface{}{"status": "deployed"},
+	})
+	Expect(err).To(BeNil())
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      fmt.Sprintf("sh.helm.release.v1.%s.v%d", name, version),
+			Labels:    map[string]string{"owner": "helm", "name": name, "status": "deployed", "version": fmt.Sprint(version)},
+		},
+		Type: "helm.sh/release.v1",
+		Data: map[string][]byte{"release": []byte(base64.StdEncoding.EncodeToString(release))},
+	}
+}
+
+var _ = Describe("Applications", func() {
+	It("getHelmRelease returns the latest revision and rejects ambiguous names", func() {
+		collector := newTestCollector([]client.Object{helmReleaseSecret("web", "nginx", 1), helmReleaseSecret("web", "nginx", 2)})
+		release, err := utils.GetHelmRelease(collector, context.TODO(), "", "nginx")
+		Expect(err).To(BeNil())
+		Expect(release.Version).To(Equal(2))
+
+		collector = newTestCollector([]client.Object{helmReleaseSecret("web", "nginx", 1), helmReleaseSecret("staging", "nginx", 1)})
+		_, err = utils.GetHelmRelease(collector, context.TODO(), "", "nginx")
+		Expect(err).To(MatchError(ContainSubstring("ambiguous Helm release nginx: found in namespaces staging, web")))
+
+		release, err = utils.GetHelmRelease(collector, context.TODO(), "staging", "nginx")
+		Expect(err).To(BeNil())
+		Expect(release.Namespace).To(Equal("staging"))
+	})
+
+	It("storeManifestObject does not store the data of release Secrets", func() {
+		dir, err := os.MkdirTemp("", "applications")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		secret := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]interface{}{"namespace": "web", "name": "nginx-auth"},
+			"data":       map[string]interface{}{"password": base64.StdEncoding.EncodeToString([]byte("s3cr3t"))},
+			"stringData": map[string]interface{}{"token": "t0k3n"},
+		}}
+		Expect(utils.StoreManifestObject(newTestCollector(nil, utils.WithDirectory(dir)), secret, logr.Discard())).To(Succeed())
+
+		content, err := os.ReadFile(filepath.Join(dir, "resources", "web", "Secret", "nginx-auth.yaml"))
+		Expect(err).To(BeNil())
+		Expect(string(content)).To(ContainSubstring("password: <redacted>"))
+		Expect(string(content)).ToNot(ContainSubstring(base64.StdEncoding.EncodeToString([]byte("s3cr3t"))))
+		Expect(string(content)).ToNot(ContainSubstring("t0k3n"))
+	})
+
+	It("Collect collects objects of the Helm release manifest once", func() {
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "nginx",
+			Labels: map[string]string{"app.kubernetes.io/instance": "nginx"}}}
+		objects := []client.Object{helmReleaseSecret("web", "nginx", 1), deployment}
+
+		results := utils.NewMemoryResults()
+		options := append(results.Options(), utils.WithClientset(servingClientset(objects...)))
+		collector := newTestCollector(objects, options...)
+
+		config := &utils.Configuration{
+			Applications: []utils.Application{{Namespace: "web", HelmRelease: "nginx"}},
+		}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		Expect(results.Objects()).To(HaveLen(1))
+		Expect(collector.Summary().Objects).To(Equal(1))
+	})
+
+	It("decodeHelmRelease decodes a gzipped release", func() {
+		release := map[string]interface{}{
+			"name":      "nginx",
+			"namespace": "web",
+			"version":   3,
+			"manifest":  helmManifest,
+			"config": map[string]interface{}{
+				"replicaCount": 2,
+			},
+			"info": map[string]interface{}{"status": "deployed"},
+		}
+
+		data, err := json.Marshal(release)
+		Expect(err).To(BeNil())
+
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err = w.Write(data)
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+		decoded, err := utils.DecodeHelmRelease([]byte(encoded))
+		Expect(err).To(BeNil())
+		Expect(decoded.Name).To(Equal("nginx"))
+		Expect(decoded.Namespace).To(Equal("web"))
+		Expect(decoded.Version).To(Equal(3))
+		Expect(decoded.Info.Status).To(Equal("deployed"))
+
+		objects, err := utils.ParseManifest(decoded.Manifest)
+		Expect(err).To(BeNil())
+		Expect(len(objects)).To(Equal(2))
+		Expect(objects[0].GetKind()).To(Equal("ServiceAccount"))
+		Expect(objects[1].GetNamespace()).To(Equal("web"))
+	})
+
+	It("redactValues redacts sensitive values only", func() {
+		values := map[string]interface{}{
+			"replicaCount": 2,
+			"auth": map[string]interface{}{
+				"enabled":       true,
+				"adminPassword": "foo",
+				"api-token":     "bar",
+			},
+			"extraEnv": []interface{}{"a", "b"},
+		}
+
+		redacted := utils.RedactValues(values)
+		Expect(redacted["replicaCount"]).To(Equal(2))
+		Expect(redacted["extraEnv"]).To(Equal([]interface{}{"a", "b"}))
+
+		auth := redacted["auth"].(map[string]interface{})
+		Expect(auth["enabled"]).To(Equal(true))
+		Expect(auth["adminPassword"]).To(Equal("<redacted>"))
+		Expect(auth["api-token"]).To(Equal("<redacted>"))
+
+		// Original values are not modified
+		Expect(values["auth"].(map[string]interface{})["adminPassword"]).To(Equal("foo"))
+	})
+})
@@ -0,0 +1,337 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+const (
+	// Budget categories
+	budgetTotal     = "total"
+	budgetLogs      = "logs"
+	budgetResources = "resources"
+	budgetEvents    = "events"
+
+	// truncationMarker ends a log file truncated because the budget of a category was exhausted
+	truncationMarker = "\n[k8s-collector: truncated, %s budget exhausted]\n"
+	// markerReserve is the budget kept, in each category, for truncation markers
+	markerReserve = int64(len(truncationMarker) + len(budgetResources))
+
+	// Pod priorities when a budget is set
+	priorityDefault   = 0
+	priorityRestarted = 1
+	priorityWarning   = 2
+)
+
+// errBudgetExhausted stops the collection of logs truncated by the budget.
+var errBudgetExhausted = errors.New("budget exhausted")
+
+// budget tracks the size of the data collected against a Budget.
+// A nil budget is unlimited. It is safe for concurrent use.
+type budget struct {
+	mu     sync.Mutex
+	limits map[string]int64
+	used   map[string]int64
+}
+
+// newBudget returns the budget of config, nil if config is nil.
+func newBudget(config *Budget) *budget {
+	if config == nil {
+		return nil
+	}
+
+	b := &budget{limits: make(map[string]int64), used: make(map[string]int64)}
+	for category, limit := range map[string]*int64{
+		budgetTotal: config.TotalBytes, budgetLogs: config.LogsBytes,
+		budgetResources: config.ResourcesBytes, budgetEvents: config.EventsBytes,
+	} {
+		if limit != nil {
+			b.limits[category] = *limit
+		}
+	}
+	return b
+}
+
+// budgetCategory returns the category of the file at relPath. Applications and captured
+// pods only count towards the total budget. Other files (e.g. summary.yaml) are not limited.
+func budgetCategory(relPath string) (category string, limited bool) {
+	parts := strings.Split(relPath, "/")
+	switch parts[0] {
+	case logsDir:
+		return budgetLogs, true
+	case resourcesDir:
+		// resources/<namespace>/<kind>/<name>.yaml or resources/<kind>/<name>.yaml
+		if len(parts) >= clusterResourceDepth && parts[len(parts)-2] == eventKind {
+			return budgetEvents, true
+		}
+		return budgetResources, true
+	case applicationsDir, capturedDir:
+		return budgetTotal, true
+	default:
+		return "", false
+	}
+}
+
+// remaining returns how many bytes can still be written in the file at relPath and,
+// if it is limited, the category limiting it. It must be called with mu held.
+func (b *budget) remaining(relPath string) (remaining int64, limiting string) {
+	category, limited := budgetCategory(relPath)
+	if !limited {
+		return -1, ""
+	}
+
+	remaining = -1
+	for _, c := range []string{category, budgetTotal} {
+		limit, ok := b.limits[c]
+		if !ok {
+			continue
+		}
+		if left := max(limit-b.used[c], 0); remaining < 0 || left < remaining {
+			remaining, limiting = left, c
+		}
+	}
+	return remaining, limiting
+}
+
+// charge counts n bytes written in the file at relPath. It must be called with mu held.
+func (b *budget) charge(relPath string, n int64) {
+	category, limited := budgetCategory(relPath)
+	if !limited {
+		return
+	}
+
+	b.used[category] += n
+	if category != budgetTotal {
+		b.used[budgetTotal] += n
+	}
+}
+
+// add counts n bytes written in the file at relPath, even if they exceed the budget.
+func (b *budget) add(relPath string, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.charge(relPath, n)
+}
+
+// reserve counts a whole file of n bytes at relPath. If it does not fit, nothing
+// is counted and the exhausted category is returned.
+func (b *budget) reserve(relPath string, n int64) (exhausted string) {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if remaining, limiting := b.remaining(relPath); remaining >= 0 && n > remaining {
+		return limiting
+	}
+	b.charge(relPath, n)
+	return ""
+}
+
+// take counts up to n bytes of logs written at relPath, keeping room for a truncation
+// marker. It returns how many bytes can be written and, if fewer than n, the exhausted category.
+func (b *budget) take(relPath string, n int64) (granted int64, exhausted string) {
+	if b == nil {
+		return n, ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	remaining, limiting := b.remaining(relPath)
+	if remaining < 0 {
+		b.charge(relPath, n)
+		return n, ""
+	}
+
+	granted = min(n, max(remaining-markerReserve, 0))
+	b.charge(relPath, granted)
+	if granted < n {
+		return granted, limiting
+	}
+	return granted, ""
+}
+
+// exhausted returns the category whose budget leaves no room for the file at
+// relPath, an empty string if there is room.
+func (b *budget) exhausted(relPath string) string {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if remaining, limiting := b.remaining(relPath); remaining >= 0 && remaining <= markerReserve {
+		return limiting
+	}
+	return ""
+}
+
+// budgetWriter writes logs to w until the budget is exhausted, then a truncation
+// marker. Further writes fail with errBudgetExhausted.
+type budgetWriter struct {
+	collector *Collector
+	relPath   string
+	w         io.WriteCloser
+	truncated bool
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	if w.truncated {
+		return 0, errBudgetExhausted
+	}
+
+	granted, exhausted := w.collector.budget.take(w.relPath, int64(len(p)))
+	n, err := w.w.Write(p[:granted])
+	if err != nil || exhausted == "" {
+		return n, err
+	}
+
+	w.truncated = true
+	marker := fmt.Sprintf(truncationMarker, exhausted)
+	w.collector.budget.add(w.relPath, int64(len(marker)))
+	if _, err := io.WriteString(w.w, marker); err != nil {
+		return n, err
+	}
+	w.collector.recordTruncated(w.relPath, exhausted)
+	return n, errBudgetExhausted
+}
+
+func (w *budgetWriter) Close() error {
+	return w.w.Close()
+}
+
+// startBudget starts tracking the budget of config. Collectors of a multi-cluster
+// collection share the budget of the whole collection.
+func (a *Collector) startBudget(config *Configuration) {
+	if !a.inheritBudget {
+		a.budget = newBudget(config.Budget)
+	}
+}
+
+// recordDropped records a file not stored because the budget of category was exhausted.
+func (a *Collector) recordDropped(relPath, category string) {
+	a.logger.Info(fmt.Sprintf("%s budget exhausted: %s dropped", category, relPath))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Dropped = append(a.summary.Dropped, relPath)
+	}
+}
+
+// recordTruncated records a log file truncated because the budget of category was exhausted.
+func (a *Collector) recordTruncated(relPath, category string) {
+	a.logger.Info(fmt.Sprintf("%s budget exhausted: %s truncated", category, relPath))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Truncated = append(a.summary.Truncated, relPath)
+	}
+}
+
+// prioritizePods sorts pods, of all log entries, so that, when a budget is set, the
+// logs of pods with Warning events, then of pods with restarted containers, are
+// collected first. namespaces are the namespaces pods were listed in.
+func (a *Collector) prioritizePods(ctx context.Context, namespaces []string, pods []logPod, logger logr.Logger) {
+	if a.budget == nil || len(pods) == 0 {
+		return
+	}
+
+	// Events are listed once per namespace, cluster-wide if any entry was
+	warningNamespaces := make(map[string]bool, len(namespaces))
+	for i := range namespaces {
+		if namespaces[i] == "" {
+			warningNamespaces = map[string]bool{"": true}
+			break
+		}
+		warningNamespaces[namespaces[i]] = true
+	}
+
+	warnings := make(map[string]bool)
+	selector := fields.Set{"type": corev1.EventTypeWarning, "involvedObject.kind": podKind}.AsSelector().String()
+	for namespace := range warningNamespaces {
+		var events *corev1.EventList
+		err := a.doRequest(ctx, fmt.Sprintf("list Warning events in namespace %q", namespace),
+			func(ctx context.Context) (err error) {
+				events, err = a.clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+				return err
+			})
+		if err != nil {
+			logger.Info(fmt.Sprintf("failed to list Warning events in namespace %q, pods are not prioritized by events: %v",
+				namespace, err))
+			continue
+		}
+		for i := range events.Items {
+			event := &events.Items[i]
+			// Field selectors are not honored by every client
+			if event.Type == corev1.EventTypeWarning && event.InvolvedObject.Kind == podKind {
+				warnings[event.InvolvedObject.Namespace+"/"+event.InvolvedObject.Name] = true
+			}
+		}
+	}
+
+	priority := func(pod *corev1.Pod) int {
+		if warnings[pod.Namespace+"/"+pod.Name] {
+			return priorityWarning
+		}
+		for i := range pod.Status.ContainerStatuses {
+			if hasPreviousRun(&pod.Status.ContainerStatuses[i]) {
+				return priorityRestarted
+			}
+		}
+		return priorityDefault
+	}
+	sort.SliceStable(pods, func(i, j int) bool {
+		return priority(pods[i].pod) > priority(pods[j].pod)
+	})
+}
+
+// prioritizeLogReferences sorts refs so that, when a budget is set, the logs of
+// restarted containers are collected first.
+func (a *Collector) prioritizeLogReferences(pod *corev1.Pod, refs []LogReference) {
+	if a.budget == nil {
+		return
+	}
+
+	restarted := func(ref *LogReference) bool {
+		status := containerStatus(pod, ref.Container)
+		return status != nil && hasPreviousRun(status)
+	}
+	sort.SliceStable(refs, func(i, j int) bool {
+		return restarted(&refs[i]) && !restarted(&refs[j])
+	})
+}
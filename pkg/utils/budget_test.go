@@ -0,0 +1,181 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Budget", func() {
+	var objects []client.Object
+
+	BeforeEach(func() {
+		warning := runningPod("b-warning", 0)
+		objects = []client.Object{
+			runningPod("a-quiet", 0), warning, runningPod("c-restarted", 1),
+			&corev1.Event{
+				ObjectMeta:     metav1.ObjectMeta{Namespace: "kube-system", Name: "b-warning.1"},
+				InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "kube-system", Name: warning.Name},
+				Type:           corev1.EventTypeWarning,
+				Reason:         "Unhealthy",
+			},
+		}
+	})
+
+	It("Collect collects logs of pods with Warning events, then of restarted containers, first", func() {
+		order := make([]string, 0)
+		collector := newTestCollector(objects, utils.WithLogHandler(func(ref utils.LogReference, logs io.Reader) error {
+			order = append(order, ref.String())
+			_, err := io.Copy(io.Discard, logs)
+			return err
+		}))
+
+		totalBytes := int64(1024 * 1024)
+		config := &utils.Configuration{
+			Logs:   []utils.Log{{Namespace: "kube-system"}},
+			Budget: &utils.Budget{TotalBytes: &totalBytes},
+		}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		Expect(order).To(HaveLen(4))
+		Expect(order[0]).To(ContainSubstring("b-warning"))
+		Expect(order[1]).To(ContainSubstring("c-restarted"))
+		Expect(order[2]).To(ContainSubstring("c-restarted"))
+		Expect(order[3]).To(ContainSubstring("a-quiet"))
+	})
+
+	It("Collect ranks pods of all log entries, application logs included, in the logs phase", func() {
+		quiet := runningPod("web-quiet", 0)
+		quiet.Namespace = "web"
+		application := runningPod("nginx", 0)
+		application.Namespace = "apps"
+		application.Labels = map[string]string{"app.kubernetes.io/instance": "nginx"}
+		objects = append(objects, quiet, application)
+
+		order := make([]string, 0)
+		collector := newTestCollector(objects, utils.WithClientset(servingClientset(objects...)),
+			utils.WithLogHandler(func(ref utils.LogReference, logs io.Reader) error {
+				order = append(order, ref.String())
+				_, err := io.Copy(io.Discard, logs)
+				return err
+			}))
+
+		totalBytes := int64(1024 * 1024)
+		config := &utils.Configuration{
+			Logs:         []utils.Log{{Namespace: "web"}, {Namespace: "kube-system"}},
+			Applications: []utils.Application{{Namespace: "apps", Instance: "nginx"}},
+			Budget:       &utils.Budget{TotalBytes: &totalBytes},
+		}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		Expect(order).To(HaveLen(6))
+		Expect(order[0]).To(ContainSubstring("b-warning"))
+		Expect(order[1]).To(ContainSubstring("c-restarted"))
+		Expect(order[2]).To(ContainSubstring("c-restarted"))
+		Expect(order[3]).To(ContainSubstring("web-quiet"))
+		Expect(order[4]).To(ContainSubstring("a-quiet"))
+		Expect(order[5]).To(ContainSubstring("apps/nginx"))
+	})
+
+	It("Collect drops logs once the logs budget is exhausted and records them", func() {
+		dir, err := os.MkdirTemp("", "budget")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector(objects, utils.WithDirectory(dir))
+		logsBytes := int64(1)
+		config := &utils.Configuration{
+			Logs:   []utils.Log{{Namespace: "kube-system"}},
+			Budget: &utils.Budget{LogsBytes: &logsBytes},
+		}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		summary := collector.Summary()
+		Expect(summary.Dropped).To(ContainElements("logs/kube-system/a-quiet-coredns",
+			"logs/kube-system/a-quiet-coredns.status.yaml", "logs/kube-system/c-restarted-coredns.previous"))
+		Expect(filepath.Join(dir, "logs", "kube-system", "a-quiet-coredns")).ToNot(BeAnExistingFile())
+		// summary.yaml is not limited
+		Expect(filepath.Join(dir, "summary.yaml")).To(BeAnExistingFile())
+	})
+
+	It("log files are truncated with a marker when the budget is exhausted", func() {
+		dir, err := os.MkdirTemp("", "budget")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector(objects, utils.WithDirectory(dir))
+		logsBytes := utils.BudgetMarkerReserve + 10
+		utils.SetBudget(collector, &utils.Budget{LogsBytes: &logsBytes})
+
+		w, err := utils.CreateLogFile(collector, "logs/kube-system/coredns-coredns")
+		Expect(err).To(BeNil())
+		_, err = w.Write([]byte(strings.Repeat("line\n", 4)))
+		Expect(err).ToNot(BeNil())
+		_, err = w.Write([]byte("more\n"))
+		Expect(err).ToNot(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		data, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", "coredns-coredns"))
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(Equal("line\nline\n\n[k8s-collector: truncated, logs budget exhausted]\n"))
+		Expect(int64(len(data))).To(BeNumerically("<=", logsBytes))
+	})
+
+	It("dumpObject counts only the objects stored within the budget", func() {
+		dir, err := os.MkdirTemp("", "budget")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector(nil, utils.WithDirectory(dir))
+		utils.StartSummary(collector)
+		resourcesBytes := int64(1)
+		utils.SetBudget(collector, &utils.Budget{ResourcesBytes: &resourcesBytes})
+
+		Expect(utils.DumpObject(collector, objects[0], logr.Discard())).To(Succeed())
+
+		summary := collector.Summary()
+		Expect(summary.Objects).To(BeZero())
+		Expect(summary.Resources).To(BeEmpty())
+		Expect(summary.Dropped).To(ContainElement("resources/kube-system/Pod/a-quiet.yaml"))
+	})
+
+	It("budgetCategory separates Events from other resources", func() {
+		category, limited := utils.BudgetCategory("resources/kube-system/Event/coredns.1.yaml")
+		Expect(limited).To(BeTrue())
+		Expect(category).To(Equal("events"))
+
+		category, _ = utils.BudgetCategory("resources/Node/node1.yaml")
+		Expect(category).To(Equal("resources"))
+
+		_, limited = utils.BudgetCategory("summary.yaml")
+		Expect(limited).To(BeFalse())
+	})
+})
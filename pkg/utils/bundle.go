@@ -0,0 +1,302 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	resourcesDir    = "resources"
+	logsDir         = "logs"
+	applicationsDir = "applications"
+
+	// Number of path components of collected files
+	clusterResourceDepth    = 3 // resources/<kind>/<name>.yaml
+	namespacedResourceDepth = 4 // resources/<namespace>/<kind>/<name>.yaml
+	applicationFileDepth    = 4 // applications/<namespace>/<name>/<file>
+)
+
+// BundleSummary summarises the content of a directory collected data was stored in.
+type BundleSummary struct {
+	// Resources is the number of collected resources per Kind.
+	Resources map[string]int `json:"resources,omitempty" yaml:"resources,omitempty"`
+
+	// Namespaces contains all namespaces resources or logs were collected from.
+	Namespaces []string `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
+
+	// Logs is the number of collected container logs.
+	Logs int `json:"logs" yaml:"logs"`
+
+	// LogBytes is the total size of collected logs.
+	LogBytes int64 `json:"logBytes" yaml:"logBytes"`
+
+	// Applications contains the collected applications (<namespace>/<name>).
+	Applications []string `json:"applications,omitempty" yaml:"applications,omitempty"`
+
+	// Captured is the number of pods captured when they terminated.
+	Captured int `json:"captured,omitempty" yaml:"captured,omitempty"`
+
+	// Clusters summarises the data collected from each cluster, when collecting
+	// from multiple clusters.
+	Clusters []ClusterSummary `json:"clusters,omitempty" yaml:"clusters,omitempty"`
+}
+
+// ClusterSummary summarises the data collected from a cluster.
+type ClusterSummary struct {
+	// Name of the cluster directory.
+	Name string `json:"name" yaml:"name"`
+
+	// Status is the content of the cluster status.yaml file, if present.
+	Status *ClusterStatus `json:"status,omitempty" yaml:"status,omitempty"`
+
+	// Summary of the data collected from the cluster.
+	Summary *BundleSummary `json:"summary" yaml:"summary"`
+}
+
+// BundleDiff lists the files that differ between two bundles. Paths are
+// relative to the bundle directory. Logs, status and summary files are not compared.
+type BundleDiff struct {
+	// Added contains files only present in the new bundle.
+	Added []string `json:"added,omitempty" yaml:"added,omitempty"`
+
+	// Removed contains files only present in the old bundle.
+	Removed []string `json:"removed,omitempty" yaml:"removed,omitempty"`
+
+	// Changed contains files present in both bundles with different content.
+	Changed []string `json:"changed,omitempty" yaml:"changed,omitempty"`
+}
+
+// IsEmpty returns true if bundles do not differ.
+func (d *BundleDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// InspectBundle summarises the content of directory, where collected data was stored.
+func InspectBundle(directory string) (*BundleSummary, error) {
+	return summarizeBundle(os.DirFS(directory))
+}
+
+// DiffBundles compares the resources and applications stored in two directories.
+func DiffBundles(oldDirectory, newDirectory string) (*BundleDiff, error) {
+	return diffBundles(os.DirFS(oldDirectory), os.DirFS(newDirectory))
+}
+
+func summarizeBundle(fsys fs.FS) (*BundleSummary, error) {
+	summary := &BundleSummary{Resources: make(map[string]int)}
+	namespaces := make(map[string]bool)
+	applications := make(map[string]bool)
+	captured := make(map[string]bool)
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == clustersDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		parts := strings.Split(p, "/")
+		switch parts[0] {
+		case resourcesDir:
+			// Descriptions are derived from the resources they are next to
+			if len(parts) < clusterResourceDepth || strings.HasSuffix(p, describeSuffix) {
+				return nil
+			}
+			summary.Resources[parts[len(parts)-2]]++
+			if len(parts) == namespacedResourceDepth {
+				namespaces[parts[1]] = true
+			}
+		case logsDir:
+			// logs/<namespace>/<pod>-<container>, and the status of the container
+			if strings.HasSuffix(p, containerStatusSuffix) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			summary.Logs++
+			summary.LogBytes += info.Size()
+			namespaces[parts[1]] = true
+		case applicationsDir:
+			if len(parts) == applicationFileDepth {
+				applications[path.Join(parts[1], parts[2])] = true
+			}
+		case capturedDir:
+			// captured/<snapshot>/, with the same layout as a bundle
+			if len(parts) > 2 {
+				captured[parts[1]] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary.Namespaces = sortedKeys(namespaces)
+	summary.Applications = sortedKeys(applications)
+	summary.Captured = len(captured)
+
+	summary.Clusters, err = summarizeClusters(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+func summarizeClusters(fsys fs.FS) ([]ClusterSummary, error) {
+	entries, err := fs.ReadDir(fsys, clustersDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	clusters := make([]ClusterSummary, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		clusterFS, err := fs.Sub(fsys, path.Join(clustersDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		cluster := ClusterSummary{Name: entry.Name()}
+		if content, err := fs.ReadFile(clusterFS, statusFile); err == nil {
+			status := &ClusterStatus{}
+			if err := yaml.Unmarshal(content, status); err == nil {
+				cluster.Status = status
+			}
+		}
+
+		cluster.Summary, err = summarizeBundle(clusterFS)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, nil
+}
+
+func diffBundles(oldFS, newFS fs.FS) (*BundleDiff, error) {
+	oldFiles, err := comparableFiles(oldFS)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := comparableFiles(newFS)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &BundleDiff{}
+	for _, p := range sortedKeys(oldFiles) {
+		if !newFiles[p] {
+			diff.Removed = append(diff.Removed, p)
+			continue
+		}
+
+		oldContent, err := fs.ReadFile(oldFS, p)
+		if err != nil {
+			return nil, err
+		}
+		newContent, err := fs.ReadFile(newFS, p)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(oldContent, newContent) {
+			diff.Changed = append(diff.Changed, p)
+		}
+	}
+
+	for _, p := range sortedKeys(newFiles) {
+		if !oldFiles[p] {
+			diff.Added = append(diff.Added, p)
+		}
+	}
+
+	return diff, nil
+}
+
+// comparableFiles returns all files of a bundle except logs, status and summary
+// files, which differ on every collection.
+func comparableFiles(fsys fs.FS) (map[string]bool, error) {
+	files := make(map[string]bool)
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isVolatile(p) {
+			return nil
+		}
+		files[p] = true
+		return nil
+	})
+
+	return files, err
+}
+
+// isVolatile returns true for files, of a bundle, that are not compared.
+func isVolatile(p string) bool {
+	parts := strings.Split(p, "/")
+	if parts[0] == clustersDir {
+		// clusters/status.yaml, while clusters/<cluster>/ has the same layout as a bundle
+		parts = parts[1:]
+		if len(parts) > 1 {
+			parts = parts[1:]
+		}
+	}
+
+	if strings.HasSuffix(p, describeSuffix) {
+		// Descriptions change with the events of the resources they are next to
+		return true
+	}
+	if len(parts) == 1 {
+		switch parts[0] {
+		case statusFile, summaryFile, overviewMarkdownFile, overviewHTMLFile:
+			return true
+		}
+	}
+	return parts[0] == logsDir || parts[0] == capturedDir
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
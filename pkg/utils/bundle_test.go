@@ -0,0 +1,92 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+func writeBundleFile(dir, relPath, content string) {
+	filename := filepath.Join(dir, filepath.FromSlash(relPath))
+	Expect(os.MkdirAll(filepath.Dir(filename), 0755)).To(Succeed())
+	Expect(os.WriteFile(filename, []byte(content), 0600)).To(Succeed())
+}
+
+var _ = Describe("Bundle", func() {
+	var oldDir, newDir string
+
+	BeforeEach(func() {
+		oldDir = GinkgoT().TempDir()
+		newDir = GinkgoT().TempDir()
+
+		for _, dir := range []string{oldDir, newDir} {
+			writeBundleFile(dir, "resources/default/Deployment/web.yaml", "kind: Deployment")
+			writeBundleFile(dir, "resources/Node/node1.yaml", "kind: Node")
+			writeBundleFile(dir, "applications/default/web/values.yaml", "replicas: 1")
+			writeBundleFile(dir, "clusters/status.yaml", "- cluster: prod")
+			writeBundleFile(dir, "clusters/prod/status.yaml",
+				"cluster: prod\nstatus: Failed\nfailureMessage: forbidden\n")
+			writeBundleFile(dir, "clusters/prod/resources/kube-system/Pod/coredns.yaml", "kind: Pod")
+		}
+		writeBundleFile(oldDir, "logs/kube-system/coredns-coredns", "old logs")
+		writeBundleFile(newDir, "logs/kube-system/coredns-coredns", "new logs!")
+	})
+
+	It("InspectBundle summarises collected data", func() {
+		summary, err := utils.InspectBundle(oldDir)
+		Expect(err).To(BeNil())
+		Expect(summary.Resources).To(Equal(map[string]int{"Deployment": 1, "Node": 1}))
+		Expect(summary.Namespaces).To(Equal([]string{"default", "kube-system"}))
+		Expect(summary.Logs).To(Equal(1))
+		Expect(summary.LogBytes).To(Equal(int64(len("old logs"))))
+		Expect(summary.Applications).To(Equal([]string{"default/web"}))
+
+		Expect(summary.Clusters).To(HaveLen(1))
+		cluster := summary.Clusters[0]
+		Expect(cluster.Name).To(Equal("prod"))
+		Expect(cluster.Status).ToNot(BeNil())
+		Expect(cluster.Status.Status).To(Equal(utils.ClusterFailed))
+		Expect(cluster.Status.FailureMessage).To(Equal("forbidden"))
+		Expect(cluster.Summary.Resources).To(Equal(map[string]int{"Pod": 1}))
+	})
+
+	It("DiffBundles ignores logs and status files", func() {
+		writeBundleFile(newDir, "clusters/prod/status.yaml", "cluster: prod\nstatus: Succeeded\n")
+
+		diff, err := utils.DiffBundles(oldDir, newDir)
+		Expect(err).To(BeNil())
+		Expect(diff.IsEmpty()).To(BeTrue())
+	})
+
+	It("DiffBundles reports added, removed and changed files", func() {
+		writeBundleFile(newDir, "resources/default/Deployment/web.yaml", "kind: Deployment\nreplicas: 2")
+		writeBundleFile(newDir, "clusters/prod/resources/kube-system/Pod/etcd.yaml", "kind: Pod")
+		Expect(os.Remove(filepath.Join(newDir, "resources", "Node", "node1.yaml"))).To(Succeed())
+
+		diff, err := utils.DiffBundles(oldDir, newDir)
+		Expect(err).To(BeNil())
+		Expect(diff.Added).To(Equal([]string{"clusters/prod/resources/kube-system/Pod/etcd.yaml"}))
+		Expect(diff.Removed).To(Equal([]string{"resources/Node/node1.yaml"}))
+		Expect(diff.Changed).To(Equal([]string{"resources/default/Deployment/web.yaml"}))
+	})
+})
@@ -0,0 +1,481 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	capturedDir = "captured"
+
+	// captureTmpPrefix prefixes the directories of snapshots being written
+	captureTmpPrefix = ".tmp-"
+	// captureLockFile is locked by the processes using a capture buffer
+	captureLockFile = ".lock"
+	// includedMarker is created in a snapshot once it is included in collected data
+	includedMarker = ".included"
+	// captureLayout sorts snapshots by capture time
+	captureLayout = "20060102-150405.000"
+	// captureConcurrency is the maximum number of snapshots taken in parallel
+	captureConcurrency = 10
+
+	// DefaultCaptureMaxBytes is the default size of a capture buffer, 1GiB.
+	DefaultCaptureMaxBytes = 1 << 30
+)
+
+// CaptureBuffer is a bounded ring buffer, on disk, of snapshots of terminated
+// pods: each snapshot is a directory, with the same layout as a bundle, containing
+// the pod and its logs. When the buffer exceeds its size, oldest snapshots are removed.
+// It is safe for concurrent use, including by other processes sharing the directory.
+type CaptureBuffer struct {
+	directory string
+	maxBytes  int64
+
+	mu sync.Mutex
+}
+
+// NewCaptureBuffer returns the buffer stored in directory, creating it if needed.
+// Snapshots left incomplete by a previous process are removed.
+func NewCaptureBuffer(directory string, maxBytes int64) (*CaptureBuffer, error) {
+	if err := os.MkdirAll(directory, permission0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), captureTmpPrefix) {
+			if err := os.RemoveAll(filepath.Join(directory, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &CaptureBuffer{directory: directory, maxBytes: maxBytes}, nil
+}
+
+// Snapshots returns the names of the snapshots in the buffer, oldest first.
+func (b *CaptureBuffer) Snapshots() ([]string, error) {
+	unlock, err := b.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return b.snapshots()
+}
+
+// lock locks the buffer until the returned function is called. Buffer is locked
+// with a file, as a collector including the snapshots in collected data usually
+// runs in another process than the one capturing them.
+func (b *CaptureBuffer) lock() (func(), error) {
+	b.mu.Lock()
+	unlock, err := lockFile(filepath.Join(b.directory, captureLockFile))
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlock()
+		b.mu.Unlock()
+	}, nil
+}
+
+func (b *CaptureBuffer) snapshots() ([]string, error) {
+	entries, err := os.ReadDir(b.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), captureTmpPrefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	// Names start with the capture time
+	sort.Strings(names)
+	return names, nil
+}
+
+// has returns true if the buffer contains a snapshot of the pod with uid.
+func (b *CaptureBuffer) has(uid types.UID) (bool, error) {
+	names, err := b.Snapshots()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, string(uid)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// begin returns the directory a new snapshot is written to. It is not part of
+// the buffer until committed.
+func (b *CaptureBuffer) begin() (string, error) {
+	return os.MkdirTemp(b.directory, captureTmpPrefix)
+}
+
+// commit adds the snapshot written in tmp to the buffer, then removes the oldest
+// snapshots until the buffer fits its size. The new snapshot is always kept.
+func (b *CaptureBuffer) commit(tmp, name string) error {
+	unlock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Rename(tmp, filepath.Join(b.directory, name)); err != nil {
+		return err
+	}
+
+	names, err := b.snapshots()
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(names))
+	var total int64
+	for i := range names {
+		sizes[i], err = directorySize(filepath.Join(b.directory, names[i]))
+		if err != nil {
+			return err
+		}
+		total += sizes[i]
+	}
+
+	for i := 0; i < len(names)-1 && total > b.maxBytes; i++ {
+		if err := os.RemoveAll(filepath.Join(b.directory, names[i])); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+// directorySize returns the size of the files in directory.
+func directorySize(directory string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(directory, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// WithCaptureDirectory includes the snapshots of the capture buffer stored in
+// directory (see RunCapture) in the collected data, in captured/. Each snapshot
+// is included once: later collections skip it.
+func WithCaptureDirectory(directory string) Option {
+	return func(a *Collector) {
+		a.captureDirectory = directory
+	}
+}
+
+// includeCaptured copies the snapshots of the capture buffer in the sink.
+func (a *Collector) includeCaptured(logger logr.Logger) error {
+	if a.captureDirectory == "" || a.sink == nil {
+		return nil
+	}
+
+	// The lock file excludes the capture process
+	buffer := &CaptureBuffer{directory: a.captureDirectory}
+	unlock, err := buffer.lock()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer unlock()
+
+	names, err := buffer.snapshots()
+	if err != nil {
+		return err
+	}
+
+	pending := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(a.captureDirectory, name, includedMarker)); err != nil {
+			pending = append(pending, name)
+		}
+	}
+
+	logger.Info(fmt.Sprintf("including %d captured pod(s)", len(pending)))
+	fsys := os.DirFS(a.captureDirectory)
+	for _, name := range pending {
+		complete := true
+		err := fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			stored, err := a.copyFile(fsys, p, path.Join(capturedDir, p))
+			complete = complete && stored
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		// Snapshots whose files were dropped because of the budget are included again
+		if complete {
+			marker := filepath.Join(a.captureDirectory, name, includedMarker)
+			if err := os.WriteFile(marker, nil, permission0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	a.countCaptured(len(pending))
+	return nil
+}
+
+// copyFile copies the file at p in fsys to relPath in the sink. It returns false
+// if the file was dropped because the budget is exhausted.
+func (a *Collector) copyFile(fsys fs.FS, p, relPath string) (stored bool, err error) {
+	info, err := fs.Stat(fsys, p)
+	if err != nil {
+		return false, err
+	}
+	if category := a.budget.reserve(relPath, info.Size()); category != "" {
+		a.recordDropped(relPath, category)
+		return false, nil
+	}
+
+	in, err := fsys.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	out, err := a.sink.Create(relPath)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	n, err := io.Copy(out, in)
+	a.metrics.observeBytesWritten(relPath, n)
+	return err == nil, err
+}
+
+// capturer snapshots pods into a capture buffer.
+type capturer struct {
+	collector *Collector
+	buffer    *CaptureBuffer
+	logger    logr.Logger
+
+	mu sync.Mutex
+	// captured contains the pods already captured
+	captured  map[types.UID]bool
+	semaphore chan struct{}
+	wg        sync.WaitGroup
+}
+
+// RunCapture watches the pods matching logs and, when a pod terminates or is about
+// to be deleted (its deletionTimestamp is set), snapshots the pod and its logs into
+// buffer. Logs of pods being deleted are followed until their containers exit, or
+// the log stream timeout expires. Snapshots are included in the next bundles
+// collected WithCaptureDirectory. RunCapture returns when ctx is done.
+func (a *Collector) RunCapture(ctx context.Context, logs []Log, buffer *CaptureBuffer) error {
+	c := &capturer{
+		collector: a,
+		buffer:    buffer,
+		logger:    a.logger,
+		captured:  make(map[types.UID]bool),
+		semaphore: make(chan struct{}, captureConcurrency),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.observe(ctx, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.observe(ctx, obj) },
+		DeleteFunc: c.forget,
+	}
+
+	factories := make([]informers.SharedInformerFactory, 0)
+	for i := range logs {
+		namespaces, reason := a.entryNamespaces(logs[i].Namespace)
+		if reason != "" {
+			a.logger.Info(fmt.Sprintf("logs in namespace %q not captured: %s", logs[i].Namespace, reason))
+			continue
+		}
+
+		selector := labelFiltersSelector(logs[i].LabelFilters)
+		for _, namespace := range namespaces {
+			factory := informers.NewSharedInformerFactoryWithOptions(a.clientset, 0, informers.WithNamespace(namespace),
+				informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+					options.LabelSelector = selector
+				}))
+			if _, err := factory.Core().V1().Pods().Informer().AddEventHandler(handler); err != nil {
+				return err
+			}
+			factories = append(factories, factory)
+		}
+	}
+	if len(factories) == 0 {
+		return fmt.Errorf("no pod to capture")
+	}
+
+	for i := range factories {
+		factories[i].Start(ctx.Done())
+	}
+	a.logger.Info(fmt.Sprintf("capturing terminated pods in %s", buffer.directory))
+
+	<-ctx.Done()
+	for i := range factories {
+		factories[i].Shutdown()
+	}
+	c.wg.Wait()
+	return nil
+}
+
+// observe snapshots pod, if it terminated or is being deleted and it was not
+// captured yet.
+func (c *capturer) observe(ctx context.Context, obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || !isTerminating(pod) {
+		return
+	}
+
+	c.mu.Lock()
+	captured := c.captured[pod.UID]
+	c.captured[pod.UID] = true
+	c.mu.Unlock()
+	if captured {
+		return
+	}
+
+	// Pods captured before a restart
+	if found, err := c.buffer.has(pod.UID); err != nil || found {
+		return
+	}
+
+	pod = pod.DeepCopy()
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.semaphore <- struct{}{}
+		defer func() { <-c.semaphore }()
+
+		if err := c.snapshot(ctx, pod); err != nil {
+			c.logger.Info(fmt.Sprintf("failed to capture pod %s/%s: %v", pod.Namespace, pod.Name, err))
+		}
+	}()
+}
+
+// forget removes a deleted pod from the captured ones.
+func (c *capturer) forget(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if pod, ok := obj.(*corev1.Pod); ok {
+		c.mu.Lock()
+		delete(c.captured, pod.UID)
+		c.mu.Unlock()
+	}
+}
+
+// isTerminating returns true if pod terminated or is being deleted.
+func isTerminating(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded ||
+		pod.Status.Phase == corev1.PodFailed
+}
+
+// snapshot stores pod and its logs in the buffer. Logs that cannot be collected
+// are reported, the snapshot is stored anyhow.
+func (c *capturer) snapshot(ctx context.Context, pod *corev1.Pod) error {
+	tmp, err := c.buffer.begin()
+	if err != nil {
+		return err
+	}
+
+	logger := c.logger.WithValues("pod", pod.Namespace+"/"+pod.Name)
+	collector, err := c.collector.derive(NewDirectorySink(tmp), logger)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	logger.Info("capturing pod")
+	if err := collector.dumpContainerStatuses(pod, logger); err != nil {
+		logger.Info(fmt.Sprintf("failed to store container statuses: %v", err))
+	}
+	refs := podLogReferences(pod)
+	for i := range refs {
+		podLogOpts := podLogOptions(nil, &refs[i])
+		// Logs written while the pod is being deleted are captured as well
+		podLogOpts.Follow = !refs[i].Previous
+		if err := collector.collectPodLogs(ctx, refs[i], podLogOpts); err != nil {
+			logger.Info(fmt.Sprintf("failed to capture logs of %s: %v", &refs[i], err))
+		}
+	}
+	if err := collector.dumpObject(pod, logger); err != nil {
+		logger.Info(fmt.Sprintf("failed to store pod: %v", err))
+	}
+	if err := collector.writeDescriptions(logger); err != nil {
+		logger.Info(fmt.Sprintf("failed to describe pod: %v", err))
+	}
+
+	name := fmt.Sprintf("%s-%s-%s-%s", c.collector.clock.Now().UTC().Format(captureLayout), pod.Namespace,
+		pod.Name, pod.UID)
+	return c.buffer.commit(tmp, name)
+}
+
+// CapturePermissions returns the permissions RunCapture needs to capture the logs of config.
+func CapturePermissions(config *Configuration, namespaces []string) []Permission {
+	permissions := make([]Permission, 0)
+	for i := range config.Logs {
+		log := config.Logs[i]
+		// Pods are watched, as when following logs
+		log.Follow = &Follow{}
+		permissions = append(permissions, logPermissions(&log, fmt.Sprintf("logs[%d]", i))...)
+	}
+	return restrictPermissions(namespaces, permissions)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+// runCapture runs capture of kube-system pods until the returned function is called.
+func runCapture(collector *utils.Collector, buffer *utils.CaptureBuffer) func() {
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error)
+	go func() {
+		done <- collector.RunCapture(ctx, []utils.Log{{Namespace: "kube-system"}}, buffer)
+	}()
+
+	return func() {
+		cancel()
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+	}
+}
+
+var _ = Describe("Capture", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "capture")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("RunCapture snapshots terminated pods and pods being deleted", func() {
+		succeeded := runningPod("job", 0)
+		succeeded.UID = "uid-job"
+		succeeded.Status.Phase = corev1.PodSucceeded
+		running := runningPod("coredns", 0)
+		running.UID = "uid-coredns"
+
+		clientset := k8sfake.NewSimpleClientset(succeeded, running)
+		collector := newTestCollector(nil, utils.WithClientset(clientset))
+
+		buffer, err := utils.NewCaptureBuffer(dir, utils.DefaultCaptureMaxBytes)
+		Expect(err).To(BeNil())
+		stop := runCapture(collector, buffer)
+		defer stop()
+
+		Eventually(buffer.Snapshots, 5*time.Second).Should(HaveLen(1))
+		Consistently(buffer.Snapshots, time.Second/2).Should(HaveLen(1))
+
+		// Pod being deleted
+		now := metav1.Now()
+		running.DeletionTimestamp = &now
+		_, err = clientset.CoreV1().Pods("kube-system").Update(context.TODO(), running, metav1.UpdateOptions{})
+		Expect(err).To(BeNil())
+		Eventually(buffer.Snapshots, 5*time.Second).Should(HaveLen(2))
+
+		snapshots, err := buffer.Snapshots()
+		Expect(err).To(BeNil())
+		for _, pod := range []*corev1.Pod{succeeded, running} {
+			var snapshot string
+			for i := range snapshots {
+				if strings.HasSuffix(snapshots[i], "-kube-system-"+pod.Name+"-"+string(pod.UID)) {
+					snapshot = snapshots[i]
+				}
+			}
+			Expect(snapshot).ToNot(BeEmpty())
+
+			Expect(filepath.Join(dir, snapshot, "resources", "kube-system", "Pod", pod.Name+".yaml")).To(BeAnExistingFile())
+			logs, err := os.ReadFile(filepath.Join(dir, snapshot, "logs", "kube-system", pod.Name+"-coredns"))
+			Expect(err).To(BeNil())
+			Expect(string(logs)).To(Equal("fake logs"))
+		}
+	})
+
+	It("RunCapture does not capture again pods already in the buffer", func() {
+		pod := runningPod("job", 0)
+		pod.UID = "uid-job"
+		pod.Status.Phase = corev1.PodFailed
+
+		Expect(os.MkdirAll(filepath.Join(dir, "20240101-000000.000-kube-system-job-uid-job"), 0755)).To(Succeed())
+
+		collector := newTestCollector([]client.Object{pod})
+		buffer, err := utils.NewCaptureBuffer(dir, utils.DefaultCaptureMaxBytes)
+		Expect(err).To(BeNil())
+
+		stop := runCapture(collector, buffer)
+		Consistently(buffer.Snapshots, time.Second).Should(HaveLen(1))
+		stop()
+	})
+
+	It("CaptureBuffer removes oldest snapshots and incomplete ones", func() {
+		Expect(os.MkdirAll(filepath.Join(dir, ".tmp-incomplete"), 0755)).To(Succeed())
+
+		buffer, err := utils.NewCaptureBuffer(dir, 20)
+		Expect(err).To(BeNil())
+		Expect(filepath.Join(dir, ".tmp-incomplete")).ToNot(BeADirectory())
+
+		for _, name := range []string{"1-first", "2-second", "3-third"} {
+			tmp, err := utils.BeginCapture(buffer)
+			Expect(err).To(BeNil())
+			Expect(os.WriteFile(filepath.Join(tmp, "pod.yaml"), []byte("0123456789"), 0600)).To(Succeed())
+			Expect(utils.CommitCapture(buffer, tmp, name)).To(Succeed())
+		}
+		Expect(buffer.Snapshots()).To(Equal([]string{"2-second", "3-third"}))
+
+		// The newest snapshot is kept even when it exceeds the size
+		tmp, err := utils.BeginCapture(buffer)
+		Expect(err).To(BeNil())
+		Expect(os.WriteFile(filepath.Join(tmp, "pod.yaml"), make([]byte, 30), 0600)).To(Succeed())
+		Expect(utils.CommitCapture(buffer, tmp, "4-fourth")).To(Succeed())
+		Expect(buffer.Snapshots()).To(Equal([]string{"4-fourth"}))
+	})
+
+	It("Collect includes captured pods", func() {
+		captureDir := filepath.Join(dir, "buffer")
+		snapshot := "20240101-000000.000-kube-system-job-uid-job"
+		Expect(os.MkdirAll(filepath.Join(captureDir, snapshot, "logs", "kube-system"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(captureDir, snapshot, "logs", "kube-system", "job-main"),
+			[]byte("done"), 0600)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(captureDir, ".tmp-incomplete"), 0755)).To(Succeed())
+
+		bundleDir := filepath.Join(dir, "bundle")
+		collector := newTestCollector(nil, utils.WithDirectory(bundleDir), utils.WithCaptureDirectory(captureDir))
+
+		config := &utils.Configuration{Logs: []utils.Log{{Namespace: "kube-system"}}}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		logs, err := os.ReadFile(filepath.Join(bundleDir, "captured", snapshot, "logs", "kube-system", "job-main"))
+		Expect(err).To(BeNil())
+		Expect(string(logs)).To(Equal("done"))
+		Expect(filepath.Join(bundleDir, "captured", ".tmp-incomplete")).ToNot(BeADirectory())
+		Expect(collector.Summary().Captured).To(Equal(1))
+
+		summary, err := utils.InspectBundle(bundleDir)
+		Expect(err).To(BeNil())
+		Expect(summary.Captured).To(Equal(1))
+		Expect(summary.Logs).To(BeZero())
+	})
+
+	It("Collect includes each captured pod once", func() {
+		captureDir := filepath.Join(dir, "buffer")
+		snapshot := "20240101-000000.000-kube-system-job-uid-job"
+		Expect(os.MkdirAll(filepath.Join(captureDir, snapshot, "logs", "kube-system"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(captureDir, snapshot, "logs", "kube-system", "job-main"),
+			[]byte("done"), 0600)).To(Succeed())
+
+		config := &utils.Configuration{Logs: []utils.Log{{Namespace: "kube-system"}}}
+		first := newTestCollector(nil, utils.WithDirectory(filepath.Join(dir, "first")),
+			utils.WithCaptureDirectory(captureDir))
+		Expect(first.Collect(context.TODO(), config)).To(Succeed())
+		Expect(first.Summary().Captured).To(Equal(1))
+		Expect(filepath.Join(captureDir, snapshot, ".included")).To(BeAnExistingFile())
+
+		secondDir := filepath.Join(dir, "second")
+		second := newTestCollector(nil, utils.WithDirectory(secondDir), utils.WithCaptureDirectory(captureDir))
+		Expect(second.Collect(context.TODO(), config)).To(Succeed())
+		Expect(second.Summary().Captured).To(BeZero())
+		Expect(filepath.Join(secondDir, "captured", snapshot)).ToNot(BeADirectory())
+
+		// Snapshot stays in the buffer, so the pod is not captured again
+		buffer, err := utils.NewCaptureBuffer(captureDir, utils.DefaultCaptureMaxBytes)
+		Expect(err).To(BeNil())
+		snapshots, err := buffer.Snapshots()
+		Expect(err).To(BeNil())
+		Expect(snapshots).To(Equal([]string{snapshot}))
+	})
+})
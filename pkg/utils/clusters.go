@@ -0,0 +1,373 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+)
+
+const (
+	clustersDir = "clusters"
+	statusFile  = "status.yaml"
+
+	// ClusterSucceeded indicates collection from a cluster succeeded
+	ClusterSucceeded = "Succeeded"
+	// ClusterFailed indicates collection from a cluster failed
+	ClusterFailed = "Failed"
+)
+
+// Cluster is a cluster logs and resources are collected from.
+type Cluster struct {
+	// Name of the cluster. Data is stored in clusters/<Name> directory.
+	Name string
+
+	// Config is used to access the cluster.
+	Config *rest.Config
+
+	// Err, when set, is why the cluster cannot be accessed (for instance its kubeconfig
+	// is missing). Collection from the cluster is reported as failed.
+	Err error
+
+	// derivedName is set when Name was not chosen by the user (for instance it is the
+	// name of the kubeconfig file) and can be made unique with a suffix.
+	derivedName bool
+}
+
+// ClusterStatus is the outcome of the collection from a cluster.
+type ClusterStatus struct {
+	// Cluster is the name of the cluster.
+	Cluster string `json:"cluster" yaml:"cluster"`
+
+	// Status is either Succeeded or Failed.
+	Status string `json:"status" yaml:"status"`
+
+	// StartTime is when collection started (RFC3339).
+	StartTime string `json:"startTime" yaml:"startTime"`
+
+	// Duration of the collection.
+	Duration string `json:"duration" yaml:"duration"`
+
+	// FailureMessage reports why collection failed.
+	// +optional
+	FailureMessage string `json:"failureMessage,omitempty" yaml:"failureMessage,omitempty"`
+}
+
+// ClusterFromKubeconfig returns the Cluster for a context of a kubeconfig file.
+// If kubeconfig is empty, default loading rules (KUBECONFIG environment variable,
+// $HOME/.kube/config) are used. If kubeContext is empty, current context is used.
+// Cluster is named after kubeContext when set, otherwise after the kubeconfig file
+// (without extension) or, for default loading rules, the current context.
+// Context names such as "default" or "admin@kubernetes" are common to many
+// kubeconfig files: when collecting from multiple clusters, a name that is not
+// kubeContext is made unique with a -<n> suffix.
+func ClusterFromKubeconfig(kubeconfig, kubeContext string) (*Cluster, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		loadingRules.ExplicitPath = kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+	rawConfig, err := clientConfig.RawConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %q: %w", kubeconfig, err)
+	}
+
+	name := kubeContext
+	if name == "" && kubeconfig != "" {
+		name = strings.TrimSuffix(filepath.Base(kubeconfig), filepath.Ext(kubeconfig))
+	}
+	if name == "" {
+		name = rawConfig.CurrentContext
+	}
+
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rest config for context %q: %w", name, err)
+	}
+
+	return &Cluster{Name: name, Config: restConfig, derivedName: kubeContext == ""}, nil
+}
+
+// ClusterFromKubeconfigSecret returns the Cluster whose kubeconfig is stored in
+// a Secret. ref is either <name> or <namespace>/<name>. When namespace is not
+// specified, the value of COLLECTOR_NAMESPACE environment variable is used.
+// Kubeconfig is read from key "value" (Cluster API), "kubeconfig" or the only
+// key present. Cluster is named after the Secret (without -kubeconfig suffix).
+func ClusterFromKubeconfigSecret(ctx context.Context, c client.Client, ref string) (*Cluster, error) {
+	namespace, name := parseReference(ref)
+	namespace = defaultNamespace(namespace)
+
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret); err != nil {
+		return nil, fmt.Errorf("failed to get Secret %s/%s: %w", namespace, name, err)
+	}
+
+	data := getKubeconfigFromSecret(secret)
+	if data == nil {
+		return nil, fmt.Errorf("Secret %s/%s does not contain a kubeconfig", namespace, name)
+	}
+
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Secret %s/%s contains an invalid kubeconfig: %w", namespace, name, err)
+	}
+
+	return &Cluster{Name: strings.TrimSuffix(name, "-kubeconfig"), Config: restConfig}, nil
+}
+
+func getKubeconfigFromSecret(secret *corev1.Secret) []byte {
+	for _, key := range []string{"value", "kubeconfig"} {
+		if data, ok := secret.Data[key]; ok {
+			return data
+		}
+	}
+
+	if len(secret.Data) == 1 {
+		for k := range secret.Data {
+			return secret.Data[k]
+		}
+	}
+
+	return nil
+}
+
+// CollectFromClusters loads the configuration once and collects it from each
+// cluster, storing data in the clusters/<cluster name> directory.
+// Collection from up to concurrency clusters runs in parallel.
+// Each cluster directory contains a status.yaml file, while clusters/status.yaml
+// lists the status of all clusters.
+// An error is returned if collection from any cluster failed.
+func (a *Collector) CollectFromClusters(ctx context.Context, clusters []Cluster, concurrency int) error {
+	logger := a.logger
+	a.startSummary()
+
+	config, err := a.loadConfiguration(ctx, logger)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get configuration: %v", err))
+		a.finishSummary(err, logger)
+		return err
+	}
+
+	a.startBudget(config)
+
+	clusters, err = uniqueClusterNames(clusters)
+	if err != nil {
+		a.finishSummary(err, logger)
+		return err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	statuses := make([]ClusterStatus, len(clusters))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range clusters {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			statuses[i] = a.collectFromCluster(ctx, &clusters[i], config,
+				logger.WithValues("cluster", clusters[i].Name))
+		}(i)
+	}
+	wg.Wait()
+
+	if err := a.writeYAML(path.Join(clustersDir, statusFile), statuses); err != nil {
+		a.finishSummary(err, logger)
+		return err
+	}
+
+	errs := make([]error, 0)
+	for i := range statuses {
+		if statuses[i].Status == ClusterFailed {
+			errs = append(errs, fmt.Errorf("cluster %s: %s", statuses[i].Cluster, statuses[i].FailureMessage))
+		}
+	}
+
+	a.setClusterStatuses(statuses)
+	if cause := a.recordInterruption(ctx); cause != nil {
+		errs = append(errs, cause)
+	}
+	err = errors.Join(errs...)
+	a.finishSummary(err, logger)
+
+	return err
+}
+
+// collectFromCluster collects configuration from a single cluster and stores
+// the outcome in its status.yaml file.
+func (a *Collector) collectFromCluster(ctx context.Context, cluster *Cluster, config *Configuration,
+	logger logr.Logger) ClusterStatus {
+
+	start := a.clock.Now()
+	status := ClusterStatus{
+		Cluster:   cluster.Name,
+		StartTime: start.UTC().Format(time.RFC3339),
+	}
+
+	clusterDir := path.Join(clustersDir, clusterDirName(cluster.Name))
+	sink := newPrefixSink(a.sink, clusterDir)
+
+	var summary *Summary
+	err := cluster.Err
+	if err == nil {
+		logger.Info("collecting from cluster")
+		summary, err = a.collectClusterData(ctx, cluster, sink, config, logger)
+	}
+	a.mergeClusterSummary(cluster.Name, summary, err)
+
+	status.Duration = a.clock.Since(start).Round(time.Second).String()
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to collect from cluster: %v", err))
+		status.Status = ClusterFailed
+		status.FailureMessage = err.Error()
+	} else {
+		status.Status = ClusterSucceeded
+	}
+
+	if err := a.writeYAML(path.Join(clusterDir, statusFile), status); err != nil {
+		logger.Info(fmt.Sprintf("failed to write status: %v", err))
+	}
+
+	return status
+}
+
+// collectClusterData collects config from cluster. It returns the summary of the
+// collection, nil if collection could not start.
+func (a *Collector) collectClusterData(ctx context.Context, cluster *Cluster, sink Sink,
+	config *Configuration, logger logr.Logger) (*Summary, error) {
+
+	collector, err := a.deriveFor(cluster.Config, sink, logger)
+	if err != nil {
+		return nil, err
+	}
+	collector.budget, collector.inheritBudget = a.budget, true
+
+	err = collector.collectData(ctx, config, logger)
+	return collector.Summary(), err
+}
+
+// uniqueClusterNames returns a copy of clusters where every cluster is stored in its
+// own directory. Clusters whose name was not chosen by the user get a -<n> suffix
+// when their name is taken. An error is returned if the user chose the same name
+// for more than one cluster.
+func uniqueClusterNames(clusters []Cluster) ([]Cluster, error) {
+	names := make(map[string]bool, len(clusters))
+	for i := range clusters {
+		if clusters[i].derivedName {
+			continue
+		}
+		name := clusterDirName(clusters[i].Name)
+		if names[name] {
+			return nil, fmt.Errorf("more than one cluster named %q", clusters[i].Name)
+		}
+		names[name] = true
+	}
+
+	unique := make([]Cluster, len(clusters))
+	copy(unique, clusters)
+	for i := range unique {
+		if !unique[i].derivedName {
+			continue
+		}
+		name := unique[i].Name
+		for n := 2; names[clusterDirName(name)]; n++ {
+			name = fmt.Sprintf("%s-%d", unique[i].Name, n)
+		}
+		unique[i].Name = name
+		names[clusterDirName(name)] = true
+	}
+
+	return unique, nil
+}
+
+// clusterDirName returns the name of the directory for a cluster. Context names
+// (for instance EKS ARNs) can contain path separators.
+func clusterDirName(name string) string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(name)
+}
+
+// ClustersFromSelector returns all Sveltos and Cluster API clusters, managed by
+// the cluster c points to, whose labels match selector. Only ready clusters
+// are considered. If namespace is not empty, only clusters in that namespace are
+// considered. Cluster is named <type>:<namespace>/<name> (e.g. sveltos:mgmt/prod).
+// Clusters whose kubeconfig is missing or invalid are returned with Err set.
+// c scheme must contain libsveltos, Cluster API and apiextensions types.
+func ClustersFromSelector(ctx context.Context, c client.Client, namespace, selector string,
+	logger logr.Logger) ([]Cluster, error) {
+
+	labelSelector, err := metav1.ParseToLabelSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster selector %q: %w", selector, err)
+	}
+
+	refs, err := clusterproxy.GetMatchingClusters(ctx, c, labelSelector, namespace, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make([]Cluster, 0, len(refs))
+	for i := range refs {
+		ref := &refs[i]
+		clusterType := clusterproxy.GetClusterType(ref)
+
+		cluster := Cluster{
+			Name: fmt.Sprintf("%s:%s/%s", strings.ToLower(string(clusterType)), ref.Namespace, ref.Name),
+		}
+
+		// A cluster without a valid kubeconfig does not prevent collecting from the others
+		data, err := clusterproxy.GetSecretData(ctx, c, ref.Namespace, ref.Name, "", "",
+			clusterType, logger)
+		if err != nil {
+			cluster.Err = fmt.Errorf("failed to get kubeconfig for %s %s/%s: %w",
+				ref.Kind, ref.Namespace, ref.Name, err)
+		} else if cluster.Config, err = clientcmd.RESTConfigFromKubeConfig(data); err != nil {
+			cluster.Err = fmt.Errorf("invalid kubeconfig for %s %s/%s: %w",
+				ref.Kind, ref.Namespace, ref.Name, err)
+		}
+		if cluster.Err != nil {
+			logger.Info(cluster.Err.Error())
+		}
+
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, nil
+}
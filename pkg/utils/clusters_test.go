@@ -0,0 +1,168 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var (
+	kubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: production
+  cluster:
+    server: https://production.example.com:6443
+- name: staging
+  cluster:
+    server: https://staging.example.com:6443
+contexts:
+- name: production-admin
+  context:
+    cluster: production
+    user: admin
+- name: staging-admin
+  context:
+    cluster: staging
+    user: admin
+current-context: production-admin
+users:
+- name: admin
+  user:
+    token: foo
+`
+)
+
+var _ = Describe("Clusters", func() {
+	It("ClusterFromKubeconfig uses current or requested context and is named after the file or context", func() {
+		dir, err := os.MkdirTemp("", "clusters")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		filename := filepath.Join(dir, "kubeconfig")
+		Expect(os.WriteFile(filename, []byte(kubeconfig), 0600)).To(Succeed())
+
+		cluster, err := utils.ClusterFromKubeconfig(filename, "")
+		Expect(err).To(BeNil())
+		Expect(cluster.Name).To(Equal("kubeconfig"))
+		Expect(cluster.Config.Host).To(Equal("https://production.example.com:6443"))
+
+		cluster, err = utils.ClusterFromKubeconfig(filename, "staging-admin")
+		Expect(err).To(BeNil())
+		Expect(cluster.Name).To(Equal("staging-admin"))
+		Expect(cluster.Config.Host).To(Equal("https://staging.example.com:6443"))
+
+		_, err = utils.ClusterFromKubeconfig(filename, "foo")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("CollectFromClusters rejects clusters stored in the same directory and records the failure", func() {
+		dir, err := os.MkdirTemp("", "clusters")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector(nil, utils.WithDirectory(dir),
+			utils.WithConfigurationSource(utils.NewReaderSource("config", strings.NewReader("logs:\n- namespace: kube-system\n"))))
+
+		err = collector.CollectFromClusters(context.TODO(), []utils.Cluster{{Name: "eu/prod"}, {Name: "eu_prod"}}, 1)
+		Expect(err).To(MatchError(ContainSubstring("more than one cluster named")))
+		Expect(collector.Summary().Status).To(Equal(utils.CollectionFailed))
+		Expect(filepath.Join(dir, "summary.yaml")).To(BeAnExistingFile())
+	})
+
+	It("CollectFromClusters makes names of clusters from kubeconfig files with the same name unique", func() {
+		dir, err := os.MkdirTemp("", "clusters")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		clusters := make([]utils.Cluster, 0)
+		for _, name := range []string{"eu", "us"} {
+			Expect(os.MkdirAll(filepath.Join(dir, name), 0700)).To(Succeed())
+			filename := filepath.Join(dir, name, "config")
+			unreachable := strings.ReplaceAll(kubeconfig, "production.example.com:6443", "127.0.0.1:1")
+			Expect(os.WriteFile(filename, []byte(unreachable), 0600)).To(Succeed())
+			cluster, err := utils.ClusterFromKubeconfig(filename, "")
+			Expect(err).To(BeNil())
+			clusters = append(clusters, *cluster)
+		}
+
+		output := filepath.Join(dir, "collection")
+		collector := newTestCollector(nil, utils.WithDirectory(output),
+			utils.WithConfigurationSource(utils.NewReaderSource("config", strings.NewReader("logs:\n- namespace: kube-system\n"))))
+		err = collector.CollectFromClusters(context.TODO(), clusters, 1)
+		Expect(err).ToNot(MatchError(ContainSubstring("more than one cluster named")))
+
+		content, err := os.ReadFile(filepath.Join(output, "clusters", "status.yaml"))
+		Expect(err).To(BeNil())
+		statuses := make([]utils.ClusterStatus, 0)
+		Expect(yaml.Unmarshal(content, &statuses)).To(Succeed())
+		Expect(statuses).To(HaveLen(2))
+		Expect(statuses[0].Cluster).To(Equal("config"))
+		Expect(statuses[1].Cluster).To(Equal("config-2"))
+		Expect(filepath.Join(output, "clusters", "config-2", "status.yaml")).To(BeAnExistingFile())
+	})
+
+	It("CollectFromClusters reports clusters that cannot be accessed as failed and collects the others", func() {
+		dir, err := os.MkdirTemp("", "clusters")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector(nil, utils.WithDirectory(dir),
+			utils.WithConfigurationSource(utils.NewReaderSource("config", strings.NewReader("logs:\n- namespace: kube-system\n"))))
+
+		clusters := []utils.Cluster{
+			{Name: "sveltos:mgmt/broken", Err: errors.New("failed to get kubeconfig: secret not found")},
+			{Name: "sveltos:mgmt/prod", Config: &rest.Config{Host: "https://127.0.0.1:1"}},
+		}
+		Expect(collector.CollectFromClusters(context.TODO(), clusters, 1)).ToNot(Succeed())
+
+		content, err := os.ReadFile(filepath.Join(dir, "clusters", "status.yaml"))
+		Expect(err).To(BeNil())
+		statuses := make([]utils.ClusterStatus, 0)
+		Expect(yaml.Unmarshal(content, &statuses)).To(Succeed())
+		Expect(statuses).To(HaveLen(2))
+		Expect(statuses[0].Status).To(Equal(utils.ClusterFailed))
+		Expect(statuses[0].FailureMessage).To(ContainSubstring("secret not found"))
+		// Collection from the other cluster was attempted
+		Expect(filepath.Join(dir, "clusters", "sveltos_mgmt_prod", "status.yaml")).To(BeAnExistingFile())
+	})
+
+	It("CollectFromClusters summary merges the summaries of all clusters", func() {
+		dir, err := os.MkdirTemp("", "clusters")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector(nil, utils.WithDirectory(dir))
+		utils.StartSummary(collector)
+		utils.MergeClusterSummary(collector, "us", &utils.Summary{
+			Resources: map[string]int{"v1/Pod": 2}, Objects: 2, Captured: 1,
+			Skipped: []utils.SkippedEntry{{Kind: "Log", Namespace: "web", Name: "nginx/init", Reason: "never started"}},
+		}, nil)
+		utils.MergeClusterSummary(collector, "eu", &utils.Summary{
+			Resources: map[string]int{"v1/Pod": 1}, Objects: 1, Captured: 2,
+			Dropped: []string{"logs/web/nginx.log"},
+		}, nil)
+		utils.MergeClusterSummary(collector, "asia", nil, errors.New("unreachable"))
+		utils.FinishSummary(collector, nil, logr.Discard())
+
+		summary := collector.Summary()
+		Expect(summary.Resources).To(Equal(map[string]int{"v1/Pod": 3}))
+		Expect(summary.Objects).To(Equal(3))
+		Expect(summary.Captured).To(Equal(3))
+		Expect(summary.Dropped).To(Equal([]string{"cluster eu: logs/web/nginx.log"}))
+		Expect(summary.Errors).To(Equal([]string{"cluster asia: unreachable"}))
+		Expect(summary.Skipped).To(Equal([]utils.SkippedEntry{
+			{Cluster: "us", Kind: "Log", Namespace: "web", Name: "nginx/init", Reason: "never started"}}))
+	})
+})
@@ -18,79 +18,133 @@ package utils
 
 import (
 	"context"
-	"encoding/json"
+	stderrors "errors"
 	"fmt"
-	"os"
+	"sort"
+	"strings"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
-	"gopkg.in/yaml.v3"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func (a *Collector) CollectResouces(ctx context.Context, logger logr.Logger) error {
+// CollectResouces loads the configuration and collects resources and logs.
+func (a *Collector) CollectResouces(ctx context.Context) error {
+	logger := a.logger
+
 	config, err := a.loadConfiguration(ctx, logger)
 	if err != nil {
 		logger.Info(fmt.Sprintf("failed to get configuration: %v", err))
+		a.startSummary()
+		a.finishSummary(err, logger)
 		return err
 	}
 
-	if config == nil {
-		logger.Info("no configuration present")
-		return nil
-	}
-
 	err = a.collectData(ctx, config, logger)
 
 	return err
 }
 
 func (a *Collector) loadConfiguration(ctx context.Context, logger logr.Logger) (*Configuration, error) {
-	namespace := os.Getenv("COLLECTOR_NAMESPACE")
+	if a.configSource == nil {
+		return nil, fmt.Errorf("no configuration source")
+	}
+
+	return ReadConfiguration(ctx, a.configSource, a.client, logger)
+}
+
+// ReadConfiguration loads, validates and merges all configuration keys of source.
+// Included built-in profiles are resolved. Client is only used by sources stored
+// in a cluster and can be nil for file sources.
+func ReadConfiguration(ctx context.Context, source ConfigurationSource, c client.Client,
+	logger logr.Logger) (*Configuration, error) {
 
-	logger = logger.WithValues("configmap", fmt.Sprintf("%s/%s", namespace, a.configMapName))
-	logger.Info("getting ConfigMap ")
+	logger = logger.WithValues("source", source.String())
+	logger.Info("loading configuration")
 
-	configMap := &corev1.ConfigMap{}
-	err := a.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: a.configMapName}, configMap)
+	data, err := source.Load(ctx, c)
 	if err != nil {
-		logger.Info(fmt.Sprintf("failed to get configMap: %v", err))
+		logger.Info(fmt.Sprintf("failed to load configuration: %v", err))
 		return nil, err
 	}
 
-	if configMap.Data == nil {
-		logger.Info("configMap Data is nil")
-		return nil, fmt.Errorf("nil ConfigMap.Data")
+	if len(data) == 0 {
+		logger.Info("no configuration found")
+		return nil, fmt.Errorf("%s contains no configuration", source)
 	}
 
-	for k := range configMap.Data {
-		var currentConfiguration Configuration
-
-		err = yaml.Unmarshal([]byte(configMap.Data[k]), &currentConfiguration)
-		if err == nil {
-			return &currentConfiguration, nil
+	// Unless an explicit order is requested, keys are merged in alphabetical order
+	// so the outcome does not depend on map iteration
+	var keys []string
+	if orderer, ok := source.(interface{ Keys() []string }); ok {
+		keys = orderer.Keys()
+	} else {
+		keys = make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
 		}
+		sort.Strings(keys)
+	}
 
-		err = json.Unmarshal([]byte(configMap.Data[k]), &currentConfiguration)
-		if err == nil {
-			return &currentConfiguration, nil
+	configurations := make([]*Configuration, 0, len(keys))
+	errs := make([]error, 0)
+	for _, k := range keys {
+		currentConfiguration, err := parseConfiguration(k, data[k])
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
+		configurations = append(configurations, currentConfiguration)
+	}
 
-		logger.Info(fmt.Sprintf("content %q", configMap.Data[k]))
-		logger.Info(fmt.Sprintf("configMap key: %q does not contain a valid configuration instance: %v", k, err))
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s contains an invalid configuration:\n%w",
+			source, stderrors.Join(errs...))
 	}
 
-	return nil, nil
+	logger.Info(fmt.Sprintf("merging configuration keys %s", strings.Join(keys, ",")))
+	return resolveIncludes(mergeConfigurations(configurations...), nil)
 }
 
+// logEntries returns the log entries of configuration which are not followed,
+// followed by the log entries of its applications.
+func logEntries(configuration *Configuration) []Log {
+	logs := make([]Log, 0, len(configuration.Logs)+len(configuration.Applications))
+	for i := range configuration.Logs {
+		if configuration.Logs[i].Follow == nil {
+			logs = append(logs, configuration.Logs[i])
+		}
+	}
+	for i := range configuration.Applications {
+		// An application without instance is reported as failed when its resources are collected
+		if applicationInstance(&configuration.Applications[i]) == "" {
+			continue
+		}
+		_, log := applicationEntries(&configuration.Applications[i])
+		logs = append(logs, *log)
+	}
+	return logs
+}
+
+// collectData collects configuration. Its summary is stored in summary.yaml.
+// When ctx is done, entries not collected yet are skipped and the summary reports
+// the interruption.
 func (a *Collector) collectData(ctx context.Context, configuration *Configuration, logger logr.Logger) error {
-	logger.Info("collecting logs")
+	a.startSummary()
+	a.logCompression = configuration.LogCompression
+	a.startBudget(configuration)
+	a.keepServerVersion(logger)
+
 	var err error
-	for i := range configuration.Logs {
-		tmpErr := a.collectLogs(ctx, &configuration.Logs[i], logger)
+	for i := range configuration.Resources {
+		if ctx.Err() != nil {
+			break
+		}
+		tmpErr := a.dumpResources(ctx, &configuration.Resources[i], nil, logger)
 		if tmpErr != nil {
-			logger.Info(fmt.Sprintf("failed to collect logs %v", err))
+			a.recordError(tmpErr)
+			a.keepFailure(&configuration.Resources[i], tmpErr)
+			logger.Info(fmt.Sprintf("failed to dump resources %v", tmpErr))
 			if err == nil {
 				err = tmpErr
 			} else {
@@ -99,10 +153,14 @@ func (a *Collector) collectData(ctx context.Context, configuration *Configuratio
 		}
 	}
 
-	for i := range configuration.Resources {
-		tmpErr := a.dumpResources(ctx, &configuration.Resources[i], logger)
+	for i := range configuration.Applications {
+		if ctx.Err() != nil {
+			break
+		}
+		tmpErr := a.collectApplication(ctx, &configuration.Applications[i], logger)
 		if tmpErr != nil {
-			logger.Info(fmt.Sprintf("failed to dump resources %v", err))
+			a.recordError(tmpErr)
+			logger.Info(fmt.Sprintf("failed to collect application %v", tmpErr))
 			if err == nil {
 				err = tmpErr
 			} else {
@@ -111,5 +169,64 @@ func (a *Collector) collectData(ctx context.Context, configuration *Configuratio
 		}
 	}
 
+	// Descriptions include the events collected with their objects
+	if tmpErr := a.writeDescriptions(logger); tmpErr != nil {
+		a.recordError(tmpErr)
+		logger.Info(fmt.Sprintf("failed to describe resources %v", tmpErr))
+		if err == nil {
+			err = tmpErr
+		} else {
+			err = errors.Wrap(err, tmpErr.Error())
+		}
+	}
+
+	// Logs are collected last: with a total budget, large logs must not leave no
+	// room for resources and events. Followed logs are streamed meanwhile.
+	waitFollowing := a.startFollowing(ctx, configuration.Logs, logger)
+
+	logger.Info("collecting logs")
+	for _, tmpErr := range a.collectLogs(ctx, logEntries(configuration), logger) {
+		a.recordError(tmpErr)
+		logger.Info(fmt.Sprintf("failed to collect logs %v", tmpErr))
+		if err == nil {
+			err = tmpErr
+		} else {
+			err = errors.Wrap(err, tmpErr.Error())
+		}
+	}
+
+	if ctx.Err() == nil {
+		if tmpErr := a.includeCaptured(logger); tmpErr != nil {
+			a.recordError(tmpErr)
+			logger.Info(fmt.Sprintf("failed to include captured pods %v", tmpErr))
+			if err == nil {
+				err = tmpErr
+			} else {
+				err = errors.Wrap(err, tmpErr.Error())
+			}
+		}
+	}
+
+	for _, tmpErr := range waitFollowing() {
+		a.recordError(tmpErr)
+		logger.Info(fmt.Sprintf("failed to follow logs %v", tmpErr))
+		if err == nil {
+			err = tmpErr
+		} else {
+			err = errors.Wrap(err, tmpErr.Error())
+		}
+	}
+
+	if cause := a.recordInterruption(ctx); cause != nil {
+		logger.Info(fmt.Sprintf("collection interrupted: %v", cause))
+		if err == nil {
+			err = cause
+		} else {
+			err = errors.Wrap(err, cause.Error())
+		}
+	}
+
+	a.finishSummary(err, logger)
+
 	return err
 }
@@ -27,7 +27,7 @@ var (
   kind: Deployment
 logs:
 - namespace: kube-system
-  sinceSeconds:600`
+  sinceSeconds: 600`
 )
 
 var _ = Describe("Collect", func() {
@@ -56,7 +56,8 @@ var _ = Describe("Collect", func() {
 			},
 		}
 
-		collector, err := utils.GetCollectorInstance(scheme, env.Config, "", configMap.Name)
+		collector, err := utils.NewCollector(scheme, env.Config,
+			utils.WithConfigurationSource(utils.NewConfigMapSource(configMap.Name)))
 		Expect(err).To(BeNil())
 		Expect(k8sClient.Create(context.TODO(), configMap)).To(Succeed())
 
@@ -96,7 +97,8 @@ var _ = Describe("Collect", func() {
 			},
 		}
 
-		collector, err := utils.GetCollectorInstance(scheme, env.Config, "", configMap.Name)
+		collector, err := utils.NewCollector(scheme, env.Config,
+			utils.WithConfigurationSource(utils.NewConfigMapSource(configMap.Name)))
 		Expect(err).To(BeNil())
 		Expect(k8sClient.Create(context.TODO(), configMap)).To(Succeed())
 
@@ -111,20 +113,18 @@ var _ = Describe("Collect", func() {
 	})
 
 	It("loadConfiguration loads configuration from ConfigMap ", func() {
-		dataBytes, err := yaml.Marshal(data)
-		Expect(err).To(BeNil())
-
 		configMap := &corev1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: "default",
 				Name:      "test",
 			},
 			Data: map[string]string{
-				"config": string(dataBytes),
+				"config": data,
 			},
 		}
 
-		collector, err := utils.GetCollectorInstance(scheme, env.Config, "", configMap.Name)
+		collector, err := utils.NewCollector(scheme, env.Config,
+			utils.WithConfigurationSource(utils.NewConfigMapSource(configMap.Name)))
 		Expect(err).To(BeNil())
 		Expect(k8sClient.Create(context.TODO(), configMap)).To(Succeed())
 
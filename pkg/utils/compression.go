@@ -0,0 +1,166 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CompressionGzip compresses log files with gzip
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses log files with zstd
+	CompressionZstd = "zstd"
+
+	gzipExtension = ".gz"
+	zstdExtension = ".zst"
+
+	defaultCompressionThresholdBytes = 1024 * 1024
+)
+
+func isCompressionAlgorithm(algorithm string) bool {
+	return algorithm == CompressionGzip || algorithm == CompressionZstd
+}
+
+// logFile is a log file stored in the sink. With compression, logs are kept in
+// memory up to the threshold: smaller logs are stored as they are, larger ones are
+// compressed while they are written, in <relPath>.gz or <relPath>.zst.
+type logFile struct {
+	collector   *Collector
+	relPath     string
+	compression *LogCompression
+
+	// buffer contains the logs written before the file is created
+	buffer bytes.Buffer
+	// name is the path of the file, once created
+	name       string
+	file       io.WriteCloser
+	counter    *countingWriter
+	compressor io.WriteCloser
+	out        io.Writer
+}
+
+// createLogFile creates the file logs are stored in, at relPath unless they are
+// compressed. The number of bytes written in the sink is observed on Close.
+// With a budget, logs are truncated when it is exhausted; compressed logs count
+// for their uncompressed size.
+func (a *Collector) createLogFile(relPath string) (io.WriteCloser, error) {
+	f := &logFile{collector: a, relPath: relPath, compression: a.logCompression}
+	if f.compression == nil {
+		if err := f.open(false); err != nil {
+			return nil, err
+		}
+	}
+	if a.budget != nil {
+		return &budgetWriter{collector: a, relPath: relPath, w: f}, nil
+	}
+	return f, nil
+}
+
+func (f *logFile) threshold() int64 {
+	if f.compression.ThresholdBytes == nil {
+		return defaultCompressionThresholdBytes
+	}
+	return *f.compression.ThresholdBytes
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	if f.out != nil {
+		return f.out.Write(p)
+	}
+
+	f.buffer.Write(p)
+	if int64(f.buffer.Len()) > f.threshold() {
+		if err := f.open(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// open creates the file, compressed or not, and writes the buffered logs.
+func (f *logFile) open(compress bool) error {
+	name := f.relPath
+	if compress {
+		name += compressionExtension(f.compression.Algorithm)
+	}
+
+	file, err := f.collector.sink.Create(name)
+	if err != nil {
+		return err
+	}
+	f.name, f.file = name, file
+	f.counter = &countingWriter{w: file}
+	f.out = f.counter
+
+	if compress {
+		f.compressor, err = newCompressor(f.compression.Algorithm, f.counter)
+		if err != nil {
+			return err
+		}
+		f.out = f.compressor
+	}
+
+	_, err = f.out.Write(f.buffer.Bytes())
+	f.buffer.Reset()
+	return err
+}
+
+func (f *logFile) Close() error {
+	var err error
+	if f.file == nil {
+		// Logs did not reach the threshold
+		err = f.open(false)
+	}
+	if f.compressor != nil {
+		if cerr := f.compressor.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if f.file != nil {
+		f.collector.metrics.observeBytesWritten(f.name, f.counter.n)
+		f.collector.keepLogFile(f.relPath, f.name)
+		if cerr := f.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func compressionExtension(algorithm string) string {
+	if algorithm == CompressionZstd {
+		return zstdExtension
+	}
+	return gzipExtension
+}
+
+// newCompressor returns a writer compressing data written to w with algorithm.
+func newCompressor(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
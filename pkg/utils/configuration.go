@@ -55,10 +55,96 @@ type Log struct {
 	// If this value is in the future, no logs will be returned. Only one of sinceSeconds or sinceTime may be specified.
 	// +optional
 	SinceSeconds *int64 `json:"sinceSeconds,omitempty" yaml:"sinceSeconds,omitempty"`
+
+	// If set, the number of lines from the end of the logs to collect.
+	// +optional
+	TailLines *int64 `json:"tailLines,omitempty" yaml:"tailLines,omitempty"`
+
+	// Follow, if set, keeps streaming the logs of matching pods, including pods
+	// started meanwhile, for a time window. SinceSeconds and TailLines only apply
+	// to the containers running when the window starts.
+	// +optional
+	Follow *Follow `json:"follow,omitempty" yaml:"follow,omitempty"`
+}
+
+// Follow defines how long logs are streamed and how log files are rotated.
+type Follow struct {
+	// DurationSeconds is the duration of the window logs are streamed for.
+	DurationSeconds int64 `json:"durationSeconds" yaml:"durationSeconds"`
+
+	// MaxFileBytes is the size a container log file is rotated at: following
+	// logs are stored in <pod>-<container>.1, <pod>-<container>.2, ...
+	// Files are only rotated at the end of a line. Defaults to 10MiB.
+	// +optional
+	MaxFileBytes *int64 `json:"maxFileBytes,omitempty" yaml:"maxFileBytes,omitempty"`
+}
+
+// LogCompression defines how log files are compressed while they are written.
+type LogCompression struct {
+	// Algorithm is either gzip or zstd. Compressed logs are stored in
+	// <pod>-<container>.gz or <pod>-<container>.zst.
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+
+	// ThresholdBytes is the size logs are compressed from: smaller logs are
+	// stored as they are. 0 compresses all logs. Defaults to 1MiB.
+	// +optional
+	ThresholdBytes *int64 `json:"thresholdBytes,omitempty" yaml:"thresholdBytes,omitempty"`
+}
+
+// Budget limits the size of the collected data. Limits are in bytes; unset
+// limits are unlimited. Logs count towards the logs budget, Events towards the
+// events budget and other resources towards the resources budget. All of them,
+// applications and captured pods count towards the total budget.
+type Budget struct {
+	// TotalBytes limits the size of all collected data.
+	// +optional
+	TotalBytes *int64 `json:"totalBytes,omitempty" yaml:"totalBytes,omitempty"`
+
+	// LogsBytes limits the size of collected logs.
+	// +optional
+	LogsBytes *int64 `json:"logsBytes,omitempty" yaml:"logsBytes,omitempty"`
+
+	// ResourcesBytes limits the size of collected resources, Events excluded.
+	// +optional
+	ResourcesBytes *int64 `json:"resourcesBytes,omitempty" yaml:"resourcesBytes,omitempty"`
+
+	// EventsBytes limits the size of collected Events.
+	// +optional
+	EventsBytes *int64 `json:"eventsBytes,omitempty" yaml:"eventsBytes,omitempty"`
+}
+
+// Application identifies all the resources belonging to an application.
+// An application is either a Helm release or the set of resources labeled
+// with app.kubernetes.io/instance.
+type Application struct {
+	// Namespace of the application.
+	// If not set, Helm release and labeled resources are looked up in all namespaces.
+	// +optional
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+	// HelmRelease is the name of the Helm release. The release is decoded from its
+	// sh.helm.release.v1 Secret and the release manifest and values are collected.
+	// +optional
+	HelmRelease string `json:"helmRelease,omitempty" yaml:"helmRelease,omitempty"`
+
+	// Instance is the value of the app.kubernetes.io/instance label.
+	// Defaults to HelmRelease.
+	// +optional
+	Instance string `json:"instance,omitempty" yaml:"instance,omitempty"`
+
+	// A relative time in seconds before the current time from which to collect
+	// logs of the application pods.
+	// +optional
+	SinceSeconds *int64 `json:"sinceSeconds,omitempty" yaml:"sinceSeconds,omitempty"`
 }
 
 // Configuration defines the instruction for collector
 type Configuration struct {
+	// Include is the list of built-in profiles (e.g. networking, storage, control-plane)
+	// whose content is added to this configuration.
+	// +optional
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+
 	// Resources indicates what resorces to collect
 	// +optional
 	Resources []Resource `json:"resources,omitempty" yaml:"resources,omitempty"`
@@ -66,4 +152,20 @@ type Configuration struct {
 	// Logs indicates what pods' log to collect
 	// +optional
 	Logs []Log `json:"logs,omitempty" yaml:"logs,omitempty"`
+
+	// Applications indicates what applications to collect.
+	// +optional
+	Applications []Application `json:"applications,omitempty" yaml:"applications,omitempty"`
+
+	// LogCompression, if set, compresses each log file while it is written.
+	// When merging configurations, the last one setting it wins.
+	// +optional
+	LogCompression *LogCompression `json:"logCompression,omitempty" yaml:"logCompression,omitempty"`
+
+	// Budget, if set, limits the size of collected data: when a budget is
+	// exhausted, logs are truncated and further files are dropped. Pods with
+	// Warning events and restarted containers are collected first.
+	// When merging configurations, the last one setting it wins.
+	// +optional
+	Budget *Budget `json:"budget,omitempty" yaml:"budget,omitempty"`
 }
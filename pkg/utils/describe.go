@@ -0,0 +1,604 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// describeSuffix is appended to the name of an object to store its description
+	describeSuffix = ".describe.txt"
+
+	deploymentKind = "Deployment"
+
+	// describeNone is printed for empty sections
+	describeNone = "<none>"
+)
+
+// keptObjects keeps what a collection saw: the collected Pods, Nodes, Deployments
+// and Events, the pods whose logs were collected and what could not be collected.
+// Objects are described, and the cluster overview written, once the collection ends,
+// when all their events are known. It is safe for concurrent use.
+type keptObjects struct {
+	mu          sync.Mutex
+	pods        []*corev1.Pod
+	nodes       []*corev1.Node
+	deployments []*appsv1.Deployment
+	// events are indexed by involved object (<kind>/<namespace>/<name>)
+	events map[string][]*corev1.Event
+
+	// loggedPods are the pods whose logs were collected
+	loggedPods []*corev1.Pod
+	// logFiles maps where logs are stored (see logFilePath) to the actual file
+	logFiles map[string]string
+	// failures are the resources whose collection failed
+	failures []SkippedEntry
+	// serverVersion is the Kubernetes version of the cluster
+	serverVersion string
+}
+
+func involvedKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// keptObjects returns what the running collection saw.
+func (a *Collector) keptObjects() *keptObjects {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.kept == nil {
+		a.kept = &keptObjects{events: make(map[string][]*corev1.Event), logFiles: make(map[string]string)}
+	}
+	return a.kept
+}
+
+// keepForDescription keeps obj, if it is a Pod, a Node, a Deployment or an Event.
+func (a *Collector) keepForDescription(obj client.Object) error {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	var typed interface{}
+	switch gvk {
+	case corev1.SchemeGroupVersion.WithKind(podKind):
+		typed = &corev1.Pod{}
+	case corev1.SchemeGroupVersion.WithKind(nodeKind):
+		typed = &corev1.Node{}
+	case appsv1.SchemeGroupVersion.WithKind(deploymentKind):
+		typed = &appsv1.Deployment{}
+	case corev1.SchemeGroupVersion.WithKind(eventKind):
+		typed = &corev1.Event{}
+	default:
+		return nil
+	}
+
+	if err := toTyped(obj, typed); err != nil {
+		return err
+	}
+
+	k := a.keptObjects()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch o := typed.(type) {
+	case *corev1.Pod:
+		k.pods = append(k.pods, o)
+	case *corev1.Node:
+		k.nodes = append(k.nodes, o)
+	case *appsv1.Deployment:
+		k.deployments = append(k.deployments, o)
+	case *corev1.Event:
+		key := involvedKey(o.InvolvedObject.Kind, o.InvolvedObject.Namespace, o.InvolvedObject.Name)
+		k.events[key] = append(k.events[key], o)
+	}
+	return nil
+}
+
+// keepLoggedPod keeps a pod whose logs are collected.
+func (a *Collector) keepLoggedPod(pod *corev1.Pod) {
+	k := a.keptObjects()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.loggedPods = append(k.loggedPods, pod.DeepCopy())
+}
+
+// keepLogFile records that the logs meant for relPath are stored in name.
+func (a *Collector) keepLogFile(relPath, name string) {
+	k := a.keptObjects()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.logFiles[relPath] = name
+}
+
+// keepFailure records a resource whose collection failed.
+func (a *Collector) keepFailure(resource *Resource, err error) {
+	gvk := schema.GroupVersionKind{Group: resource.Group, Version: resource.Version, Kind: resource.Kind}
+	k := a.keptObjects()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.failures = append(k.failures, SkippedEntry{Kind: gvk.String(), Namespace: resource.Namespace, Reason: err.Error()})
+}
+
+// keepServerVersion records the Kubernetes version of the cluster.
+func (a *Collector) keepServerVersion(logger logr.Logger) {
+	if a.clientset == nil {
+		return
+	}
+	info, err := a.clientset.Discovery().ServerVersion()
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to get server version: %v", err))
+		return
+	}
+
+	k := a.keptObjects()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.serverVersion = info.GitVersion
+}
+
+// toTyped copies obj, typed or unstructured, into typed.
+func toTyped(obj client.Object, typed interface{}) error {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, typed)
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(content, typed)
+}
+
+// writeDescriptions stores, next to the YAML of each collected Pod, Node and
+// Deployment, a human readable description including its collected events.
+func (a *Collector) writeDescriptions(logger logr.Logger) error {
+	if a.sink == nil {
+		return nil
+	}
+	k := a.keptObjects()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	logger.Info(fmt.Sprintf("describing %d pods, %d nodes and %d deployments", len(k.pods), len(k.nodes),
+		len(k.deployments)))
+	for _, pod := range k.pods {
+		events := k.events[involvedKey(podKind, pod.Namespace, pod.Name)]
+		if err := a.writeDescription(podKind, pod.Namespace, pod.Name, describePod(pod, events)); err != nil {
+			return err
+		}
+	}
+	for _, node := range k.nodes {
+		err := a.writeDescription(nodeKind, "", node.Name, describeNode(node, k.pods, k.nodeEvents(node.Name)))
+		if err != nil {
+			return err
+		}
+	}
+	for _, deployment := range k.deployments {
+		events := k.events[involvedKey(deploymentKind, deployment.Namespace, deployment.Name)]
+		err := a.writeDescription(deploymentKind, deployment.Namespace, deployment.Name,
+			describeDeployment(deployment, events))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nodeEvents returns the events of a node. Node events are reported in the default
+// namespace, or without namespace.
+func (k *keptObjects) nodeEvents(name string) []*corev1.Event {
+	return append(append([]*corev1.Event(nil), k.events[involvedKey(nodeKind, "", name)]...),
+		k.events[involvedKey(nodeKind, corev1.NamespaceDefault, name)]...)
+}
+
+func (a *Collector) writeDescription(kind, namespace, name string, description []byte) error {
+	return a.writeFile(path.Join(resourcesDir, namespace, kind, name+describeSuffix), description)
+}
+
+// describer writes "kubectl describe" like descriptions.
+type describer struct {
+	buf bytes.Buffer
+	tw  *tabwriter.Writer
+}
+
+func newDescriber() *describer {
+	d := &describer{}
+	const padding = 2
+	d.tw = tabwriter.NewWriter(&d.buf, 0, 0, padding, ' ', 0)
+	return d
+}
+
+// line writes a line indented by level, whose tab separated cells are aligned.
+func (d *describer) line(level int, format string, args ...interface{}) {
+	fmt.Fprintf(d.tw, strings.Repeat("  ", level)+format+"\n", args...)
+}
+
+func (d *describer) bytes() []byte {
+	_ = d.tw.Flush()
+	return d.buf.Bytes()
+}
+
+func (d *describer) labels(title string, labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 0 {
+		d.line(0, "%s:\t%s", title, describeNone)
+		return
+	}
+	for i, k := range keys {
+		if i == 0 {
+			d.line(0, "%s:\t%s=%s", title, k, labels[k])
+		} else {
+			d.line(0, "\t%s=%s", k, labels[k])
+		}
+	}
+}
+
+func (d *describer) resources(level int, resources corev1.ResourceRequirements) {
+	for _, section := range []struct {
+		title string
+		list  corev1.ResourceList
+	}{{"Requests", resources.Requests}, {"Limits", resources.Limits}} {
+		if len(section.list) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(section.list))
+		for name := range section.list {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+
+		d.line(level, "%s:", section.title)
+		for _, name := range names {
+			quantity := section.list[corev1.ResourceName(name)]
+			d.line(level+1, "%s:\t%s", name, quantity.String())
+		}
+	}
+}
+
+func (d *describer) containers(title string, containers []corev1.Container, statuses []corev1.ContainerStatus) {
+	if len(containers) == 0 {
+		return
+	}
+
+	d.line(0, "%s:", title)
+	for i := range containers {
+		container := &containers[i]
+		d.line(1, "%s:", container.Name)
+		d.line(2, "Image:\t%s", container.Image)
+		if len(container.Ports) > 0 {
+			ports := make([]string, len(container.Ports))
+			for j := range container.Ports {
+				ports[j] = fmt.Sprintf("%d/%s", container.Ports[j].ContainerPort, container.Ports[j].Protocol)
+			}
+			d.line(2, "Ports:\t%s", strings.Join(ports, ", "))
+		}
+
+		for j := range statuses {
+			if statuses[j].Name == container.Name {
+				d.containerStatus(&statuses[j])
+			}
+		}
+		d.resources(2, container.Resources)
+		if len(container.VolumeMounts) > 0 {
+			d.line(2, "Mounts:")
+			for j := range container.VolumeMounts {
+				mount := &container.VolumeMounts[j]
+				mode := "rw"
+				if mount.ReadOnly {
+					mode = "ro"
+				}
+				d.line(3, "%s from %s (%s)", mount.MountPath, mount.Name, mode)
+			}
+		}
+	}
+}
+
+func (d *describer) containerStatus(status *corev1.ContainerStatus) {
+	d.containerState("State", &status.State)
+	if status.LastTerminationState.Terminated != nil {
+		d.containerState("Last State", &status.LastTerminationState)
+	}
+	d.line(2, "Ready:\t%t", status.Ready)
+	d.line(2, "Restart Count:\t%d", status.RestartCount)
+}
+
+func (d *describer) containerState(title string, state *corev1.ContainerState) {
+	switch {
+	case state.Running != nil:
+		d.line(2, "%s:\tRunning", title)
+		d.line(3, "Started:\t%s", formatTime(state.Running.StartedAt))
+	case state.Waiting != nil:
+		d.line(2, "%s:\tWaiting", title)
+		d.line(3, "Reason:\t%s", state.Waiting.Reason)
+		if state.Waiting.Message != "" {
+			d.line(3, "Message:\t%s", state.Waiting.Message)
+		}
+	case state.Terminated != nil:
+		d.line(2, "%s:\tTerminated", title)
+		d.line(3, "Reason:\t%s", state.Terminated.Reason)
+		if state.Terminated.Message != "" {
+			d.line(3, "Message:\t%s", state.Terminated.Message)
+		}
+		d.line(3, "Exit Code:\t%d", state.Terminated.ExitCode)
+		if !state.Terminated.FinishedAt.IsZero() {
+			d.line(3, "Started:\t%s", formatTime(state.Terminated.StartedAt))
+			d.line(3, "Finished:\t%s", formatTime(state.Terminated.FinishedAt))
+		}
+	default:
+		d.line(2, "%s:\tUnknown", title)
+	}
+}
+
+func (d *describer) conditions(conditions [][]string) {
+	if len(conditions) == 0 {
+		return
+	}
+	d.line(0, "Conditions:")
+	d.line(1, "Type\tStatus\tReason\tMessage")
+	for i := range conditions {
+		d.line(1, "%s", strings.Join(conditions[i], "\t"))
+	}
+}
+
+func (d *describer) volumes(volumes []corev1.Volume) {
+	if len(volumes) == 0 {
+		d.line(0, "Volumes:\t%s", describeNone)
+		return
+	}
+	d.line(0, "Volumes:")
+	for i := range volumes {
+		d.line(1, "%s:\t%s", volumes[i].Name, volumeSource(&volumes[i].VolumeSource))
+	}
+}
+
+// volumeSource describes the source of a volume in a few words.
+func volumeSource(source *corev1.VolumeSource) string {
+	switch {
+	case source.ConfigMap != nil:
+		return "ConfigMap " + source.ConfigMap.Name
+	case source.Secret != nil:
+		return "Secret " + source.Secret.SecretName
+	case source.PersistentVolumeClaim != nil:
+		return "PersistentVolumeClaim " + source.PersistentVolumeClaim.ClaimName
+	case source.EmptyDir != nil:
+		return "EmptyDir"
+	case source.HostPath != nil:
+		return "HostPath " + source.HostPath.Path
+	case source.Projected != nil:
+		return "Projected"
+	case source.DownwardAPI != nil:
+		return "DownwardAPI"
+	case source.CSI != nil:
+		return "CSI " + source.CSI.Driver
+	default:
+		return "Other"
+	}
+}
+
+// events describes events, most recent last.
+func (d *describer) events(events []*corev1.Event) {
+	if len(events) == 0 {
+		d.line(0, "Events:\t%s", describeNone)
+		return
+	}
+
+	sorted := append([]*corev1.Event(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return eventTime(sorted[i]) < eventTime(sorted[j])
+	})
+
+	d.line(0, "Events:")
+	d.line(1, "Type\tReason\tCount\tLast Seen\tFrom\tMessage")
+	for _, event := range sorted {
+		count := max(event.Count, 1)
+		d.line(1, "%s\t%s\t%d\t%s\t%s\t%s", event.Type, event.Reason, count, valueOrNone(eventTime(event)),
+			event.Source.Component, strings.TrimSpace(event.Message))
+	}
+}
+
+// eventTime returns when event was last seen (RFC3339).
+func eventTime(event *corev1.Event) string {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return formatTime(event.LastTimestamp)
+	case !event.EventTime.IsZero():
+		return formatTime(metav1.NewTime(event.EventTime.Time))
+	default:
+		return formatTime(event.CreationTimestamp)
+	}
+}
+
+func describePod(pod *corev1.Pod, events []*corev1.Event) []byte {
+	d := newDescriber()
+	d.line(0, "Name:\t%s", pod.Name)
+	d.line(0, "Namespace:\t%s", pod.Namespace)
+	d.line(0, "Node:\t%s", valueOrNone(pod.Spec.NodeName))
+	if pod.Status.StartTime != nil {
+		d.line(0, "Start Time:\t%s", formatTime(*pod.Status.StartTime))
+	}
+	d.labels("Labels", pod.Labels)
+	status := string(pod.Status.Phase)
+	if pod.DeletionTimestamp != nil {
+		status = "Terminating (since " + formatTime(*pod.DeletionTimestamp) + ")"
+	}
+	d.line(0, "Status:\t%s", valueOrNone(status))
+	if pod.Status.Reason != "" {
+		d.line(0, "Reason:\t%s", pod.Status.Reason)
+	}
+	if pod.Status.Message != "" {
+		d.line(0, "Message:\t%s", pod.Status.Message)
+	}
+	d.line(0, "IP:\t%s", valueOrNone(pod.Status.PodIP))
+	d.line(0, "Controlled By:\t%s", controlledBy(pod))
+	d.line(0, "QoS Class:\t%s", valueOrNone(string(pod.Status.QOSClass)))
+
+	d.containers("Init Containers", pod.Spec.InitContainers, pod.Status.InitContainerStatuses)
+	d.containers("Containers", pod.Spec.Containers, pod.Status.ContainerStatuses)
+
+	conditions := make([][]string, len(pod.Status.Conditions))
+	for i := range pod.Status.Conditions {
+		c := &pod.Status.Conditions[i]
+		conditions[i] = []string{string(c.Type), string(c.Status), c.Reason, c.Message}
+	}
+	d.conditions(conditions)
+	d.volumes(pod.Spec.Volumes)
+	d.events(events)
+	return d.bytes()
+}
+
+func describeNode(node *corev1.Node, pods []*corev1.Pod, events []*corev1.Event) []byte {
+	d := newDescriber()
+	d.line(0, "Name:\t%s", node.Name)
+	d.labels("Labels", node.Labels)
+	d.line(0, "Created:\t%s", formatTime(node.CreationTimestamp))
+	if len(node.Spec.Taints) == 0 {
+		d.line(0, "Taints:\t%s", describeNone)
+	}
+	for i := range node.Spec.Taints {
+		title := ""
+		if i == 0 {
+			title = "Taints:"
+		}
+		d.line(0, "%s\t%s", title, node.Spec.Taints[i].ToString())
+	}
+	d.line(0, "Unschedulable:\t%t", node.Spec.Unschedulable)
+
+	conditions := make([][]string, len(node.Status.Conditions))
+	for i := range node.Status.Conditions {
+		c := &node.Status.Conditions[i]
+		conditions[i] = []string{string(c.Type), string(c.Status), c.Reason, c.Message}
+	}
+	d.conditions(conditions)
+
+	d.line(0, "Addresses:")
+	for i := range node.Status.Addresses {
+		d.line(1, "%s:\t%s", node.Status.Addresses[i].Type, node.Status.Addresses[i].Address)
+	}
+	for _, section := range []struct {
+		title string
+		list  corev1.ResourceList
+	}{{"Capacity", node.Status.Capacity}, {"Allocatable", node.Status.Allocatable}} {
+		d.line(0, "%s:", section.title)
+		names := make([]string, 0, len(section.list))
+		for name := range section.list {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			quantity := section.list[corev1.ResourceName(name)]
+			d.line(1, "%s:\t%s", name, quantity.String())
+		}
+	}
+
+	info := &node.Status.NodeInfo
+	d.line(0, "System Info:")
+	d.line(1, "Kernel Version:\t%s", info.KernelVersion)
+	d.line(1, "OS Image:\t%s", info.OSImage)
+	d.line(1, "Container Runtime Version:\t%s", info.ContainerRuntimeVersion)
+	d.line(1, "Kubelet Version:\t%s", info.KubeletVersion)
+
+	// Only pods collected are known
+	d.line(0, "Collected Pods:")
+	d.line(1, "Namespace\tName\tPhase\tRestarts")
+	for _, pod := range pods {
+		if pod.Spec.NodeName != node.Name {
+			continue
+		}
+		restarts := int32(0)
+		for i := range pod.Status.ContainerStatuses {
+			restarts += pod.Status.ContainerStatuses[i].RestartCount
+		}
+		d.line(1, "%s\t%s\t%s\t%d", pod.Namespace, pod.Name, pod.Status.Phase, restarts)
+	}
+	d.events(events)
+	return d.bytes()
+}
+
+func describeDeployment(deployment *appsv1.Deployment, events []*corev1.Event) []byte {
+	d := newDescriber()
+	d.line(0, "Name:\t%s", deployment.Name)
+	d.line(0, "Namespace:\t%s", deployment.Namespace)
+	d.line(0, "Created:\t%s", formatTime(deployment.CreationTimestamp))
+	d.labels("Labels", deployment.Labels)
+	selector := describeNone
+	if deployment.Spec.Selector != nil {
+		selector = metav1.FormatLabelSelector(deployment.Spec.Selector)
+	}
+	d.line(0, "Selector:\t%s", selector)
+
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	status := &deployment.Status
+	d.line(0, "Replicas:\t%d desired | %d updated | %d total | %d available | %d unavailable", desired,
+		status.UpdatedReplicas, status.Replicas, status.AvailableReplicas, status.UnavailableReplicas)
+	d.line(0, "Strategy:\t%s", deployment.Spec.Strategy.Type)
+	if deployment.Spec.Paused {
+		d.line(0, "Paused:\ttrue")
+	}
+
+	d.line(0, "Pod Template:")
+	d.labels("  Labels", deployment.Spec.Template.Labels)
+	d.containers("  Init Containers", deployment.Spec.Template.Spec.InitContainers, nil)
+	d.containers("  Containers", deployment.Spec.Template.Spec.Containers, nil)
+	d.volumes(deployment.Spec.Template.Spec.Volumes)
+
+	conditions := make([][]string, len(status.Conditions))
+	for i := range status.Conditions {
+		c := &status.Conditions[i]
+		conditions[i] = []string{string(c.Type), string(c.Status), c.Reason, c.Message}
+	}
+	d.conditions(conditions)
+	d.events(events)
+	return d.bytes()
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return describeNone
+	}
+	return value
+}
+
+// controlledBy returns the controller of obj (<kind>/<name>).
+func controlledBy(obj client.Object) string {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Controller != nil && *ref.Controller {
+			return ref.Kind + "/" + ref.Name
+		}
+	}
+	return describeNone
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Describe", func() {
+	var dir string
+	var collector *utils.Collector
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "describe")
+		Expect(err).To(BeNil())
+
+		collector = newTestCollector(nil, utils.WithDirectory(dir))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	describe := func(objects ...client.Object) {
+		for i := range objects {
+			Expect(utils.DumpObject(collector, objects[i], logr.Discard())).To(Succeed())
+		}
+		Expect(utils.WriteDescriptions(collector, logr.Discard())).To(Succeed())
+	}
+
+	readDescription := func(elem ...string) string {
+		content, err := os.ReadFile(filepath.Join(append([]string{dir, "resources"}, elem...)...))
+		Expect(err).To(BeNil())
+		return string(content)
+	}
+
+	It("writeDescriptions describes pods with their containers, volumes and events", func() {
+		pod := crashingPod("nginx-5d8f-x2k4", &metav1.OwnerReference{
+			APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-5d8f", Controller: ptr.To(true)})
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")},
+		}
+		pod.Spec.Volumes = []corev1.Volume{{
+			Name:         "config",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "nginx"}}},
+		}}
+		pod.Status.ContainerStatuses[0].LastTerminationState = corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137},
+		}
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse, Reason: "ContainersNotReady"}}
+		event := &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "web", Name: "nginx-5d8f-x2k4.backoff"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "web", Name: pod.Name},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container",
+			Count:          4,
+		}
+
+		describe(pod, event)
+
+		description := readDescription("web", "Pod", pod.Name+".describe.txt")
+		Expect(description).To(MatchRegexp(`Controlled By:\s+ReplicaSet/nginx-5d8f`))
+		Expect(description).To(MatchRegexp(`State:\s+Waiting\n\s+Reason:\s+CrashLoopBackOff`))
+		Expect(description).To(MatchRegexp(`Last State:\s+Terminated\n\s+Reason:\s+OOMKilled\n\s+Exit Code:\s+137`))
+		Expect(description).To(MatchRegexp(`Restart Count:\s+3`))
+		Expect(description).To(MatchRegexp(`Requests:\n\s+memory:\s+64Mi`))
+		Expect(description).To(MatchRegexp(`Limits:\n\s+memory:\s+128Mi`))
+		Expect(description).To(MatchRegexp(`Ready\s+False\s+ContainersNotReady`))
+		Expect(description).To(MatchRegexp(`config:\s+ConfigMap nginx`))
+		Expect(description).To(MatchRegexp(`Warning\s+BackOff\s+4\s+.*Back-off restarting failed container`))
+
+		// Descriptions are not counted as resources
+		summary, err := utils.InspectBundle(dir)
+		Expect(err).To(BeNil())
+		Expect(summary.Resources).To(Equal(map[string]int{"Pod": 1, "Event": 1}))
+	})
+
+	It("writeDescriptions describes nodes and deployments", func() {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker"},
+			Spec: corev1.NodeSpec{
+				Taints: []corev1.Taint{{Key: "dedicated", Value: "web", Effect: corev1.TaintEffectNoSchedule}},
+			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionTrue}},
+				Capacity:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+			},
+		}
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "nginx"},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: ptr.To(int32(2)),
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.27"}}},
+				},
+			},
+			Status: appsv1.DeploymentStatus{Replicas: 2, AvailableReplicas: 1, UnavailableReplicas: 1},
+		}
+
+		describe(node, deployment, crashingPod("nginx-5d8f-x2k4", nil))
+
+		description := readDescription("Node", "worker.describe.txt")
+		Expect(description).To(MatchRegexp(`Taints:\s+dedicated=web:NoSchedule`))
+		Expect(description).To(MatchRegexp(`MemoryPressure\s+True`))
+		Expect(description).To(MatchRegexp(`Capacity:\n\s+cpu:\s+4`))
+		Expect(description).To(MatchRegexp(`web\s+nginx-5d8f-x2k4\s+\S*\s*3`))
+
+		description = readDescription("web", "Deployment", "nginx.describe.txt")
+		Expect(description).To(MatchRegexp(`Selector:\s+app=nginx`))
+		Expect(description).To(ContainSubstring("2 desired | 0 updated | 2 total | 1 available | 1 unavailable"))
+		Expect(description).To(MatchRegexp(`Image:\s+nginx:1.27`))
+		Expect(description).To(MatchRegexp(`Events:\s+<none>`))
+	})
+})
@@ -17,5 +17,39 @@ limitations under the License.
 package utils
 
 var (
-	LoadConfiguration = (*Collector).loadConfiguration
+	LoadConfiguration  = (*Collector).loadConfiguration
+	ParseConfiguration = parseConfiguration
+
+	NewPrefixSink = newPrefixSink
+
+	MergeConfigurations = mergeConfigurations
+	ResolveIncludes     = resolveIncludes
+
+	DecodeHelmRelease   = decodeHelmRelease
+	ParseManifest       = parseManifest
+	RedactValues        = redactValues
+	GetHelmRelease      = (*Collector).getHelmRelease
+	StoreManifestObject = (*Collector).storeManifestObject
+
+	NewLogStream      = (*Collector).newLogStream
+	NewRotatingWriter = (*Collector).newRotatingWriter
+
+	BeginCapture  = (*CaptureBuffer).begin
+	CommitCapture = (*CaptureBuffer).commit
+
+	CreateLogFile       = (*Collector).createLogFile
+	BudgetCategory      = budgetCategory
+	BudgetMarkerReserve = markerReserve
+
+	StartSummary        = (*Collector).startSummary
+	FinishSummary       = (*Collector).finishSummary
+	MergeClusterSummary = (*Collector).mergeClusterSummary
+	DumpObject          = (*Collector).dumpObject
+	WriteDescriptions   = (*Collector).writeDescriptions
+	WriteOverview       = (*Collector).writeOverview
 )
+
+// SetBudget sets the budget of the running collection.
+func SetBudget(a *Collector, config *Budget) {
+	a.budget = newBudget(config)
+}
@@ -0,0 +1,518 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// defaultFollowMaxFileBytes is the size followed log files are rotated at
+	defaultFollowMaxFileBytes = 10 * 1024 * 1024
+
+	// previousRunTimeout is how long the stream of the previous run of a restarted
+	// container can take to end before it is canceled
+	previousRunTimeout = 5 * time.Second
+)
+
+// containerRun identifies a run of a container: a restarted container is
+// followed from its start.
+type containerRun struct {
+	ref          LogReference
+	restartCount int32
+}
+
+// followedRun is a container run whose logs are streamed.
+type followedRun struct {
+	// cancel stops the stream
+	cancel context.CancelFunc
+	// done is closed when the stream ended
+	done chan struct{}
+}
+
+// follower streams the logs of the pods matching a log entry for a time window.
+type follower struct {
+	collector *Collector
+	log       *Log
+	// ctx is done when the window ends
+	ctx    context.Context
+	logger logr.Logger
+
+	mu sync.Mutex
+	// runs contains the container runs already being followed
+	runs map[containerRun]bool
+	// pods contains the pods (<namespace>/<name>) whose logs are collected
+	pods map[string]bool
+	// files contains the output file of each container
+	files map[LogReference]*rotatingWriter
+	errs  []error
+	wg    sync.WaitGroup
+
+	// current contains the last followed run of each container
+	current map[LogReference]*followedRun
+}
+
+// startFollowing starts streaming the logs of the entries with Follow set, while
+// everything else is collected. Returned function waits for all windows to end
+// and returns the errors of each entry.
+func (a *Collector) startFollowing(ctx context.Context, logs []Log, logger logr.Logger) func() []error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(logs))
+	for i := range logs {
+		if logs[i].Follow == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = a.followLogs(ctx, &logs[i], logger)
+		}(i)
+	}
+
+	return func() []error {
+		wg.Wait()
+		result := make([]error, 0)
+		for i := range errs {
+			if errs[i] != nil {
+				result = append(result, errs[i])
+			}
+		}
+		return result
+	}
+}
+
+// followLogs streams logs of pods matching log, including pods started during the
+// window, until the window ends.
+func (a *Collector) followLogs(ctx context.Context, log *Log, logger logr.Logger) error {
+	namespaces, reason := a.entryNamespaces(log.Namespace)
+	if reason != "" {
+		a.skip(SkippedEntry{Kind: logKind, Namespace: log.Namespace, Reason: reason}, logger)
+		return nil
+	}
+
+	window := time.Duration(log.Follow.DurationSeconds) * time.Second
+	windowCtx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+
+	logger.Info(fmt.Sprintf("following logs in namespace %q for %s", log.Namespace, window))
+	f := &follower{
+		collector: a,
+		log:       log,
+		ctx:       windowCtx,
+		logger:    logger,
+		runs:      make(map[containerRun]bool),
+		pods:      make(map[string]bool),
+		files:     make(map[LogReference]*rotatingWriter),
+		current:   make(map[LogReference]*followedRun),
+	}
+
+	var wg sync.WaitGroup
+	for _, namespace := range namespaces {
+		wg.Add(1)
+		go func(namespace string) {
+			defer wg.Done()
+			if err := f.followNamespace(namespace); err != nil {
+				f.addError(err)
+			}
+		}(namespace)
+	}
+	wg.Wait()
+	f.wg.Wait()
+
+	for _, file := range f.files {
+		if err := file.Close(); err != nil {
+			f.addError(err)
+		}
+	}
+
+	return stderrors.Join(f.errs...)
+}
+
+// followNamespace follows the pods running in namespace, then watches for new
+// pods and restarted containers until the window ends.
+func (f *follower) followNamespace(namespace string) error {
+	namespacedLog := *f.log
+	namespacedLog.Namespace = namespace
+
+	pods, err := f.collector.listPods(f.ctx, &namespacedLog)
+	if err != nil {
+		if f.ctx.Err() != nil {
+			return nil
+		}
+		if f.collector.isSkippable(err) {
+			f.collector.skipForbidden(logKind, namespace, "", err, f.logger)
+			return nil
+		}
+		return err
+	}
+
+	for i := range pods.Items {
+		f.followPod(&pods.Items[i], true)
+	}
+
+	resourceVersion := pods.ResourceVersion
+	for f.ctx.Err() == nil {
+		resourceVersion, err = f.watchPods(namespace, resourceVersion)
+		if err != nil {
+			if f.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watchPods follows pods as they are added or modified. It returns the resource
+// version to watch from when the watch ends before the window.
+func (f *follower) watchPods(namespace, resourceVersion string) (string, error) {
+	options := metav1.ListOptions{
+		LabelSelector:       labelFiltersSelector(f.log.LabelFilters),
+		ResourceVersion:     resourceVersion,
+		AllowWatchBookmarks: true,
+	}
+
+	var watcher watch.Interface
+	err := f.collector.retry(f.ctx, fmt.Sprintf("watch pods in namespace %q", namespace), func() error {
+		var err error
+		watcher, err = f.collector.clientset.CoreV1().Pods(namespace).Watch(f.ctx, options)
+		return err
+	})
+	if err != nil {
+		f.collector.metrics.observeAPIError(err)
+		return "", err
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			return resourceVersion, nil
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return resourceVersion, nil
+			}
+			switch event.Type {
+			case watch.Error:
+				// Resource version is likely too old: watch again from the current
+				// pods, already followed ones are skipped
+				f.logger.Info(fmt.Sprintf("watch of pods in namespace %q failed: %v",
+					namespace, apiStatusMessage(event.Object)))
+				sleep(f.ctx, f.collector.retryPolicy.Backoff)
+				return "", nil
+			case watch.Added, watch.Modified, watch.Bookmark:
+				pod, ok := event.Object.(*corev1.Pod)
+				if !ok {
+					continue
+				}
+				resourceVersion = pod.ResourceVersion
+				if event.Type != watch.Bookmark {
+					f.followPod(pod, false)
+				}
+			}
+		}
+	}
+}
+
+// apiStatusMessage returns the message of the Status sent with watch errors.
+func apiStatusMessage(obj interface{}) string {
+	if status, ok := obj.(*metav1.Status); ok {
+		return status.Message
+	}
+	return fmt.Sprintf("%v", obj)
+}
+
+// followPod starts streaming the logs of the containers of pod which started and
+// are not followed yet. SinceSeconds and TailLines only apply to the pods running
+// when the window starts, whose previous logs are collected as well.
+func (f *follower) followPod(pod *corev1.Pod, initial bool) {
+	for i := range pod.Status.ContainerStatuses {
+		status := &pod.Status.ContainerStatuses[i]
+		if status.State.Running == nil && status.State.Terminated == nil {
+			continue
+		}
+
+		run := containerRun{
+			ref:          LogReference{Namespace: pod.Namespace, Pod: pod.Name, Container: status.Name},
+			restartCount: status.RestartCount,
+		}
+		f.mu.Lock()
+		if f.runs[run] {
+			f.mu.Unlock()
+			continue
+		}
+		f.runs[run] = true
+		ctx, cancel := context.WithCancel(f.ctx)
+		current := &followedRun{cancel: cancel, done: make(chan struct{})}
+		previousRun := f.current[run.ref]
+		f.current[run.ref] = current
+		f.mu.Unlock()
+
+		podLogOpts := &corev1.PodLogOptions{Container: status.Name, Follow: true}
+		if initial {
+			podLogOpts.SinceSeconds = f.log.SinceSeconds
+			podLogOpts.TailLines = f.log.TailLines
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer close(current.done)
+			defer cancel()
+			if initial && hasPreviousRun(status) {
+				previous := run.ref
+				previous.Previous = true
+				f.collectPrevious(previous)
+			}
+			if previousRun != nil {
+				f.waitRun(previousRun)
+			}
+			f.stream(ctx, run.ref, podLogOpts)
+		}()
+	}
+}
+
+// waitRun waits for the stream of the previous run of a restarted container to end,
+// so runs are written one after the other to the container file. The stream of a
+// terminated container ends once its logs are read; it is canceled if it does not
+// within previousRunTimeout.
+func (f *follower) waitRun(run *followedRun) {
+	timer := time.NewTimer(previousRunTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-run.done:
+		return
+	case <-timer.C:
+	case <-f.ctx.Done():
+	}
+	run.cancel()
+	<-run.done
+}
+
+// collectPrevious collects the logs of the previous run of a container.
+func (f *follower) collectPrevious(ref LogReference) {
+	err := f.collector.collectPodLogs(f.ctx, ref, podLogOptions(f.log, &ref))
+	if err != nil && f.ctx.Err() == nil {
+		f.addError(fmt.Errorf("failed to collect logs of %s: %w", &ref, err))
+		return
+	}
+	f.countContainer(ref)
+}
+
+// stream streams the logs of a container until the container terminates or ctx,
+// which ends with the window, is done.
+func (f *follower) stream(ctx context.Context, ref LogReference, podLogOpts *corev1.PodLogOptions) {
+	a := f.collector
+	if a.sink == nil && a.logHandler == nil {
+		return
+	}
+	if a.sink != nil {
+		if category := a.budget.exhausted(logFilePath(&ref)); category != "" {
+			a.recordDropped(logFilePath(&ref), category)
+			return
+		}
+	}
+
+	start := a.clock.Now()
+	podLogs, err := a.openLogStream(ctx, ref, podLogOpts)
+	if err != nil {
+		if ctx.Err() == nil {
+			f.addError(fmt.Errorf("failed to follow logs of %s: %w", &ref, err))
+		}
+		return
+	}
+	defer podLogs.Close()
+	defer func() {
+		a.metrics.observeLogStream(a.clock.Since(start))
+	}()
+	f.countContainer(ref)
+
+	var out io.Writer
+	if a.sink != nil {
+		out = f.file(ref)
+	}
+
+	// Logs received until the window ends (or the stream is canceled) are complete logs
+	logs := &windowReader{r: podLogs, ctx: ctx}
+	if err := a.storeLogs(ref, logs, out); err != nil && !stderrors.Is(err, errBudgetExhausted) {
+		f.addError(fmt.Errorf("failed to follow logs of %s: %w", &ref, err))
+	}
+}
+
+// file returns the output file of a container. All runs of a container are
+// stored in the same file.
+func (f *follower) file(ref LogReference) *rotatingWriter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, ok := f.files[ref]
+	if !ok {
+		maxBytes := int64(defaultFollowMaxFileBytes)
+		if f.log.Follow.MaxFileBytes != nil {
+			maxBytes = *f.log.Follow.MaxFileBytes
+		}
+		file = f.collector.newRotatingWriter(logFilePath(&ref), maxBytes)
+		f.files[ref] = file
+	}
+	return file
+}
+
+// countContainer adds a container log to the summary. Each pod is counted once.
+func (f *follower) countContainer(ref LogReference) {
+	pod := ref.Namespace + "/" + ref.Pod
+
+	f.mu.Lock()
+	pods := 0
+	if !f.pods[pod] {
+		f.pods[pod] = true
+		pods = 1
+	}
+	f.mu.Unlock()
+
+	f.collector.countLogs(pods, 1)
+}
+
+func (f *follower) addError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.logger.Info(err.Error())
+	f.errs = append(f.errs, err)
+}
+
+// windowReader reports the end of the stream, instead of an error, once the
+// window ended.
+type windowReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (w *windowReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	if err != nil && err != io.EOF && w.ctx.Err() != nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// rotatingWriter writes to relPath until maxBytes are written, then to relPath.1,
+// relPath.2, ... Files are only rotated at the end of a line.
+// It is safe for concurrent use.
+type rotatingWriter struct {
+	collector *Collector
+	relPath   string
+	maxBytes  int64
+
+	mu sync.Mutex
+	// file is the current file, nil until the first write
+	file io.WriteCloser
+	// size is the number of bytes written to the current file
+	size int64
+	// rotations is the number of rotated files
+	rotations int
+	// lineEnded is true if the last byte written ends a line
+	lineEnded bool
+}
+
+func (a *Collector) newRotatingWriter(relPath string, maxBytes int64) *rotatingWriter {
+	return &rotatingWriter{collector: a, relPath: relPath, maxBytes: maxBytes}
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		if w.file == nil || (w.size >= w.maxBytes && w.lineEnded) {
+			if err := w.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		// Write up to the end of the line crossing the limit
+		chunk := p
+		if w.size+int64(len(p)) > w.maxBytes {
+			offset := max(w.maxBytes-w.size-1, 0)
+			if idx := bytes.IndexByte(p[offset:], '\n'); idx >= 0 {
+				chunk = p[:offset+int64(idx)+1]
+			}
+		}
+
+		n, err := w.file.Write(chunk)
+		written += n
+		w.size += int64(n)
+		if n > 0 {
+			w.lineEnded = chunk[n-1] == '\n'
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// rotate closes the current file, if any, and creates the next one.
+func (w *rotatingWriter) rotate() error {
+	name := w.relPath
+	if w.file != nil {
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+		w.rotations++
+		name = fmt.Sprintf("%s.%d", w.relPath, w.rotations)
+	}
+
+	file, err := w.collector.createLogFile(name)
+	if err != nil {
+		return err
+	}
+	w.file, w.size = file, 0
+	return nil
+}
+
+func (w *rotatingWriter) closeFile() error {
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	return w.closeFile()
+}
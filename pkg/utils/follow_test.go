@@ -0,0 +1,154 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+func runningPod(name string, restartCount int32) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: name},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "coredns", Image: "coredns"}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:         "coredns",
+					RestartCount: restartCount,
+					State:        corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+				},
+			},
+		},
+	}
+}
+
+var _ = Describe("Follow", func() {
+	It("Collect follows running pods and pods started during the window", func() {
+		pod := runningPod("coredns", 1)
+
+		clientset := k8sfake.NewSimpleClientset(pod)
+		watcher := watch.NewFake()
+		clientset.PrependWatchReactor("pods", k8stesting.DefaultWatchReactor(watcher, nil))
+
+		results := utils.NewMemoryResults()
+		collector := newTestCollector([]client.Object{pod}, append(results.Options(), utils.WithClientset(clientset))...)
+
+		config := &utils.Configuration{
+			Logs: []utils.Log{{Namespace: "kube-system", Follow: &utils.Follow{DurationSeconds: 1}}},
+		}
+
+		start := time.Now()
+		done := make(chan error)
+		go func() {
+			done <- collector.Collect(context.TODO(), config)
+		}()
+
+		// Pod started during the window, and an event for an already followed pod
+		watcher.Add(runningPod("coredns-new", 0))
+		watcher.Modify(pod)
+
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+
+		current := utils.LogReference{Namespace: "kube-system", Pod: "coredns", Container: "coredns"}
+		previous := current
+		previous.Previous = true
+		started := utils.LogReference{Namespace: "kube-system", Pod: "coredns-new", Container: "coredns"}
+		logs := results.Logs()
+		Expect(logs).To(HaveLen(3))
+		Expect(logs).To(HaveKeyWithValue(current, []byte("fake logs")))
+		Expect(logs).To(HaveKey(previous))
+		Expect(logs).To(HaveKeyWithValue(started, []byte("fake logs")))
+
+		summary := collector.Summary()
+		Expect(summary.Pods).To(Equal(2))
+		Expect(summary.Containers).To(Equal(3))
+	})
+
+	It("Collect follows each run of a restarted container after the previous one", func() {
+		dir, err := os.MkdirTemp("", "follow")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		pod := runningPod("coredns", 0)
+		clientset := k8sfake.NewSimpleClientset(pod)
+		watcher := watch.NewFake()
+		clientset.PrependWatchReactor("pods", k8stesting.DefaultWatchReactor(watcher, nil))
+		collector := newTestCollector([]client.Object{pod}, utils.WithClientset(clientset), utils.WithDirectory(dir))
+
+		config := &utils.Configuration{
+			Logs: []utils.Log{{Namespace: "kube-system", Follow: &utils.Follow{DurationSeconds: 1}}},
+		}
+		done := make(chan error)
+		go func() {
+			done <- collector.Collect(context.TODO(), config)
+		}()
+
+		// Container restarted, twice
+		watcher.Modify(runningPod("coredns", 1))
+		watcher.Modify(runningPod("coredns", 2))
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+
+		logs, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", "coredns-coredns"))
+		Expect(err).To(BeNil())
+		Expect(string(logs)).To(Equal("fake logsfake logsfake logs"))
+		Expect(collector.Summary().Containers).To(Equal(3))
+	})
+
+	It("rotating writer rotates files at the end of a line", func() {
+		dir, err := os.MkdirTemp("", "follow")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector(nil, utils.WithDirectory(dir))
+
+		w := utils.NewRotatingWriter(collector, "logs/kube-system/coredns-coredns", 10)
+		_, err = w.Write([]byte("first line\nsec"))
+		Expect(err).To(BeNil())
+		_, err = w.Write([]byte("ond line\nthird\n"))
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		expected := map[string]string{
+			"coredns-coredns":   "first line\n",
+			"coredns-coredns.1": "second line\n",
+			"coredns-coredns.2": "third\n",
+		}
+		for name, content := range expected {
+			data, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", name))
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(content))
+		}
+	})
+})
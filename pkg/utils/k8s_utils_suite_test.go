@@ -11,9 +11,14 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
 )
 
 var (
@@ -85,3 +90,21 @@ func waitForObject(ctx context.Context, c client.Client, obj client.Object) {
 		Expect(err).To(BeNil())
 	}
 }
+
+// newTestCollector returns a collector whose fake client, clientset and dynamic client
+// all contain objects. options are applied last and can replace any of them.
+func newTestCollector(objects []client.Object, options ...utils.Option) *utils.Collector {
+	runtimeObjects := make([]runtime.Object, len(objects))
+	for i := range objects {
+		runtimeObjects[i] = objects[i]
+	}
+
+	options = append([]utils.Option{
+		utils.WithClient(fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()),
+		utils.WithClientset(k8sfake.NewSimpleClientset(runtimeObjects...)),
+		utils.WithDynamicClient(dynamicfake.NewSimpleDynamicClient(scheme, runtimeObjects...)),
+	}, options...)
+	collector, err := utils.NewCollector(scheme, nil, options...)
+	Expect(err).To(BeNil())
+	return collector
+}
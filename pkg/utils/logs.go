@@ -18,46 +18,175 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"path"
-	"path/filepath"
+	"time"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-
-	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 )
 
 const (
-	permission0600 = 0600
 	permission0644 = 0644
 	permission0755 = 0755
+
+	// logKind is the kind of skipped logs
+	logKind = "Log"
+
+	// containerStatusSuffix is appended to the log file name of a container to store its status
+	containerStatusSuffix = ".status.yaml"
+
+	// Container states
+	containerWaiting    = "Waiting"
+	containerRunning    = "Running"
+	containerTerminated = "Terminated"
+	containerUnknown    = "Unknown"
 )
 
-func (a *Collector) collectLogs(ctx context.Context, log *Log, logger logr.Logger) error {
-	options := client.ListOptions{}
+// ContainerLogStatus is the state of a container when its logs were collected.
+// It is stored next to the logs, in <pod>-<container>.status.yaml.
+type ContainerLogStatus struct {
+	// Container is the name of the container.
+	Container string `json:"container" yaml:"container"`
 
-	if len(log.LabelFilters) > 0 {
-		labelFilter := ""
-		for i := range log.LabelFilters {
-			if labelFilter != "" {
-				labelFilter += ","
-			}
-			f := log.LabelFilters[i]
-			if f.Operation == libsveltosv1alpha1.OperationEqual {
-				labelFilter += fmt.Sprintf("%s=%s", f.Key, f.Value)
-			} else {
-				labelFilter += fmt.Sprintf("%s!=%s", f.Key, f.Value)
+	// State is either Waiting, Running, Terminated or Unknown (no status reported yet).
+	State string `json:"state" yaml:"state"`
+
+	// Reason of the state (e.g. ContainerCreating, CrashLoopBackOff, OOMKilled).
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+
+	// Message of the state.
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+
+	// Ready reports whether the container passes its readiness probe.
+	Ready bool `json:"ready" yaml:"ready"`
+
+	// RestartCount is the number of times the container restarted.
+	RestartCount int32 `json:"restartCount" yaml:"restartCount"`
+
+	// Runs is the restart history known to the kubelet, most recent first: the
+	// current run and the last terminated one. Older runs are not reported.
+	Runs []ContainerRunStatus `json:"runs,omitempty" yaml:"runs,omitempty"`
+
+	// Skipped explains why logs were not collected (the container never started).
+	Skipped string `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+}
+
+// ContainerRunStatus describes a run of a container.
+type ContainerRunStatus struct {
+	// Log is the name of the file containing the logs of this run, if collected.
+	Log string `json:"log,omitempty" yaml:"log,omitempty"`
+
+	// StartedAt is when the run started (RFC3339).
+	StartedAt string `json:"startedAt,omitempty" yaml:"startedAt,omitempty"`
+
+	// FinishedAt is when the run terminated (RFC3339).
+	FinishedAt string `json:"finishedAt,omitempty" yaml:"finishedAt,omitempty"`
+
+	// Reason the run terminated (e.g. Completed, Error, OOMKilled).
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+
+	// ExitCode of the terminated run.
+	ExitCode *int32 `json:"exitCode,omitempty" yaml:"exitCode,omitempty"`
+}
+
+// logPod is a pod whose logs are collected for a log entry.
+type logPod struct {
+	// entry is the index of the log entry
+	entry int
+	// log is the log entry restricted to the namespace of pod
+	log *Log
+	pod *corev1.Pod
+}
+
+// collectLogs collects the logs of all entries. Pods of all entries are listed
+// first so that, with a budget, they are prioritized across entries. After an
+// error, the remaining pods of the same entry are not collected.
+// It returns the error of each entry that failed.
+func (a *Collector) collectLogs(ctx context.Context, logs []Log, logger logr.Logger) []error {
+	errs := make([]error, 0)
+	failed := make(map[int]bool)
+	pods := make([]logPod, 0)
+	namespaces := make([]string, 0)
+	for i := range logs {
+		if ctx.Err() != nil {
+			return errs
+		}
+		entryPods, entryNamespaces, err := a.listLogPods(ctx, i, &logs[i], logger)
+		if err != nil {
+			errs = append(errs, err)
+			failed[i] = true
+		}
+		pods = append(pods, entryPods...)
+		namespaces = append(namespaces, entryNamespaces...)
+	}
+
+	a.prioritizePods(ctx, namespaces, pods, logger)
+	for i := range pods {
+		if ctx.Err() != nil {
+			break
+		}
+		if failed[pods[i].entry] {
+			continue
+		}
+		if err := a.dumpPodLogs(ctx, pods[i].log, pods[i].pod, logger); err != nil {
+			errs = append(errs, err)
+			failed[pods[i].entry] = true
+		}
+	}
+
+	return errs
+}
+
+// listLogPods returns the pods whose logs are collected for log, the entry at
+// index entry, and the namespaces they were listed in.
+func (a *Collector) listLogPods(ctx context.Context, entry int, log *Log, logger logr.Logger,
+) ([]logPod, []string, error) {
+
+	namespaces, reason := a.entryNamespaces(log.Namespace)
+	if reason != "" {
+		a.skip(SkippedEntry{Kind: logKind, Namespace: log.Namespace, Reason: reason}, logger)
+		return nil, nil, nil
+	}
+
+	result := make([]logPod, 0)
+	listed := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		namespacedLog := *log
+		namespacedLog.Namespace = namespace
+
+		pods, err := a.listPods(ctx, &namespacedLog)
+		if err != nil {
+			if a.isSkippable(err) {
+				a.skipForbidden(logKind, namespace, "", err, logger)
+				continue
 			}
+			return result, listed, err
 		}
 
-		parsedSelector, err := labels.Parse(labelFilter)
+		logger.Info(fmt.Sprintf("found %d pods in namespace %q", len(pods.Items), namespace))
+		for i := range pods.Items {
+			result = append(result, logPod{entry: entry, log: &namespacedLog, pod: &pods.Items[i]})
+		}
+		listed = append(listed, namespace)
+	}
+
+	return result, listed, nil
+}
+
+// listPods returns the pods matching log namespace and label filters.
+func (a *Collector) listPods(ctx context.Context, log *Log) (*corev1.PodList, error) {
+	options := client.ListOptions{}
+
+	if len(log.LabelFilters) > 0 {
+		parsedSelector, err := labels.Parse(labelFiltersSelector(log.LabelFilters))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		options.LabelSelector = parsedSelector
 	}
@@ -67,102 +196,280 @@ func (a *Collector) collectLogs(ctx context.Context, log *Log, logger logr.Logge
 	}
 
 	pods := &corev1.PodList{}
-	if err := a.client.List(ctx, pods, &options); err != nil {
+	err := a.doRequest(ctx, fmt.Sprintf("list pods in namespace %q", log.Namespace),
+		func(ctx context.Context) error {
+			return a.client.List(ctx, pods, &options)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return pods, nil
+}
+
+// dumpPodLogs collects logs for all containers in a pod and store them, together
+// with the status of each container. Containers that never started are skipped.
+// If a container has a previous run, it will try to collect its log as well.
+func (a *Collector) dumpPodLogs(ctx context.Context, log *Log, pod *corev1.Pod, logger logr.Logger) error {
+	if err := a.dumpContainerStatuses(pod, logger); err != nil {
 		return err
 	}
 
-	logger.Info(fmt.Sprintf("found %d pods", len(pods.Items)))
-	for i := range pods.Items {
-		if err := a.dumpPodLogs(ctx, log.SinceSeconds, &pods.Items[i]); err != nil {
+	refs := podLogReferences(pod)
+	a.prioritizeLogReferences(pod, refs)
+	for i := range refs {
+		if err := a.collectPodLogs(ctx, refs[i], podLogOptions(log, &refs[i])); err != nil {
+			if a.isSkippable(err) {
+				a.skipForbidden(logKind, pod.Namespace, pod.Name, err, logger)
+				return nil
+			}
 			return err
 		}
 	}
 
+	a.countLogs(1, len(refs))
 	return nil
 }
 
-// dumpPodLogs collects logs for all containers in a pod and store them.
-// If pod has restarted, it will try to collect log from previous run as well.
-func (a *Collector) dumpPodLogs(ctx context.Context, since *int64, pod *corev1.Pod) error {
+// podLogReferences returns the logs of all containers in a pod which started,
+// including the logs of the previous run of containers which have one.
+func podLogReferences(pod *corev1.Pod) []LogReference {
+	refs := make([]LogReference, 0, len(pod.Spec.Containers))
 	for i := range pod.Spec.Containers {
-		container := &pod.Spec.Containers[i]
-		resourceFilePath := path.Join(a.directory, "logs", pod.Namespace, pod.Name+"-"+container.Name)
-		err := os.MkdirAll(filepath.Dir(resourceFilePath), permission0755)
-		if err != nil {
-			return err
+		status := containerStatus(pod, pod.Spec.Containers[i].Name)
+		if neverStarted(status) != "" {
+			continue
 		}
 
-		err = a.collectPodLogs(ctx, pod.Namespace, pod.Name, container.Name, resourceFilePath, since, false)
-		if err != nil {
-			return err
+		ref := LogReference{Namespace: pod.Namespace, Pod: pod.Name, Container: status.Name}
+		refs = append(refs, ref)
+
+		if hasPreviousRun(status) {
+			ref.Previous = true
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs
+}
+
+// containerStatus returns the status of the container named name, nil if not reported yet.
+func containerStatus(pod *corev1.Pod, name string) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == name {
+			return &pod.Status.ContainerStatuses[i]
 		}
+	}
+	return nil
+}
 
-		// If container restarted, collect previous logs as well
-		for i := range pod.Status.ContainerStatuses {
-			containerStatus := &pod.Status.ContainerStatuses[i]
-			if containerStatus.Name == container.Name &&
-				containerStatus.RestartCount > 0 {
+// neverStarted returns why a container never started, hence has no logs. It returns
+// an empty string if the container started at least once.
+func neverStarted(status *corev1.ContainerStatus) string {
+	switch {
+	case status == nil:
+		return "container never started: no status reported"
+	case status.State.Running != nil || status.State.Terminated != nil || hasPreviousRun(status):
+		return ""
+	case status.State.Waiting != nil && status.State.Waiting.Reason != "":
+		return "container never started: " + status.State.Waiting.Reason
+	default:
+		return "container never started"
+	}
+}
 
-				resourceFilePath := path.Join(a.directory, "logs", pod.Namespace,
-					pod.Name+"-"+container.Name+".previous")
+// hasPreviousRun returns true if the container has the logs of a previous run.
+// LastTerminationState is set even when restartCount was reset (e.g. pod sandbox recreated).
+func hasPreviousRun(status *corev1.ContainerStatus) bool {
+	return status.LastTerminationState.Terminated != nil || status.RestartCount > 0
+}
 
-				err := os.MkdirAll(filepath.Dir(resourceFilePath), permission0755)
-				if err != nil {
-					return err
-				}
+// dumpContainerStatuses stores the status of each container of pod next to its
+// logs and records, as skipped, the containers that never started.
+func (a *Collector) dumpContainerStatuses(pod *corev1.Pod, logger logr.Logger) error {
+	for i := range pod.Spec.Containers {
+		name := pod.Spec.Containers[i].Name
+		status := containerLogStatus(pod, name)
+		if status.Skipped != "" {
+			a.skip(SkippedEntry{Kind: logKind, Namespace: pod.Namespace, Name: pod.Name + "/" + name,
+				Reason: status.Skipped}, logger)
+		}
 
-				err = a.collectPodLogs(ctx, pod.Namespace, pod.Name, container.Name, resourceFilePath, since, true)
-				if err != nil {
-					return err
-				}
-			}
+		ref := LogReference{Namespace: pod.Namespace, Pod: pod.Name, Container: name}
+		if err := a.writeYAML(logFilePath(&ref)+containerStatusSuffix, status); err != nil {
+			return err
 		}
 	}
+	a.keepLoggedPod(pod)
 
 	return nil
 }
 
-// collectPodLogs collect logs for a given namespace/pod container
-func (a *Collector) collectPodLogs(ctx context.Context, namespace, podName, containerName, filename string,
-	since *int64, previous bool) (err error) {
+// containerLogStatus returns the status of the container named name.
+func containerLogStatus(pod *corev1.Pod, name string) *ContainerLogStatus {
+	logStatus := &ContainerLogStatus{Container: name, State: containerUnknown}
+	status := containerStatus(pod, name)
+	logStatus.Skipped = neverStarted(status)
+	if status == nil {
+		return logStatus
+	}
 
-	// open output file
-	var fo *os.File
-	fo, err = os.Create(filename)
-	if err != nil {
-		return err
+	logStatus.Ready = status.Ready
+	logStatus.RestartCount = status.RestartCount
+
+	ref := LogReference{Namespace: pod.Namespace, Pod: pod.Name, Container: name}
+	current := ContainerRunStatus{}
+	if logStatus.Skipped == "" {
+		current.Log = path.Base(logFilePath(&ref))
+	}
+	switch {
+	case status.State.Waiting != nil:
+		logStatus.State = containerWaiting
+		logStatus.Reason = status.State.Waiting.Reason
+		logStatus.Message = status.State.Waiting.Message
+	case status.State.Running != nil:
+		logStatus.State = containerRunning
+		current.StartedAt = formatTime(status.State.Running.StartedAt)
+	case status.State.Terminated != nil:
+		logStatus.State = containerTerminated
+		logStatus.Reason = status.State.Terminated.Reason
+		logStatus.Message = status.State.Terminated.Message
+		current = terminatedRun(status.State.Terminated, current.Log)
+	}
+	// A waiting container has no current run
+	if logStatus.State != containerWaiting {
+		logStatus.Runs = append(logStatus.Runs, current)
+	}
+
+	if last := status.LastTerminationState.Terminated; last != nil {
+		ref.Previous = true
+		logStatus.Runs = append(logStatus.Runs, terminatedRun(last, path.Base(logFilePath(&ref))))
+	}
+
+	return logStatus
+}
+
+// terminatedRun returns the run terminated describes, whose logs are stored in log.
+func terminatedRun(terminated *corev1.ContainerStateTerminated, log string) ContainerRunStatus {
+	exitCode := terminated.ExitCode
+	return ContainerRunStatus{
+		Log:        log,
+		StartedAt:  formatTime(terminated.StartedAt),
+		FinishedAt: formatTime(terminated.FinishedAt),
+		Reason:     terminated.Reason,
+		ExitCode:   &exitCode,
+	}
+}
+
+// formatTime returns t in RFC3339 format, an empty string if t is not set.
+func formatTime(t metav1.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// podLogOptions returns the options to request the logs ref points to.
+func podLogOptions(log *Log, ref *LogReference) *corev1.PodLogOptions {
+	podLogOpts := &corev1.PodLogOptions{
+		Container: ref.Container,
+		Previous:  ref.Previous,
 	}
-	// close fo on exit and check for its returned error
-	defer func() {
-		if cerr := fo.Close(); cerr != nil {
-			if err == nil {
-				err = cerr
-			}
-		}
-	}()
 
-	podLogOpts := corev1.PodLogOptions{}
-	if containerName != "" {
-		podLogOpts.Container = containerName
+	if log != nil {
+		podLogOpts.SinceSeconds = log.SinceSeconds
+		podLogOpts.TailLines = log.TailLines
 	}
 
-	if previous {
-		podLogOpts.Previous = previous
+	return podLogOpts
+}
+
+// logFilePath returns where the logs ref points to are stored.
+func logFilePath(ref *LogReference) string {
+	name := ref.Pod + "-" + ref.Container
+	if ref.Previous {
+		name += ".previous"
 	}
+	return path.Join("logs", ref.Namespace, name)
+}
 
-	if since != nil {
-		podLogOpts.SinceSeconds = since
+// collectPodLogs collect logs for a given namespace/pod container.
+// Logs are passed to the log handler, if any, and stored in the sink, if any.
+func (a *Collector) collectPodLogs(ctx context.Context, ref LogReference,
+	podLogOpts *corev1.PodLogOptions) (err error) {
+
+	if a.sink == nil && a.logHandler == nil {
+		return nil
+	}
+	if a.sink != nil {
+		if category := a.budget.exhausted(logFilePath(&ref)); category != "" {
+			a.recordDropped(logFilePath(&ref), category)
+			return nil
+		}
 	}
 
-	req := a.clientset.CoreV1().Pods(namespace).GetLogs(podName, &podLogOpts)
+	streamCtx, cancel := a.streamContext(ctx)
+	defer cancel()
+	// Runs last, once the output file is closed: logs received before the deadline are kept
+	defer func() {
+		if err != nil && isTimedOut(ctx, streamCtx) {
+			a.recordTimeout(fmt.Sprintf("logs of %s", &ref))
+			err = nil
+		}
+	}()
+
+	start := a.clock.Now()
 	var podLogs io.ReadCloser
-	podLogs, err = req.Stream(ctx)
+	podLogs, err = a.openLogStream(streamCtx, ref, podLogOpts)
 	if err != nil {
 		return err
 	}
 	defer podLogs.Close()
+	defer func() {
+		a.metrics.observeLogStream(a.clock.Since(start))
+	}()
+
+	var out io.Writer
+	if a.sink != nil {
+		// open output file
+		var fo io.WriteCloser
+		fo, err = a.createLogFile(logFilePath(&ref))
+		if err != nil {
+			return err
+		}
+		out = fo
+		// close fo on exit and check for its returned error
+		defer func() {
+			if cerr := fo.Close(); cerr != nil {
+				if err == nil {
+					err = cerr
+				}
+			}
+		}()
+	}
+
+	err = a.storeLogs(ref, podLogs, out)
+	if errors.Is(err, errBudgetExhausted) {
+		err = nil
+	}
+	return err
+}
+
+// storeLogs passes logs to the log handler, if any, and writes them to out, if not nil.
+func (a *Collector) storeLogs(ref LogReference, logs io.Reader, out io.Writer) error {
+	if a.logHandler == nil {
+		_, err := io.Copy(out, logs)
+		return err
+	}
 
-	_, err = io.Copy(fo, podLogs)
+	if out != nil {
+		logs = io.TeeReader(logs, out)
+	}
+	if err := a.logHandler(ref, logs); err != nil {
+		return err
+	}
 
+	// Store whatever the handler did not consume
+	_, err := io.Copy(io.Discard, logs)
 	return err
 }
@@ -0,0 +1,175 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Logs", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "logs")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readStatus := func(name string) *utils.ContainerLogStatus {
+		data, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", name+".status.yaml"))
+		Expect(err).To(BeNil())
+		status := &utils.ContainerLogStatus{}
+		Expect(yaml.Unmarshal(data, status)).To(Succeed())
+		return status
+	}
+
+	collect := func(pod *corev1.Pod, compression ...*utils.LogCompression) (*utils.Collector, *utils.MemoryResults) {
+		results := utils.NewMemoryResults()
+		collector := newTestCollector([]client.Object{pod}, append(results.Options(), utils.WithDirectory(dir))...)
+
+		config := &utils.Configuration{Logs: []utils.Log{{Namespace: "kube-system"}}}
+		if len(compression) > 0 {
+			config.LogCompression = compression[0]
+		}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+		return collector, results
+	}
+
+	It("Collect skips containers that never started and records why", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "pending"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "creating"}, {Name: "unscheduled"}},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodPending,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name:  "creating",
+						State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+					},
+				},
+			},
+		}
+
+		collector, results := collect(pod)
+		Expect(results.Logs()).To(BeEmpty())
+
+		skipped := collector.Skipped()
+		Expect(skipped).To(HaveLen(2))
+		Expect(skipped[0]).To(Equal(utils.SkippedEntry{Kind: "Log", Namespace: "kube-system", Name: "pending/creating",
+			Reason: "container never started: ContainerCreating"}))
+		Expect(skipped[1].Name).To(Equal("pending/unscheduled"))
+
+		status := readStatus("pending-creating")
+		Expect(status.State).To(Equal("Waiting"))
+		Expect(status.Reason).To(Equal("ContainerCreating"))
+		Expect(status.Skipped).To(Equal("container never started: ContainerCreating"))
+		Expect(status.Runs).To(BeEmpty())
+		Expect(readStatus("pending-unscheduled").State).To(Equal("Unknown"))
+	})
+
+	It("Collect collects previous logs whenever the last termination is known", func() {
+		started := metav1.NewTime(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+		finished := metav1.NewTime(time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC))
+		pod := runningPod("coredns", 0)
+		pod.Status.ContainerStatuses[0].LastTerminationState = corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137,
+				StartedAt: started, FinishedAt: finished},
+		}
+
+		collector, results := collect(pod)
+		current := utils.LogReference{Namespace: "kube-system", Pod: "coredns", Container: "coredns"}
+		previous := current
+		previous.Previous = true
+		Expect(results.Logs()).To(HaveLen(2))
+		Expect(results.Logs()).To(HaveKey(previous))
+		Expect(collector.Skipped()).To(BeEmpty())
+
+		exitCode := int32(137)
+		status := readStatus("coredns-coredns")
+		Expect(status.State).To(Equal("Running"))
+		Expect(status.Runs).To(Equal([]utils.ContainerRunStatus{
+			{Log: "coredns-coredns"},
+			{Log: "coredns-coredns.previous", StartedAt: "2024-01-01T10:00:00Z", FinishedAt: "2024-01-01T11:00:00Z",
+				Reason: "OOMKilled", ExitCode: &exitCode},
+		}))
+
+		summary, err := utils.InspectBundle(dir)
+		Expect(err).To(BeNil())
+		Expect(summary.Logs).To(Equal(2))
+	})
+
+	It("Collect compresses logs larger than the threshold", func() {
+		threshold := int64(len("fake logs") - 1)
+		_, results := collect(runningPod("coredns", 0),
+			&utils.LogCompression{Algorithm: utils.CompressionGzip, ThresholdBytes: &threshold})
+
+		ref := utils.LogReference{Namespace: "kube-system", Pod: "coredns", Container: "coredns"}
+		// The log handler receives uncompressed logs
+		Expect(results.Logs()).To(HaveKeyWithValue(ref, []byte("fake logs")))
+
+		logFile := filepath.Join(dir, "logs", "kube-system", "coredns-coredns")
+		Expect(logFile).ToNot(BeAnExistingFile())
+		file, err := os.Open(logFile + ".gz")
+		Expect(err).To(BeNil())
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		Expect(err).To(BeNil())
+		Expect(io.ReadAll(reader)).To(Equal([]byte("fake logs")))
+	})
+
+	It("Collect compresses all logs with zstd and threshold 0", func() {
+		threshold := int64(0)
+		collect(runningPod("coredns", 0), &utils.LogCompression{Algorithm: utils.CompressionZstd, ThresholdBytes: &threshold})
+
+		data, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", "coredns-coredns.zst"))
+		Expect(err).To(BeNil())
+		decoder, err := zstd.NewReader(nil)
+		Expect(err).To(BeNil())
+		defer decoder.Close()
+		Expect(decoder.DecodeAll(data, nil)).To(Equal([]byte("fake logs")))
+	})
+
+	It("Collect stores logs smaller than the threshold as they are", func() {
+		collect(runningPod("coredns", 0), &utils.LogCompression{Algorithm: utils.CompressionGzip})
+
+		data, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", "coredns-coredns"))
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(Equal("fake logs"))
+	})
+})
@@ -0,0 +1,184 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// resumableLogStream reads the logs of a container. Logs are requested with
+// timestamps, which are removed from the returned lines.
+// When the stream fails with a transient error, logs are requested again from the
+// timestamp of the last returned line, so lines are neither lost nor duplicated.
+// Lines sharing that timestamp are told apart by their position: as many as were
+// returned are skipped.
+type resumableLogStream struct {
+	ctx        context.Context
+	collector  *Collector
+	ref        LogReference
+	podLogOpts *corev1.PodLogOptions
+	request    logRequest
+
+	stream   io.ReadCloser
+	reader   *bufio.Reader
+	pending  []byte
+	attempts int
+	backoff  wait.Backoff
+
+	// last is the timestamp of the last returned line
+	last time.Time
+	// lastLines is the number of returned lines stamped last
+	lastLines int
+	// resuming is true, after reconnecting, until a line not returned yet is read
+	resuming bool
+	// skipped is the number of lines stamped last skipped since reconnecting
+	skipped int
+}
+
+// logRequest opens a stream with the logs of a container
+type logRequest func(ctx context.Context, podLogOpts *corev1.PodLogOptions) (io.ReadCloser, error)
+
+// openLogStream returns the logs ref points to. Opening the stream is retried
+// according to the collector retry policy.
+func (a *Collector) openLogStream(ctx context.Context, ref LogReference, podLogOpts *corev1.PodLogOptions,
+) (io.ReadCloser, error) {
+
+	return a.newLogStream(ctx, ref, podLogOpts,
+		func(ctx context.Context, podLogOpts *corev1.PodLogOptions) (io.ReadCloser, error) {
+			return a.clientset.CoreV1().Pods(ref.Namespace).GetLogs(ref.Pod, podLogOpts).Stream(ctx)
+		})
+}
+
+func (a *Collector) newLogStream(ctx context.Context, ref LogReference, podLogOpts *corev1.PodLogOptions,
+	request logRequest) (io.ReadCloser, error) {
+
+	s := &resumableLogStream{
+		ctx:        ctx,
+		collector:  a,
+		ref:        ref,
+		podLogOpts: podLogOpts.DeepCopy(),
+		request:    request,
+		backoff:    a.retryPolicy.backoff(),
+	}
+	s.podLogOpts.Timestamps = true
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open (re)opens the stream. Until any line is returned, original options are used.
+// Afterwards logs are requested since the second of the last returned line.
+func (s *resumableLogStream) open() error {
+	opts := s.podLogOpts
+	if !s.last.IsZero() {
+		opts = opts.DeepCopy()
+		opts.TailLines = nil
+		opts.SinceSeconds = nil
+		opts.SinceTime = &metav1.Time{Time: s.last.Truncate(time.Second)}
+		s.resuming = true
+		s.skipped = 0
+	}
+
+	return s.collector.retryAttempt(s.ctx, &s.attempts, &s.backoff, s.what(),
+		func() error {
+			stream, err := s.request(s.ctx, opts)
+			if err != nil {
+				s.collector.metrics.observeAPIError(err)
+				return err
+			}
+			s.stream = stream
+			s.reader = bufio.NewReader(stream)
+			return nil
+		})
+}
+
+func (s *resumableLogStream) what() string {
+	return fmt.Sprintf("logs of %s", &s.ref)
+}
+
+func (s *resumableLogStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		line, err := s.reader.ReadBytes('\n')
+		// A line broken by an error is requested again when resuming
+		if err == nil || (err == io.EOF && len(line) > 0) {
+			s.pending = s.process(line)
+			continue
+		}
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+
+		s.stream.Close()
+		if !s.collector.waitRetry(s.ctx, s.attempts, &s.backoff, s.what(), err) {
+			return 0, err
+		}
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// process removes the timestamp of line. It returns nothing for lines already
+// returned before resuming.
+func (s *resumableLogStream) process(line []byte) []byte {
+	idx := bytes.IndexByte(line, ' ')
+	if idx < 0 {
+		return line
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, string(line[:idx]))
+	if err != nil {
+		return line
+	}
+
+	if s.resuming {
+		if timestamp.Before(s.last) {
+			return nil
+		}
+		if timestamp.Equal(s.last) && s.skipped < s.lastLines {
+			s.skipped++
+			return nil
+		}
+		s.resuming = false
+	}
+
+	if timestamp.Equal(s.last) {
+		s.lastLines++
+	} else {
+		s.last = timestamp
+		s.lastLines = 1
+	}
+	return line[idx+1:]
+}
+
+func (s *resumableLogStream) Close() error {
+	return s.stream.Close()
+}
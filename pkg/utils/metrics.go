@@ -0,0 +1,239 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	metricsNamespace = "k8s_collector"
+
+	// Type of written data, bytesWrittenTotal label
+	dataResources    = "resources"
+	dataLogs         = "logs"
+	dataApplications = "applications"
+	dataOther        = "other"
+
+	// errorCodeUnknown is the code of errors not returned by the API server (e.g. connection errors)
+	errorCodeUnknown = "unknown"
+)
+
+// Metrics are the Prometheus metrics of a collector. Create them with NewMetrics
+// and pass them to collectors with WithMetrics.
+type Metrics struct {
+	objectsCollected  *prometheus.CounterVec
+	bytesWritten      *prometheus.CounterVec
+	logStreamDuration prometheus.Histogram
+	apiErrors         *prometheus.CounterVec
+	retries           prometheus.Counter
+	triggers          *prometheus.CounterVec
+
+	runs                 *prometheus.CounterVec
+	runDuration          prometheus.Gauge
+	lastRunSuccess       prometheus.Gauge
+	lastRunTimestamp     prometheus.Gauge
+	lastRunObjects       prometheus.Gauge
+	lastRunContainerLogs prometheus.Gauge
+}
+
+// NewMetrics creates the collector metrics and registers them with registerer.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		objectsCollected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "objects_collected_total",
+			Help:      "Number of collected objects per GroupVersionKind",
+		}, []string{"gvk"}),
+		bytesWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_written_total",
+			Help:      "Number of bytes written per type of data (resources, logs, applications, other)",
+		}, []string{"type"}),
+		logStreamDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "log_stream_duration_seconds",
+			Help:      "Time spent collecting a container log stream",
+			Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+		}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_errors_total",
+			Help:      "Number of failed API requests per HTTP status code (unknown for connection errors)",
+		}, []string{"code"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "retries_total",
+			Help:      "Number of list requests and log streams retried after a transient error",
+		}),
+		triggers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "triggers_total",
+			Help: "Number of failures detected in controller mode per reason and outcome " +
+				"(collected, duplicate, rate_limited, dropped)",
+		}, []string{"reason", "outcome"}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "runs_total",
+			Help:      "Number of collections per status (Succeeded or Failed)",
+		}, []string{"status"}),
+		runDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_run_duration_seconds",
+			Help:      "Duration of the last collection",
+		}),
+		lastRunSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_run_success",
+			Help:      "1 if the last collection succeeded, 0 otherwise",
+		}),
+		lastRunTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Unix time the last collection completed",
+		}),
+		lastRunObjects: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_run_objects",
+			Help:      "Number of objects collected by the last collection",
+		}),
+		lastRunContainerLogs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_run_container_logs",
+			Help:      "Number of container logs collected by the last collection",
+		}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.objectsCollected, m.bytesWritten, m.logStreamDuration, m.apiErrors, m.retries, m.triggers, m.runs, m.runDuration,
+		m.lastRunSuccess, m.lastRunTimestamp, m.lastRunObjects, m.lastRunContainerLogs,
+	}
+	for i := range collectors {
+		if err := registerer.Register(collectors[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// WithMetrics sets the metrics updated while collecting.
+func WithMetrics(m *Metrics) Option {
+	return func(a *Collector) {
+		a.metrics = m
+	}
+}
+
+// ObserveRun updates the metrics describing a whole collection (status, duration,
+// completion time and collected objects and logs) from its summary.
+func (m *Metrics) ObserveRun(summary *Summary, completed time.Time) {
+	m.runs.WithLabelValues(summary.Status).Inc()
+
+	if duration, err := time.ParseDuration(summary.Duration); err == nil {
+		m.runDuration.Set(duration.Seconds())
+	}
+
+	success := 0.0
+	if summary.Status == CollectionSucceeded {
+		success = 1
+	}
+	m.lastRunSuccess.Set(success)
+	m.lastRunTimestamp.Set(float64(completed.Unix()))
+	m.lastRunObjects.Set(float64(summary.Objects))
+	m.lastRunContainerLogs.Set(float64(summary.Containers))
+}
+
+func (m *Metrics) observeObject(gvk schema.GroupVersionKind) {
+	if m != nil {
+		m.objectsCollected.WithLabelValues(path.Join(gvk.Group, gvk.Version, gvk.Kind)).Inc()
+	}
+}
+
+// observeBytesWritten counts n bytes written in the file at relPath.
+func (m *Metrics) observeBytesWritten(relPath string, n int64) {
+	if m != nil && n > 0 {
+		m.bytesWritten.WithLabelValues(dataType(relPath)).Add(float64(n))
+	}
+}
+
+func (m *Metrics) observeLogStream(duration time.Duration) {
+	if m != nil {
+		m.logStreamDuration.Observe(duration.Seconds())
+	}
+}
+
+// observeAPIError counts a failed API request. Nil errors are ignored.
+func (m *Metrics) observeAPIError(err error) {
+	if m == nil || err == nil {
+		return
+	}
+
+	code := errorCodeUnknown
+	var status apierrors.APIStatus
+	if errors.As(err, &status) && status.Status().Code != 0 {
+		code = strconv.Itoa(int(status.Status().Code))
+	}
+	m.apiErrors.WithLabelValues(code).Inc()
+}
+
+func (m *Metrics) observeRetry() {
+	if m != nil {
+		m.retries.Inc()
+	}
+}
+
+func (m *Metrics) observeTrigger(reason, outcome string) {
+	if m == nil {
+		return
+	}
+	m.triggers.WithLabelValues(reason, outcome).Inc()
+}
+
+// dataType returns the type of data stored in the file at relPath.
+func dataType(relPath string) string {
+	switch strings.Split(relPath, "/")[0] {
+	case resourcesDir:
+		return dataResources
+	case logsDir:
+		return dataLogs
+	case applicationsDir:
+		return dataApplications
+	default:
+		return dataOther
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
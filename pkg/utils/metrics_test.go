@@ -0,0 +1,128 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Metrics", func() {
+	It("Collect updates metrics", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "coredns", Image: "coredns"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "coredns", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				},
+			},
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).WithInterceptorFuncs(
+			interceptor.Funcs{
+				List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+					options := &client.ListOptions{}
+					options.ApplyOptions(opts)
+					if options.Namespace == "forbidden" {
+						return apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", nil)
+					}
+					return c.List(ctx, list, opts...)
+				},
+			}).Build()
+
+		registry := prometheus.NewRegistry()
+		metrics, err := utils.NewMetrics(registry)
+		Expect(err).To(BeNil())
+
+		dir, err := os.MkdirTemp("", "metrics")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		collector := newTestCollector([]client.Object{pod}, utils.WithClient(c), utils.WithDirectory(dir), utils.WithMetrics(metrics))
+
+		config := &utils.Configuration{
+			Logs: []utils.Log{{Namespace: "kube-system"}, {Namespace: "forbidden"}},
+		}
+		Expect(collector.Collect(context.TODO(), config)).ToNot(Succeed())
+		metrics.ObserveRun(collector.Summary(), time.Unix(1700000000, 0))
+
+		expected := `
+# HELP k8s_collector_api_errors_total Number of failed API requests per HTTP status code (unknown for connection errors)
+# TYPE k8s_collector_api_errors_total counter
+k8s_collector_api_errors_total{code="403"} 1
+# HELP k8s_collector_last_run_container_logs Number of container logs collected by the last collection
+# TYPE k8s_collector_last_run_container_logs gauge
+k8s_collector_last_run_container_logs 1
+# HELP k8s_collector_last_run_success 1 if the last collection succeeded, 0 otherwise
+# TYPE k8s_collector_last_run_success gauge
+k8s_collector_last_run_success 0
+# HELP k8s_collector_last_run_timestamp_seconds Unix time the last collection completed
+# TYPE k8s_collector_last_run_timestamp_seconds gauge
+k8s_collector_last_run_timestamp_seconds 1.7e+09
+# HELP k8s_collector_runs_total Number of collections per status (Succeeded or Failed)
+# TYPE k8s_collector_runs_total counter
+k8s_collector_runs_total{status="Failed"} 1
+`
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(expected),
+			"k8s_collector_api_errors_total",
+			"k8s_collector_last_run_container_logs", "k8s_collector_last_run_success",
+			"k8s_collector_last_run_timestamp_seconds", "k8s_collector_runs_total")).To(Succeed())
+
+		families, err := registry.Gather()
+		Expect(err).To(BeNil())
+		bytesWritten := make(map[string]float64)
+		for _, family := range families {
+			if family.GetName() != "k8s_collector_bytes_written_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				bytesWritten[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+		// Logs and the status of the container
+		status, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", "coredns-coredns.status.yaml"))
+		Expect(err).To(BeNil())
+		Expect(bytesWritten).To(HaveKeyWithValue("logs", float64(len("fake logs")+len(status))))
+		// summary.yaml
+		Expect(bytesWritten).To(HaveKey("other"))
+
+		count, err := testutil.GatherAndCount(registry, "k8s_collector_log_stream_duration_seconds")
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(1))
+	})
+})
@@ -0,0 +1,617 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// overviewMarkdownFile and overviewHTMLFile are the overview of the cluster at the
+	// root of collected data
+	overviewMarkdownFile = "SUMMARY.md"
+	overviewHTMLFile     = "index.html"
+
+	// overviewTopRestarts is the number of most restarted containers reported
+	overviewTopRestarts = 10
+
+	nodeRoleLabelPrefix = "node-role.kubernetes.io/"
+)
+
+// clusterOverview is the overview of a cluster, built from collected data.
+type clusterOverview struct {
+	Status   string
+	Start    string
+	Duration string
+	Message  string
+	Version  string
+
+	Nodes []overviewNode
+	// Pods is the number of pods known to the collection
+	Pods int
+	// Namespaces groups, per namespace, the pods not Running and Ready
+	Namespaces []overviewNamespace
+	Restarts   []overviewContainer
+	Warnings   []overviewWarning
+	Failures   []SkippedEntry
+	Clusters   []overviewCluster
+}
+
+type overviewLink struct {
+	Text string
+	Href string
+}
+
+type overviewNode struct {
+	Name        string
+	Status      string
+	Roles       string
+	Version     string
+	Capacity    string
+	Allocatable string
+	Links       []overviewLink
+}
+
+type overviewNamespace struct {
+	Name string
+	Pods []overviewPod
+}
+
+type overviewPod struct {
+	Name     string
+	Phase    string
+	Reason   string
+	Ready    string
+	Restarts int32
+	Links    []overviewLink
+}
+
+type overviewContainer struct {
+	Namespace  string
+	Pod        string
+	Container  string
+	Restarts   int32
+	LastReason string
+	Links      []overviewLink
+}
+
+type overviewWarning struct {
+	Reason  string
+	Count   int32
+	Objects int
+	Message string
+}
+
+type overviewCluster struct {
+	Name    string
+	Status  string
+	Message string
+	Links   []overviewLink
+}
+
+// writeOverview stores SUMMARY.md and index.html, an overview of the cluster built
+// from the objects the collection saw, linking to collected logs and resources.
+func (a *Collector) writeOverview(summary *Summary, logger logr.Logger) error {
+	if a.sink == nil {
+		return nil
+	}
+
+	overview := a.buildOverview(summary)
+	logger.Info(fmt.Sprintf("storing cluster overview in %s and %s", overviewMarkdownFile, overviewHTMLFile))
+
+	var markdown bytes.Buffer
+	if err := markdownOverview.Execute(&markdown, overview); err != nil {
+		return err
+	}
+	if err := a.writeFile(overviewMarkdownFile, markdown.Bytes()); err != nil {
+		return err
+	}
+
+	var html bytes.Buffer
+	if err := htmlOverview.Execute(&html, overview); err != nil {
+		return err
+	}
+	return a.writeFile(overviewHTMLFile, html.Bytes())
+}
+
+func (a *Collector) buildOverview(summary *Summary) *clusterOverview {
+	overview := &clusterOverview{
+		Status:   summary.Status,
+		Start:    summary.StartTime,
+		Duration: summary.Duration,
+		Message:  summary.Message(),
+	}
+
+	dropped := make(map[string]bool, len(summary.Dropped))
+	for _, p := range summary.Dropped {
+		dropped[p] = true
+	}
+	// link returns a link to relPath, if it was stored
+	link := func(text, relPath string) []overviewLink {
+		if relPath == "" || dropped[relPath] {
+			return nil
+		}
+		return []overviewLink{{Text: text, Href: relPath}}
+	}
+
+	for i := range summary.Clusters {
+		status := &summary.Clusters[i]
+		clusterDir := path.Join(clustersDir, clusterDirName(status.Cluster))
+		overview.Clusters = append(overview.Clusters, overviewCluster{
+			Name: status.Cluster, Status: status.Status, Message: status.FailureMessage,
+			Links: []overviewLink{
+				{Text: overviewHTMLFile, Href: path.Join(clusterDir, overviewHTMLFile)},
+				{Text: overviewMarkdownFile, Href: path.Join(clusterDir, overviewMarkdownFile)},
+			},
+		})
+	}
+	for i := range summary.Skipped {
+		if summary.Skipped[i].Kind != logKind {
+			overview.Failures = append(overview.Failures, summary.Skipped[i])
+		}
+	}
+
+	k := a.keptObjects()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	overview.Version = k.serverVersion
+	overview.Failures = append(overview.Failures, k.failures...)
+
+	for _, node := range k.nodes {
+		resourcePath := path.Join(resourcesDir, nodeKind, node.Name)
+		overview.Nodes = append(overview.Nodes, overviewNode{
+			Name:        node.Name,
+			Status:      nodeStatus(node),
+			Roles:       nodeRoles(node),
+			Version:     node.Status.NodeInfo.KubeletVersion,
+			Capacity:    resourceSummary(node.Status.Capacity),
+			Allocatable: resourceSummary(node.Status.Allocatable),
+			Links: append(link("yaml", resourcePath+".yaml"),
+				link("describe", resourcePath+describeSuffix)...),
+		})
+	}
+	sort.Slice(overview.Nodes, func(i, j int) bool { return overview.Nodes[i].Name < overview.Nodes[j].Name })
+
+	pods, described := k.overviewPods()
+	overview.Pods = len(pods)
+	namespaces := make(map[string]*overviewNamespace)
+	for _, pod := range pods {
+		key := pod.Namespace + "/" + pod.Name
+		resourcePath := path.Join(resourcesDir, pod.Namespace, podKind, pod.Name)
+		var podLinks []overviewLink
+		if described[key] {
+			podLinks = append(link("yaml", resourcePath+".yaml"), link("describe", resourcePath+describeSuffix)...)
+		}
+
+		for i := range pod.Status.ContainerStatuses {
+			status := &pod.Status.ContainerStatuses[i]
+			if status.RestartCount == 0 {
+				continue
+			}
+			ref := LogReference{Namespace: pod.Namespace, Pod: pod.Name, Container: status.Name}
+			previous := ref
+			previous.Previous = true
+			lastReason := ""
+			if status.LastTerminationState.Terminated != nil {
+				lastReason = status.LastTerminationState.Terminated.Reason
+			}
+			overview.Restarts = append(overview.Restarts, overviewContainer{
+				Namespace: pod.Namespace, Pod: pod.Name, Container: status.Name,
+				Restarts: status.RestartCount, LastReason: lastReason,
+				Links: append(link("logs", k.logFiles[logFilePath(&ref)]),
+					link("previous logs", k.logFiles[logFilePath(&previous)])...),
+			})
+		}
+
+		if isRunningAndReady(pod) || pod.Status.Phase == corev1.PodSucceeded {
+			continue
+		}
+		for i := range pod.Spec.Containers {
+			ref := LogReference{Namespace: pod.Namespace, Pod: pod.Name, Container: pod.Spec.Containers[i].Name}
+			podLinks = append(podLinks, link(ref.Container+" logs", k.logFiles[logFilePath(&ref)])...)
+		}
+		ns, ok := namespaces[pod.Namespace]
+		if !ok {
+			ns = &overviewNamespace{Name: pod.Namespace}
+			namespaces[pod.Namespace] = ns
+		}
+		ns.Pods = append(ns.Pods, overviewPod{
+			Name: pod.Name, Phase: string(pod.Status.Phase), Reason: podReason(pod), Ready: readyContainers(pod),
+			Restarts: podRestarts(pod), Links: podLinks,
+		})
+	}
+	for _, ns := range namespaces {
+		overview.Namespaces = append(overview.Namespaces, *ns)
+	}
+	sort.Slice(overview.Namespaces, func(i, j int) bool {
+		return overview.Namespaces[i].Name < overview.Namespaces[j].Name
+	})
+
+	sort.SliceStable(overview.Restarts, func(i, j int) bool {
+		return overview.Restarts[i].Restarts > overview.Restarts[j].Restarts
+	})
+	if len(overview.Restarts) > overviewTopRestarts {
+		overview.Restarts = overview.Restarts[:overviewTopRestarts]
+	}
+
+	overview.Warnings = k.warningsByReason()
+	return overview
+}
+
+// overviewPods returns the pods the collection saw, collected as resources or whose
+// logs were collected, sorted by namespace and name. described contains the pods
+// collected as resources (<namespace>/<name>).
+func (k *keptObjects) overviewPods() (pods []*corev1.Pod, described map[string]bool) {
+	described = make(map[string]bool, len(k.pods))
+	byKey := make(map[string]*corev1.Pod)
+	for _, pod := range k.pods {
+		key := pod.Namespace + "/" + pod.Name
+		described[key] = true
+		byKey[key] = pod
+	}
+	for _, pod := range k.loggedPods {
+		key := pod.Namespace + "/" + pod.Name
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = pod
+		}
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pods = make([]*corev1.Pod, len(keys))
+	for i := range keys {
+		pods[i] = byKey[keys[i]]
+	}
+	return pods, described
+}
+
+// warningsByReason aggregates Warning events per reason, most frequent first.
+func (k *keptObjects) warningsByReason() []overviewWarning {
+	byReason := make(map[string]*overviewWarning)
+	objects := make(map[string]map[string]bool)
+	for key, events := range k.events {
+		for _, event := range events {
+			if event.Type != corev1.EventTypeWarning {
+				continue
+			}
+			warning, ok := byReason[event.Reason]
+			if !ok {
+				warning = &overviewWarning{Reason: event.Reason}
+				byReason[event.Reason] = warning
+				objects[event.Reason] = make(map[string]bool)
+			}
+			warning.Count += max(event.Count, 1)
+			objects[event.Reason][key] = true
+			if warning.Message == "" {
+				warning.Message = strings.TrimSpace(event.Message)
+			}
+		}
+	}
+
+	warnings := make([]overviewWarning, 0, len(byReason))
+	for reason, warning := range byReason {
+		warning.Objects = len(objects[reason])
+		warnings = append(warnings, *warning)
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].Count != warnings[j].Count {
+			return warnings[i].Count > warnings[j].Count
+		}
+		return warnings[i].Reason < warnings[j].Reason
+	})
+	return warnings
+}
+
+func nodeStatus(node *corev1.Node) string {
+	status := "Unknown"
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type != corev1.NodeReady {
+			continue
+		}
+		switch node.Status.Conditions[i].Status {
+		case corev1.ConditionTrue:
+			status = "Ready"
+		case corev1.ConditionFalse:
+			status = "NotReady"
+		}
+	}
+	if node.Spec.Unschedulable {
+		status += ",SchedulingDisabled"
+	}
+	return status
+}
+
+func nodeRoles(node *corev1.Node) string {
+	roles := make([]string, 0)
+	for label := range node.Labels {
+		if role, ok := strings.CutPrefix(label, nodeRoleLabelPrefix); ok && role != "" {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return strings.Join(roles, ",")
+}
+
+// resourceSummary describes the cpu, memory and pods of list.
+func resourceSummary(list corev1.ResourceList) string {
+	parts := make([]string, 0)
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourcePods} {
+		if quantity, ok := list[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s: %s", name, quantity.String()))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func isRunningAndReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == corev1.PodReady {
+			return pod.Status.Conditions[i].Status == corev1.ConditionTrue
+		}
+	}
+	// Without conditions, pods are ready when all their containers are
+	for i := range pod.Status.ContainerStatuses {
+		if !pod.Status.ContainerStatuses[i].Ready {
+			return false
+		}
+	}
+	return len(pod.Status.ContainerStatuses) > 0
+}
+
+// podReason returns why pod is not running and ready, as kubectl get pods does.
+func podReason(pod *corev1.Pod) string {
+	if pod.DeletionTimestamp != nil {
+		return "Terminating"
+	}
+	if pod.Status.Reason != "" {
+		return pod.Status.Reason
+	}
+	for i := range pod.Status.ContainerStatuses {
+		state := &pod.Status.ContainerStatuses[i].State
+		switch {
+		case state.Waiting != nil && state.Waiting.Reason != "":
+			return state.Waiting.Reason
+		case state.Terminated != nil && state.Terminated.Reason != "":
+			return state.Terminated.Reason
+		}
+	}
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Status != corev1.ConditionTrue && pod.Status.Conditions[i].Reason != "" {
+			return pod.Status.Conditions[i].Reason
+		}
+	}
+	return ""
+}
+
+func readyContainers(pod *corev1.Pod) string {
+	ready := 0
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Ready {
+			ready++
+		}
+	}
+	return fmt.Sprintf("%d/%d", ready, len(pod.Spec.Containers))
+}
+
+func podRestarts(pod *corev1.Pod) int32 {
+	restarts := int32(0)
+	for i := range pod.Status.ContainerStatuses {
+		restarts += pod.Status.ContainerStatuses[i].RestartCount
+	}
+	return restarts
+}
+
+// markdownCell escapes value for a Markdown table cell.
+func markdownCell(value string) string {
+	return strings.NewReplacer("|", "\\|", "<", "&lt;", "\r", " ", "\n", " ").Replace(value)
+}
+
+var markdownOverview = template.Must(template.New(overviewMarkdownFile).Funcs(template.FuncMap{"cell": markdownCell}).Parse(
+	`# Cluster overview
+
+{{ cell .Message }}
+
+| Status | Started | Duration | Kubernetes version |
+|---|---|---|---|
+| {{ .Status }} | {{ .Start }} | {{ .Duration }} | {{ or .Version "unknown" }} |
+{{- if .Clusters }}
+
+Collected data: [clusters](clusters/), [summary.yaml](summary.yaml)
+
+## Clusters
+
+| Cluster | Status | Failure | Links |
+|---|---|---|---|
+{{- range .Clusters }}
+| {{ cell .Name }} | {{ .Status }} | {{ cell .Message }} |{{ range .Links }} [{{ .Text }}]({{ .Href }}){{ end }} |
+{{- end }}
+{{- else }}
+
+Collected data: [logs](logs/), [resources](resources/), [summary.yaml](summary.yaml)
+
+## Nodes
+{{ if .Nodes }}
+| Node | Status | Roles | Version | Capacity | Allocatable | Links |
+|---|---|---|---|---|---|---|
+{{- range .Nodes }}
+| {{ .Name }} | {{ .Status }} | {{ .Roles }} | {{ .Version }} | {{ .Capacity }} | {{ .Allocatable }} |{{ range .Links }} [{{ .Text }}]({{ .Href }}){{ end }} |
+{{- end }}
+{{- else }}
+No Node collected.
+{{- end }}
+
+## Pods not Running and Ready
+{{ if .Namespaces }}
+{{- range .Namespaces }}
+### {{ .Name }}
+
+| Pod | Phase | Reason | Ready | Restarts | Links |
+|---|---|---|---|---|---|
+{{- range .Pods }}
+| {{ .Name }} | {{ .Phase }} | {{ cell .Reason }} | {{ .Ready }} | {{ .Restarts }} |{{ range .Links }} [{{ .Text }}]({{ .Href }}){{ end }} |
+{{- end }}
+{{ end }}
+{{- else }}
+All {{ .Pods }} pods are Running and Ready (or Succeeded).
+{{ end }}
+## Most restarted containers
+{{ if .Restarts }}
+| Namespace | Pod | Container | Restarts | Last termination | Links |
+|---|---|---|---|---|---|
+{{- range .Restarts }}
+| {{ .Namespace }} | {{ .Pod }} | {{ .Container }} | {{ .Restarts }} | {{ cell .LastReason }} |{{ range .Links }} [{{ .Text }}]({{ .Href }}){{ end }} |
+{{- end }}
+{{- else }}
+No container restarted.
+{{- end }}
+
+## Warning events
+{{ if .Warnings }}
+| Reason | Count | Objects | Message |
+|---|---|---|---|
+{{- range .Warnings }}
+| {{ cell .Reason }} | {{ .Count }} | {{ .Objects }} | {{ cell .Message }} |
+{{- end }}
+{{- else }}
+No Warning event collected.
+{{- end }}
+{{- end }}
+
+## Failed collections
+{{ if .Failures }}
+| Kind | Namespace | Name | Reason |
+|---|---|---|---|
+{{- range .Failures }}
+| {{ cell .Kind }} | {{ .Namespace }} | {{ .Name }} | {{ cell .Reason }} |
+{{- end }}
+{{- else }}
+All resources were collected.
+{{- end }}
+`))
+
+var htmlOverview = htmltemplate.Must(htmltemplate.New(overviewHTMLFile).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Cluster overview</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+.Succeeded, .Ready { color: #1a7f37; }
+.Failed, .NotReady { color: #cf222e; }
+</style>
+</head>
+<body>
+{{- define "links" }}{{ range $i, $l := . }}{{ if $i }} | {{ end }}<a href="{{ $l.Href }}">{{ $l.Text }}</a>{{ end }}{{ end }}
+<h1>Cluster overview</h1>
+<p>{{ .Message }}</p>
+<table>
+<tr><th>Status</th><th>Started</th><th>Duration</th><th>Kubernetes version</th></tr>
+<tr><td class="{{ .Status }}">{{ .Status }}</td><td>{{ .Start }}</td><td>{{ .Duration }}</td><td>{{ or .Version "unknown" }}</td></tr>
+</table>
+{{- if .Clusters }}
+<p>Collected data: <a href="clusters/">clusters</a> | <a href="summary.yaml">summary.yaml</a></p>
+<h2>Clusters</h2>
+<table>
+<tr><th>Cluster</th><th>Status</th><th>Failure</th><th>Links</th></tr>
+{{- range .Clusters }}
+<tr><td>{{ .Name }}</td><td class="{{ .Status }}">{{ .Status }}</td><td>{{ .Message }}</td><td>{{ template "links" .Links }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>Collected data: <a href="logs/">logs</a> | <a href="resources/">resources</a> | <a href="summary.yaml">summary.yaml</a></p>
+<h2>Nodes</h2>
+{{- if .Nodes }}
+<table>
+<tr><th>Node</th><th>Status</th><th>Roles</th><th>Version</th><th>Capacity</th><th>Allocatable</th><th>Links</th></tr>
+{{- range .Nodes }}
+<tr><td>{{ .Name }}</td><td class="{{ .Status }}">{{ .Status }}</td><td>{{ .Roles }}</td><td>{{ .Version }}</td>
+<td>{{ .Capacity }}</td><td>{{ .Allocatable }}</td><td>{{ template "links" .Links }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>No Node collected.</p>
+{{- end }}
+<h2>Pods not Running and Ready</h2>
+{{- range .Namespaces }}
+<h3>{{ .Name }}</h3>
+<table>
+<tr><th>Pod</th><th>Phase</th><th>Reason</th><th>Ready</th><th>Restarts</th><th>Links</th></tr>
+{{- range .Pods }}
+<tr><td>{{ .Name }}</td><td class="{{ .Phase }}">{{ .Phase }}</td><td>{{ .Reason }}</td><td>{{ .Ready }}</td>
+<td>{{ .Restarts }}</td><td>{{ template "links" .Links }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>All {{ .Pods }} pods are Running and Ready (or Succeeded).</p>
+{{- end }}
+<h2>Most restarted containers</h2>
+{{- if .Restarts }}
+<table>
+<tr><th>Namespace</th><th>Pod</th><th>Container</th><th>Restarts</th><th>Last termination</th><th>Links</th></tr>
+{{- range .Restarts }}
+<tr><td>{{ .Namespace }}</td><td>{{ .Pod }}</td><td>{{ .Container }}</td><td>{{ .Restarts }}</td>
+<td>{{ .LastReason }}</td><td>{{ template "links" .Links }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>No container restarted.</p>
+{{- end }}
+<h2>Warning events</h2>
+{{- if .Warnings }}
+<table>
+<tr><th>Reason</th><th>Count</th><th>Objects</th><th>Message</th></tr>
+{{- range .Warnings }}
+<tr><td>{{ .Reason }}</td><td>{{ .Count }}</td><td>{{ .Objects }}</td><td>{{ .Message }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>No Warning event collected.</p>
+{{- end }}
+{{- end }}
+<h2>Failed collections</h2>
+{{- if .Failures }}
+<table>
+<tr><th>Kind</th><th>Namespace</th><th>Name</th><th>Reason</th></tr>
+{{- range .Failures }}
+<tr><td>{{ .Kind }}</td><td>{{ .Namespace }}</td><td>{{ .Name }}</td><td>{{ .Reason }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>All resources were collected.</p>
+{{- end }}
+</body>
+</html>
+`))
@@ -0,0 +1,141 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Overview", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "overview")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readFile := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		Expect(err).To(BeNil())
+		return string(content)
+	}
+
+	It("Collect writes SUMMARY.md and index.html linking to the logs of failing pods", func() {
+		crashing := crashingPod("nginx-5d8f-x2k4", nil)
+		running := runningPod("coredns", 0)
+		running.Status.Phase = corev1.PodRunning
+		running.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+
+		clientset := k8sfake.NewSimpleClientset(crashing, running)
+		clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: "v1.31.2"}
+		collector := newTestCollector([]client.Object{crashing, running}, utils.WithDirectory(dir), utils.WithClientset(clientset))
+
+		config := &utils.Configuration{Logs: []utils.Log{{Namespace: "web"}, {Namespace: "kube-system"}}}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		markdown := readFile("SUMMARY.md")
+		Expect(markdown).To(ContainSubstring("| Succeeded | "))
+		Expect(markdown).To(ContainSubstring("v1.31.2"))
+		Expect(markdown).To(ContainSubstring("### web"))
+		Expect(markdown).To(ContainSubstring("| nginx-5d8f-x2k4 |  | CrashLoopBackOff | 0/1 | 3 | [nginx logs](logs/web/nginx-5d8f-x2k4-nginx) |"))
+		// Running and Ready pods are not listed
+		Expect(markdown).ToNot(ContainSubstring("### kube-system"))
+		Expect(markdown).To(ContainSubstring("| web | nginx-5d8f-x2k4 | nginx | 3 |  | [logs](logs/web/nginx-5d8f-x2k4-nginx) " +
+			"[previous logs](logs/web/nginx-5d8f-x2k4-nginx.previous) |"))
+
+		html := readFile("index.html")
+		Expect(html).To(ContainSubstring(`<a href="logs/web/nginx-5d8f-x2k4-nginx.previous">previous logs</a>`))
+		Expect(html).To(ContainSubstring("<h3>web</h3>"))
+
+		// The overview is not counted nor compared
+		summary, err := utils.InspectBundle(dir)
+		Expect(err).To(BeNil())
+		Expect(summary.Resources).To(BeEmpty())
+	})
+
+	It("writeOverview reports nodes, Warning events by reason and failed collections", func() {
+		collector := newTestCollector(nil, utils.WithDirectory(dir))
+
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker", Labels: map[string]string{"node-role.kubernetes.io/worker": ""}},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionFalse}},
+				Capacity:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+			},
+		}
+		warning := func(name, reason, message string, count int32) *corev1.Event {
+			return &corev1.Event{
+				ObjectMeta:     metav1.ObjectMeta{Namespace: "web", Name: name},
+				InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "web", Name: name},
+				Type:           corev1.EventTypeWarning,
+				Reason:         reason,
+				Message:        message,
+				Count:          count,
+			}
+		}
+		for _, obj := range []*corev1.Event{
+			warning("a.1", "BackOff", "Back-off restarting failed container", 3),
+			warning("b.1", "BackOff", "Back-off restarting failed container", 2),
+			warning("c.1", "FailedMount", "<script>alert(1)</script>", 1),
+		} {
+			Expect(utils.DumpObject(collector, obj, logr.Discard())).To(Succeed())
+		}
+		Expect(utils.DumpObject(collector, node, logr.Discard())).To(Succeed())
+
+		summary := &utils.Summary{
+			Status: utils.CollectionFailed,
+			Skipped: []utils.SkippedEntry{
+				{Kind: "/v1, Kind=Secret", Namespace: "web", Reason: "forbidden: secrets is forbidden"},
+			},
+		}
+		Expect(utils.WriteOverview(collector, summary, logr.Discard())).To(Succeed())
+
+		markdown := readFile("SUMMARY.md")
+		Expect(markdown).To(ContainSubstring("| worker | NotReady | worker |  | cpu: 4 |  | [yaml](resources/Node/worker.yaml) " +
+			"[describe](resources/Node/worker.describe.txt) |"))
+		Expect(markdown).To(ContainSubstring("| BackOff | 5 | 2 | Back-off restarting failed container |\n| FailedMount | 1 | 1 |"))
+		Expect(markdown).To(ContainSubstring("| /v1, Kind=Secret | web |  | forbidden: secrets is forbidden |"))
+		Expect(markdown).To(ContainSubstring("All 0 pods are Running and Ready"))
+
+		Expect(markdown).To(ContainSubstring("| FailedMount | 1 | 1 | &lt;script>alert(1)&lt;/script> |"))
+
+		html := readFile("index.html")
+		Expect(html).ToNot(ContainSubstring("<script>"))
+		Expect(html).To(ContainSubstring("&lt;script&gt;"))
+	})
+})
@@ -0,0 +1,423 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// planPageSize is the number of objects listed per request when counting resources
+	planPageSize = 500
+)
+
+// Plan describes what collecting a configuration would do. It is computed
+// against the live cluster without storing anything.
+type Plan struct {
+	// Resources contains one entry per resource entry of the configuration
+	// (including the ones of the applications).
+	Resources []ResourcePlan `json:"resources,omitempty" yaml:"resources,omitempty"`
+
+	// Logs contains one entry per log entry of the configuration
+	// (including the ones of the applications).
+	Logs []LogPlan `json:"logs,omitempty" yaml:"logs,omitempty"`
+
+	// Applications contains one entry per application of the configuration.
+	Applications []ApplicationPlan `json:"applications,omitempty" yaml:"applications,omitempty"`
+
+	// Objects is the total number of objects that would be collected.
+	Objects int `json:"objects" yaml:"objects"`
+
+	// Containers is the total number of container logs that would be collected.
+	Containers int `json:"containers" yaml:"containers"`
+
+	// EstimatedLogBytes is the estimated size of all logs. It is a lower bound
+	// when the logs of any container exceed the probe size.
+	EstimatedLogBytes int64 `json:"estimatedLogBytes" yaml:"estimatedLogBytes"`
+}
+
+// ResourcePlan describes the objects a resource entry matches.
+type ResourcePlan struct {
+	Group   string `json:"group" yaml:"group"`
+	Version string `json:"version" yaml:"version"`
+	Kind    string `json:"kind" yaml:"kind"`
+
+	// Application is set when the entry is part of an application (<namespace>/<instance>).
+	Application string `json:"application,omitempty" yaml:"application,omitempty"`
+
+	// Served is false when the cluster does not serve this GroupVersionKind.
+	Served bool `json:"served" yaml:"served"`
+
+	// Resource is the resource name discovery maps the Kind to.
+	Resource string `json:"resource,omitempty" yaml:"resource,omitempty"`
+
+	// Namespaced is true for namespaced resources.
+	Namespaced bool `json:"namespaced" yaml:"namespaced"`
+
+	// LabelSelector and FieldSelector are used to list objects. Namespaced resources
+	// are listed in the namespace of the entry, if any.
+	LabelSelector string `json:"labelSelector,omitempty" yaml:"labelSelector,omitempty"`
+	FieldSelector string `json:"fieldSelector,omitempty" yaml:"fieldSelector,omitempty"`
+
+	// Objects is the number of matching objects. Objects of the application Helm
+	// release manifest are not included: they are counted in ManifestObjects.
+	Objects int `json:"objects" yaml:"objects"`
+
+	// Namespaces contains the namespaces of the matching objects.
+	Namespaces []string `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
+
+	// Error reports why objects could not be listed.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// Skipped reports why, in namespaced mode, the entry would not be collected.
+	Skipped string `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+}
+
+// LogPlan describes the container logs a log entry matches.
+type LogPlan struct {
+	// Namespace of the pods. Empty means all namespaces.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+	// Application is set when the entry is part of an application (<namespace>/<instance>).
+	Application string `json:"application,omitempty" yaml:"application,omitempty"`
+
+	// LabelSelector is used to list pods.
+	LabelSelector string `json:"labelSelector,omitempty" yaml:"labelSelector,omitempty"`
+
+	// Pods is the number of matching pods.
+	Pods int `json:"pods" yaml:"pods"`
+
+	// FollowSeconds, if set, is how long logs would be streamed. Estimated size
+	// does not include logs written meanwhile.
+	FollowSeconds int64 `json:"followSeconds,omitempty" yaml:"followSeconds,omitempty"`
+
+	// Containers contains the container logs that would be collected.
+	Containers []ContainerLogPlan `json:"containers,omitempty" yaml:"containers,omitempty"`
+
+	// EstimatedBytes is the estimated size of all container logs.
+	EstimatedBytes int64 `json:"estimatedBytes" yaml:"estimatedBytes"`
+
+	// Error reports why pods could not be listed.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// Skipped reports why, in namespaced mode, the entry would not be collected.
+	Skipped string `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+}
+
+// ContainerLogPlan describes the logs of a container.
+type ContainerLogPlan struct {
+	LogReference `json:",inline" yaml:",inline"`
+
+	// EstimatedBytes is the size of the logs, read up to the probe size.
+	EstimatedBytes int64 `json:"estimatedBytes" yaml:"estimatedBytes"`
+
+	// AtLeast is true when logs exceed the probe size, so EstimatedBytes is a lower bound.
+	AtLeast bool `json:"atLeast,omitempty" yaml:"atLeast,omitempty"`
+
+	// Error reports why logs could not be probed.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// ApplicationPlan describes the Helm release of an application.
+type ApplicationPlan struct {
+	Namespace   string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Instance    string `json:"instance" yaml:"instance"`
+	HelmRelease string `json:"helmRelease,omitempty" yaml:"helmRelease,omitempty"`
+
+	// HelmReleaseRevision is the revision that would be collected. Zero if release is not found.
+	HelmReleaseRevision int `json:"helmReleaseRevision,omitempty" yaml:"helmReleaseRevision,omitempty"`
+
+	// ManifestObjects is the number of objects in the Helm release manifest.
+	ManifestObjects int `json:"manifestObjects,omitempty" yaml:"manifestObjects,omitempty"`
+
+	// Error reports why the Helm release could not be read.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Plan resolves config against the cluster and returns what collecting it would
+// do: discovery mappings, matching objects, pods and containers. Nothing is
+// collected or stored.
+// If probeBytes is greater than 0, the size of each container log is estimated
+// reading at most probeBytes bytes of it (using limitBytes). Otherwise log sizes
+// are not estimated.
+// Errors listing objects or pods are reported in the plan entries.
+func (a *Collector) Plan(ctx context.Context, config *Configuration, probeBytes int64) (*Plan, error) {
+	resolved, err := prepareConfiguration(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discovery runs once per plan, not once per entry
+	a.mu.Lock()
+	a.mapper = nil
+	a.mu.Unlock()
+
+	plan := &Plan{}
+	for i := range resolved.Resources {
+		plan.Resources = append(plan.Resources, a.planResources(ctx, &resolved.Resources[i], "", nil))
+	}
+
+	for i := range resolved.Logs {
+		plan.Logs = append(plan.Logs, a.planLogs(ctx, &resolved.Logs[i], "", probeBytes))
+	}
+
+	for i := range resolved.Applications {
+		app := &resolved.Applications[i]
+		appPlan, manifestKeys := a.planApplication(ctx, app)
+		plan.Applications = append(plan.Applications, appPlan)
+
+		name := path.Join(app.Namespace, applicationInstance(app))
+		resources, log := applicationEntries(app)
+		for i := range resources {
+			plan.Resources = append(plan.Resources, a.planResources(ctx, &resources[i], name, manifestKeys))
+		}
+		plan.Logs = append(plan.Logs, a.planLogs(ctx, log, name, probeBytes))
+	}
+
+	for i := range plan.Resources {
+		plan.Objects += plan.Resources[i].Objects
+	}
+	for i := range plan.Applications {
+		plan.Objects += plan.Applications[i].ManifestObjects
+	}
+	for i := range plan.Logs {
+		plan.Containers += len(plan.Logs[i].Containers)
+		plan.EstimatedLogBytes += plan.Logs[i].EstimatedBytes
+	}
+
+	return plan, nil
+}
+
+// planResources returns the plan of a resource entry. Objects whose key (see objectKey)
+// is in excluded are not counted.
+func (a *Collector) planResources(ctx context.Context, resource *Resource, application string,
+	excluded map[string]bool) ResourcePlan {
+
+	plan := ResourcePlan{
+		Group:       resource.Group,
+		Version:     resource.Version,
+		Kind:        resource.Kind,
+		Application: application,
+	}
+
+	gvk := schema.GroupVersionKind{Group: resource.Group, Version: resource.Version, Kind: resource.Kind}
+	dr, mapping, err := a.getDynamicResource(gvk)
+	if err != nil {
+		if !apimeta.IsNoMatchError(err) {
+			plan.Error = err.Error()
+		}
+		return plan
+	}
+
+	plan.Served = true
+	plan.Resource = mapping.Resource.Resource
+	plan.Namespaced = mapping.Scope.Name() == apimeta.RESTScopeNameNamespace
+
+	if a.isNamespaced() && !plan.Namespaced {
+		plan.Skipped = reasonClusterScoped
+		return plan
+	}
+
+	entryNamespaces, reason := a.entryNamespaces(resource.Namespace)
+	if reason != "" {
+		plan.Skipped = reason
+		return plan
+	}
+
+	namespaces := make(map[string]bool)
+	for _, namespace := range entryNamespaces {
+		namespacedResource := *resource
+		namespacedResource.Namespace = namespace
+
+		ri, options := resourceLister(dr, mapping, &namespacedResource)
+		plan.LabelSelector = options.LabelSelector
+		plan.FieldSelector = options.FieldSelector
+
+		err := a.countResources(ctx, fmt.Sprintf("list %s in namespace %q", gvk, namespace), ri, options,
+			excluded, &plan, namespaces)
+		if err != nil {
+			plan.Error = err.Error()
+			break
+		}
+	}
+	plan.Namespaces = sortedKeys(namespaces)
+
+	return plan
+}
+
+// countResources pages through the matching objects, adding the ones not in excluded
+// to plan and their namespaces to namespaces. what describes the request.
+func (a *Collector) countResources(ctx context.Context, what string, ri dynamic.ResourceInterface,
+	options metav1.ListOptions, excluded map[string]bool, plan *ResourcePlan, namespaces map[string]bool) error {
+
+	gk := schema.GroupKind{Group: plan.Group, Kind: plan.Kind}
+	options.Limit = planPageSize
+	for {
+		var list *unstructured.UnstructuredList
+		err := a.doRequest(ctx, what, func(ctx context.Context) (err error) {
+			list, err = ri.List(ctx, options)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range list.Items {
+			u := &list.Items[i]
+			if excluded[objectKey(gk, u.GetNamespace(), u.GetName())] {
+				continue
+			}
+			plan.Objects++
+			if ns := u.GetNamespace(); ns != "" {
+				namespaces[ns] = true
+			}
+		}
+
+		options.Continue = list.GetContinue()
+		if options.Continue == "" {
+			return nil
+		}
+	}
+}
+
+func (a *Collector) planLogs(ctx context.Context, log *Log, application string, probeBytes int64) LogPlan {
+	plan := LogPlan{
+		Namespace:     log.Namespace,
+		Application:   application,
+		LabelSelector: labelFiltersSelector(log.LabelFilters),
+	}
+	if log.Follow != nil {
+		plan.FollowSeconds = log.Follow.DurationSeconds
+	}
+
+	namespaces, reason := a.entryNamespaces(log.Namespace)
+	if reason != "" {
+		plan.Skipped = reason
+		return plan
+	}
+
+	for _, namespace := range namespaces {
+		namespacedLog := *log
+		namespacedLog.Namespace = namespace
+
+		pods, err := a.listPods(ctx, &namespacedLog)
+		if err != nil {
+			plan.Error = err.Error()
+			return plan
+		}
+
+		plan.Pods += len(pods.Items)
+		for i := range pods.Items {
+			refs := podLogReferences(&pods.Items[i])
+			for j := range refs {
+				container := ContainerLogPlan{LogReference: refs[j]}
+				if probeBytes > 0 {
+					a.probeLogs(ctx, log, &container, probeBytes)
+				}
+				plan.EstimatedBytes += container.EstimatedBytes
+				plan.Containers = append(plan.Containers, container)
+			}
+		}
+	}
+
+	return plan
+}
+
+// probeLogs reads at most probeBytes bytes of the container logs to estimate their size.
+// Like log streams of a collection, the probe is bounded by the log stream timeout
+// and retried when it fails.
+func (a *Collector) probeLogs(ctx context.Context, log *Log, container *ContainerLogPlan, probeBytes int64) {
+	podLogOpts := podLogOptions(log, &container.LogReference)
+	podLogOpts.LimitBytes = &probeBytes
+
+	streamCtx, cancel := a.streamContext(ctx)
+	defer cancel()
+
+	err := a.retry(streamCtx, fmt.Sprintf("logs of %s", &container.LogReference), func() error {
+		stream, err := a.clientset.CoreV1().Pods(container.Namespace).GetLogs(container.Pod, podLogOpts).
+			Stream(streamCtx)
+		if err != nil {
+			a.metrics.observeAPIError(err)
+			return err
+		}
+		defer stream.Close()
+
+		container.EstimatedBytes, err = io.Copy(io.Discard, stream)
+		return err
+	})
+	if err != nil {
+		container.Error = err.Error()
+	}
+	container.AtLeast = container.EstimatedBytes >= probeBytes
+}
+
+// planApplication returns the plan of an application Helm release and the keys
+// (see objectKey) of the objects of its manifest.
+func (a *Collector) planApplication(ctx context.Context, app *Application) (ApplicationPlan, map[string]bool) {
+	plan := ApplicationPlan{
+		Namespace:   app.Namespace,
+		Instance:    applicationInstance(app),
+		HelmRelease: app.HelmRelease,
+	}
+
+	if app.HelmRelease == "" {
+		return plan, nil
+	}
+
+	if _, reason := a.entryNamespaces(app.Namespace); reason != "" {
+		plan.Error = reason
+		return plan, nil
+	}
+
+	release, err := a.getHelmRelease(ctx, app.Namespace, app.HelmRelease)
+	if err != nil {
+		plan.Error = err.Error()
+		return plan, nil
+	}
+	if release == nil {
+		return plan, nil
+	}
+
+	plan.HelmReleaseRevision = release.Version
+	objects, err := parseManifest(release.Manifest)
+	if err != nil {
+		plan.Error = fmt.Sprintf("invalid manifest: %v", err)
+		return plan, nil
+	}
+	plan.ManifestObjects = len(objects)
+
+	// Application resources are namespaced: objects without namespace are in the release one
+	keys := make(map[string]bool, len(objects))
+	for i := range objects {
+		namespace := objects[i].GetNamespace()
+		if namespace == "" {
+			namespace = release.Namespace
+		}
+		keys[objectKey(objects[i].GroupVersionKind().GroupKind(), namespace, objects[i].GetName())] = true
+	}
+
+	return plan, keys
+}
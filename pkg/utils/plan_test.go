@@ -0,0 +1,177 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+var _ = Describe("Plan", func() {
+	var collector *utils.Collector
+	var config *utils.Configuration
+
+	BeforeEach(func() {
+		running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+		pods := []client.Object{
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns",
+					Labels: map[string]string{"k8s-app": "kube-dns"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "coredns"}, {Name: "sidecar"}},
+				},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "coredns", RestartCount: 2, State: running},
+						{Name: "sidecar", State: running},
+					},
+				},
+			},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "etcd"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "etcd"}}},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{{Name: "etcd", State: running}},
+				},
+			},
+		}
+
+		collector = newTestCollector(pods)
+
+		config = &utils.Configuration{
+			Logs: []utils.Log{
+				{
+					Namespace: "kube-system",
+					LabelFilters: []libsveltosv1alpha1.LabelFilter{
+						{Key: "k8s-app", Operation: libsveltosv1alpha1.OperationEqual, Value: "kube-dns"},
+					},
+				},
+			},
+		}
+	})
+
+	It("Plan lists matching containers, including previous runs", func() {
+		plan, err := collector.Plan(context.TODO(), config, 0)
+		Expect(err).To(BeNil())
+		Expect(plan.Logs).To(HaveLen(1))
+		Expect(plan.Logs[0].LabelSelector).To(Equal("k8s-app=kube-dns"))
+		Expect(plan.Logs[0].Pods).To(Equal(1))
+		Expect(plan.Logs[0].Containers).To(HaveLen(3))
+		Expect(plan.Logs[0].Containers[1].LogReference).To(Equal(utils.LogReference{
+			Namespace: "kube-system", Pod: "coredns", Container: "coredns", Previous: true}))
+		Expect(plan.Containers).To(Equal(3))
+		Expect(plan.EstimatedLogBytes).To(BeZero())
+	})
+
+	It("Plan estimates log sizes reading at most probeBytes", func() {
+		// fake clientset always returns "fake logs"
+		plan, err := collector.Plan(context.TODO(), config, 1024)
+		Expect(err).To(BeNil())
+		Expect(plan.EstimatedLogBytes).To(Equal(int64(3 * len("fake logs"))))
+		for i := range plan.Logs[0].Containers {
+			Expect(plan.Logs[0].Containers[i].AtLeast).To(BeFalse())
+		}
+
+		plan, err = collector.Plan(context.TODO(), config, 4)
+		Expect(err).To(BeNil())
+		Expect(plan.Logs[0].Containers[0].AtLeast).To(BeTrue())
+	})
+
+	It("Plan runs discovery once", func() {
+		clientset := k8sfake.NewSimpleClientset()
+		collector = newTestCollector(nil, utils.WithClientset(clientset))
+
+		config = &utils.Configuration{
+			Resources: []utils.Resource{
+				{Group: "example.com", Version: "v1", Kind: "Foo"},
+				{Group: "example.com", Version: "v1", Kind: "Bar"},
+			},
+		}
+		plan, err := collector.Plan(context.TODO(), config, 0)
+		Expect(err).To(BeNil())
+		Expect(plan.Resources).To(HaveLen(2))
+		Expect(plan.Resources[1].Served).To(BeFalse())
+
+		discoveries := 0
+		for _, action := range clientset.Actions() {
+			if action.GetResource().Resource == "resource" {
+				discoveries++
+			}
+		}
+		Expect(discoveries).To(Equal(1))
+	})
+
+	It("Plan counts objects of the Helm release manifest once", func() {
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "nginx",
+			Labels: map[string]string{"app.kubernetes.io/instance": "nginx"}}}
+		objects := []client.Object{helmReleaseSecret("web", "nginx", 1), deployment}
+		collector = newTestCollector(objects, utils.WithClientset(servingClientset(objects...)))
+
+		config = &utils.Configuration{
+			Applications: []utils.Application{{Namespace: "web", HelmRelease: "nginx"}},
+		}
+		plan, err := collector.Plan(context.TODO(), config, 0)
+		Expect(err).To(BeNil())
+		Expect(plan.Applications[0].ManifestObjects).To(Equal(2))
+		for i := range plan.Resources {
+			Expect(plan.Resources[i].Objects).To(BeZero())
+		}
+		Expect(plan.Objects).To(Equal(2))
+	})
+
+	It("Plan retries list requests failing with transient errors", func() {
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "nginx"}}
+		dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme, deployment)
+		failures := 1
+		dynamicClient.PrependReactor("list", "deployments",
+			func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if failures > 0 {
+					failures--
+					return true, nil, apierrors.NewTooManyRequests("throttled", 0)
+				}
+				return false, nil, nil
+			})
+
+		policy := utils.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		collector = newTestCollector(nil, utils.WithClientset(servingClientset()),
+			utils.WithDynamicClient(dynamicClient), utils.WithRetryPolicy(policy))
+
+		config = &utils.Configuration{
+			Resources: []utils.Resource{{Group: "apps", Version: "v1", Kind: "Deployment", Namespace: "web"}},
+		}
+		plan, err := collector.Plan(context.TODO(), config, 0)
+		Expect(err).To(BeNil())
+		Expect(plan.Resources[0].Error).To(BeEmpty())
+		Expect(plan.Resources[0].Objects).To(Equal(1))
+	})
+})
@@ -0,0 +1,173 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	profilesDir = "profiles"
+)
+
+var (
+	//go:embed profiles/*.yaml
+	profilesFS embed.FS
+)
+
+// ProfileNames returns the names of all built-in profiles.
+func ProfileNames() []string {
+	entries, err := profilesFS.ReadDir(profilesDir)
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// GetProfile returns the built-in profile with the given name.
+// Includes in the profile are resolved.
+func GetProfile(name string) (*Configuration, error) {
+	return resolveIncludes(&Configuration{Include: []string{name}}, nil)
+}
+
+// ProfileDescription returns the description, taken from the leading comment,
+// of the built-in profile with the given name.
+func ProfileDescription(name string) string {
+	content, err := profilesFS.ReadFile(path.Join(profilesDir, name+".yaml"))
+	if err != nil {
+		return ""
+	}
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		lines = append(lines, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+	}
+
+	return strings.Join(lines, " ")
+}
+
+func isProfile(name string) bool {
+	for _, profile := range ProfileNames() {
+		if profile == name {
+			return true
+		}
+	}
+	return false
+}
+
+func loadProfile(name string) (*Configuration, error) {
+	content, err := profilesFS.ReadFile(path.Join(profilesDir, name+".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown profile %q (available profiles: %s)", name,
+			strings.Join(ProfileNames(), ", "))
+	}
+
+	return parseConfiguration("profile "+name, string(content))
+}
+
+// resolveIncludes returns a configuration containing all entries of the profiles
+// config includes (recursively) followed by config own entries.
+// visited contains the profiles being resolved and is used to detect cycles.
+func resolveIncludes(config *Configuration, visited []string) (*Configuration, error) {
+	configurations := make([]*Configuration, 0, len(config.Include)+1)
+	for _, name := range config.Include {
+		for i := range visited {
+			if visited[i] == name {
+				return nil, fmt.Errorf("profile %q includes itself: %s", name,
+					strings.Join(append(visited, name), " -> "))
+			}
+		}
+
+		profile, err := loadProfile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		profile, err = resolveIncludes(profile, append(visited, name))
+		if err != nil {
+			return nil, err
+		}
+		configurations = append(configurations, profile)
+	}
+
+	own := *config
+	own.Include = nil
+	configurations = append(configurations, &own)
+
+	return mergeConfigurations(configurations...), nil
+}
+
+// mergeConfigurations returns a configuration containing, in order, all entries
+// of all configurations. Duplicated entries are kept only once.
+func mergeConfigurations(configurations ...*Configuration) *Configuration {
+	result := &Configuration{}
+
+	for _, config := range configurations {
+		for i := range config.Resources {
+			if !containsEntry(result.Resources, &config.Resources[i]) {
+				result.Resources = append(result.Resources, config.Resources[i])
+			}
+		}
+		for i := range config.Logs {
+			if !containsEntry(result.Logs, &config.Logs[i]) {
+				result.Logs = append(result.Logs, config.Logs[i])
+			}
+		}
+		for i := range config.Applications {
+			if !containsEntry(result.Applications, &config.Applications[i]) {
+				result.Applications = append(result.Applications, config.Applications[i])
+			}
+		}
+		for _, name := range config.Include {
+			if !containsEntry(result.Include, &name) {
+				result.Include = append(result.Include, name)
+			}
+		}
+		if config.LogCompression != nil {
+			result.LogCompression = config.LogCompression
+		}
+		if config.Budget != nil {
+			result.Budget = config.Budget
+		}
+	}
+
+	return result
+}
+
+func containsEntry[T any](entries []T, entry *T) bool {
+	for i := range entries {
+		if reflect.DeepEqual(&entries[i], entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package utils_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Profiles", func() {
+	It("all built-in profiles are valid", func() {
+		names := utils.ProfileNames()
+		Expect(names).To(ContainElements("control-plane", "networking", "storage", "sveltos"))
+
+		for _, name := range names {
+			profile, err := utils.GetProfile(name)
+			Expect(err).To(BeNil())
+			Expect(len(profile.Resources) + len(profile.Logs)).ToNot(BeZero())
+		}
+	})
+
+	It("profile source returns a configuration including the profiles", func() {
+		source := utils.NewProfileSource([]string{"networking", "sveltos"})
+		Expect(source.String()).To(Equal("profiles networking,sveltos"))
+
+		content, err := source.Load(context.TODO(), nil)
+		Expect(err).To(BeNil())
+		Expect(content).To(HaveKey("profiles"))
+
+		config, err := utils.ParseConfiguration("profiles", content["profiles"])
+		Expect(err).To(BeNil())
+		Expect(config.Include).To(Equal([]string{"networking", "sveltos"}))
+	})
+
+	It("mergeConfigurations keeps order and removes duplicates", func() {
+		sinceSeconds := int64(600)
+		first := &utils.Configuration{
+			Resources: []utils.Resource{
+				{Group: "", Version: "v1", Kind: "Secret"},
+				{Group: "apps", Version: "v1", Kind: "Deployment"},
+			},
+			Logs: []utils.Log{{Namespace: "kube-system", SinceSeconds: &sinceSeconds}},
+		}
+		second := &utils.Configuration{
+			Resources: []utils.Resource{
+				{Group: "apps", Version: "v1", Kind: "Deployment"},
+				{Group: "", Version: "v1", Kind: "Pod"},
+			},
+			Logs: []utils.Log{{Namespace: "kube-system", SinceSeconds: &sinceSeconds}},
+		}
+
+		merged := utils.MergeConfigurations(first, second)
+		Expect(len(merged.Resources)).To(Equal(3))
+		Expect(merged.Resources[0].Kind).To(Equal("Secret"))
+		Expect(merged.Resources[1].Kind).To(Equal("Deployment"))
+		Expect(merged.Resources[2].Kind).To(Equal("Pod"))
+		Expect(len(merged.Logs)).To(Equal(1))
+	})
+
+	It("resolveIncludes adds profile content before configuration content", func() {
+		config, err := utils.ParseConfiguration("config.yaml", `include:
+- storage
+resources:
+- group: apps
+  version: v1
+  kind: Deployment`)
+		Expect(err).To(BeNil())
+
+		storage, err := utils.GetProfile("storage")
+		Expect(err).To(BeNil())
+
+		resolved, err := utils.ResolveIncludes(config, nil)
+		Expect(err).To(BeNil())
+		Expect(resolved.Include).To(BeEmpty())
+		Expect(len(resolved.Resources)).To(Equal(len(storage.Resources) + 1))
+		Expect(resolved.Resources[len(resolved.Resources)-1].Kind).To(Equal("Deployment"))
+	})
+
+	It("parseConfiguration rejects unknown profiles", func() {
+		_, err := utils.ParseConfiguration("config.yaml", `include:
+- storage
+- foo`)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(`key "config.yaml" line 3: include[1]: Unsupported value: "foo"`))
+	})
+})
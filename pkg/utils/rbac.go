@@ -0,0 +1,534 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	verbGet    = "get"
+	verbList   = "list"
+	verbWatch  = "watch"
+	verbCreate = "create"
+	verbUpdate = "update"
+	verbPatch  = "patch"
+)
+
+// Permission is an access the collector needs.
+type Permission struct {
+	// Namespace the access is needed in. Empty for cluster-wide access.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+	Verb        string `json:"verb" yaml:"verb"`
+	Group       string `json:"group" yaml:"group"`
+	Resource    string `json:"resource" yaml:"resource"`
+	Subresource string `json:"subresource,omitempty" yaml:"subresource,omitempty"`
+
+	// Name restricts access to a single object.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Reason is the configuration entry requiring the access.
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// String describes the permission, e.g. "get pods/log in namespace kube-system".
+func (p *Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource = p.Resource + "." + p.Group
+	}
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.Name != "" {
+		resource += " " + p.Name
+	}
+
+	scope := "cluster-wide"
+	if p.Namespace != "" {
+		scope = "in namespace " + p.Namespace
+	}
+
+	return fmt.Sprintf("%s %s %s", p.Verb, resource, scope)
+}
+
+// RequiredPermissions returns the permissions needed to collect config.
+// mapper maps Kinds to resources. Kinds mapper does not know are not collected, so
+// they require no permission. If mapper is nil, resource names are guessed from
+// Kinds and resources with a namespace are assumed to be namespaced.
+// Objects of a Helm release manifest are read with get; as the manifest is only
+// known reading the release, those permissions are not included (see ManifestPermissions).
+func RequiredPermissions(config *Configuration, mapper apimeta.RESTMapper) ([]Permission, error) {
+	return RequiredNamespacedPermissions(config, mapper, nil)
+}
+
+// RequiredNamespacedPermissions returns the permissions needed to collect config
+// with a collector restricted to namespaces (see WithNamespaces). No cluster-wide
+// permission is returned: cluster-scoped Kinds are skipped and entries for all
+// namespaces need one permission per namespace. If mapper is nil, all Kinds are
+// assumed to be namespaced.
+// If namespaces is empty, it is equivalent to RequiredPermissions.
+func RequiredNamespacedPermissions(config *Configuration, mapper apimeta.RESTMapper, namespaces []string,
+) ([]Permission, error) {
+
+	resolved, err := prepareConfiguration(config)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make([]Permission, 0)
+	add := func(p ...Permission) {
+		p = restrictPermissions(namespaces, p)
+		for i := range p {
+			if !containsPermission(permissions, &p[i]) {
+				permissions = append(permissions, p[i])
+			}
+		}
+	}
+
+	clusterScoped := len(namespaces) == 0
+	for i := range resolved.Resources {
+		p, err := resourcePermission(&resolved.Resources[i], mapper, fmt.Sprintf("resources[%d]", i), clusterScoped)
+		if err != nil {
+			return nil, err
+		}
+		add(p...)
+	}
+
+	for i := range resolved.Logs {
+		add(logPermissions(&resolved.Logs[i], fmt.Sprintf("logs[%d]", i))...)
+		if resolved.Budget != nil {
+			// Pods with Warning events are collected first
+			add(Permission{Namespace: resolved.Logs[i].Namespace, Verb: verbList, Resource: "events",
+				Reason: fmt.Sprintf("logs[%d] budget", i)})
+		}
+	}
+
+	for i := range resolved.Applications {
+		app := &resolved.Applications[i]
+		reason := fmt.Sprintf("applications[%d] %s", i, path.Join(app.Namespace, applicationInstance(app)))
+		if app.HelmRelease != "" {
+			add(Permission{Namespace: app.Namespace, Verb: verbList, Resource: "secrets", Reason: reason})
+		}
+
+		resources, log := applicationEntries(app)
+		for j := range resources {
+			p, err := resourcePermission(&resources[j], mapper, reason, clusterScoped)
+			if err != nil {
+				return nil, err
+			}
+			add(p...)
+		}
+		add(logPermissions(log, reason)...)
+	}
+
+	return permissions, nil
+}
+
+// resourcePermission returns the permission needed to list resource. If clusterScoped
+// is false, cluster-scoped Kinds need no permission as they are not collected.
+func resourcePermission(resource *Resource, mapper apimeta.RESTMapper, reason string, clusterScoped bool,
+) ([]Permission, error) {
+
+	gvk := schema.GroupVersionKind{Group: resource.Group, Version: resource.Version, Kind: resource.Kind}
+	reason = fmt.Sprintf("%s %s", reason, gvk.String())
+
+	if mapper == nil {
+		plural, _ := apimeta.UnsafeGuessKindToResource(gvk)
+		return []Permission{{Namespace: resource.Namespace, Verb: verbList, Group: resource.Group,
+			Resource: plural.Resource, Reason: reason}}, nil
+	}
+
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		if apimeta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	p := Permission{Verb: verbList, Group: resource.Group, Resource: mapping.Resource.Resource, Reason: reason}
+	if mapping.Scope.Name() == apimeta.RESTScopeNameNamespace {
+		p.Namespace = resource.Namespace
+	} else if !clusterScoped {
+		return nil, nil
+	}
+
+	return []Permission{p}, nil
+}
+
+func logPermissions(log *Log, reason string) []Permission {
+	permissions := []Permission{
+		{Namespace: log.Namespace, Verb: verbList, Resource: "pods", Reason: reason},
+		{Namespace: log.Namespace, Verb: verbGet, Resource: "pods", Subresource: "log", Reason: reason},
+	}
+	if log.Follow != nil {
+		// Pods started while following are watched
+		permissions = append(permissions,
+			Permission{Namespace: log.Namespace, Verb: verbWatch, Resource: "pods", Reason: reason})
+	}
+	return permissions
+}
+
+// restrictPermissions returns, for each permission, the permissions in the namespaces
+// it is restricted to: a cluster-wide permission becomes one permission per namespace
+// and permissions in other namespaces are dropped. Permissions are unchanged if
+// namespaces is empty.
+func restrictPermissions(namespaces []string, permissions []Permission) []Permission {
+	if len(namespaces) == 0 {
+		return permissions
+	}
+
+	restricted := make([]Permission, 0, len(permissions))
+	for i := range permissions {
+		selected, _ := restrictNamespace(namespaces, permissions[i].Namespace)
+		for _, namespace := range selected {
+			p := permissions[i]
+			p.Namespace = namespace
+			restricted = append(restricted, p)
+		}
+	}
+
+	return restricted
+}
+
+// SourcePermissions returns the permissions needed to load configuration from source.
+func SourcePermissions(source ConfigurationSource) []Permission {
+	switch s := source.(type) {
+	case *keysSource:
+		return SourcePermissions(s.ConfigurationSource)
+	case *configMapSource:
+		return []Permission{{Namespace: defaultNamespace(s.namespace), Verb: verbGet, Resource: "configmaps",
+			Name: s.name, Reason: s.String()}}
+	case *secretSource:
+		return []Permission{{Namespace: defaultNamespace(s.namespace), Verb: verbGet, Resource: "secrets",
+			Name: s.name, Reason: s.String()}}
+	default:
+		return nil
+	}
+}
+
+// containsPermission returns true if permissions already grants p.
+func containsPermission(permissions []Permission, p *Permission) bool {
+	for i := range permissions {
+		q := &permissions[i]
+		if q.Namespace == p.Namespace && q.Verb == p.Verb && q.Group == p.Group &&
+			q.Resource == p.Resource && q.Subresource == p.Subresource && q.Name == p.Name {
+
+			return true
+		}
+	}
+	return false
+}
+
+// Preflight verifies the collector can collect config (and load its configuration
+// source, if any). It returns the missing permissions.
+func (a *Collector) Preflight(ctx context.Context, config *Configuration) ([]Permission, error) {
+	mapper, err := a.GetRESTMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := RequiredNamespacedPermissions(config, mapper, a.namespaces)
+	if err != nil {
+		return nil, err
+	}
+	manifestPermissions, err := a.ManifestPermissions(ctx, config, mapper)
+	if err != nil {
+		return nil, err
+	}
+	permissions = append(permissions, manifestPermissions...)
+	if a.configSource != nil {
+		permissions = append(SourcePermissions(a.configSource), permissions...)
+	}
+
+	return a.CheckPermissions(ctx, permissions)
+}
+
+// CollectsHelmReleases returns true if config collects Helm releases: getting the objects
+// of their manifests needs permissions RequiredPermissions does not include.
+func CollectsHelmReleases(config *Configuration) bool {
+	resolved, err := prepareConfiguration(config)
+	if err != nil {
+		return false
+	}
+
+	for i := range resolved.Applications {
+		if resolved.Applications[i].HelmRelease != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ManifestPermissions returns the permissions needed to get the objects of the Helm
+// releases config collects. Each release is read from the cluster to find the objects
+// in its manifest. Releases which are not found, or cannot be read because listing
+// Secrets is not permitted, require no permission: the latter is reported by
+// RequiredPermissions.
+func (a *Collector) ManifestPermissions(ctx context.Context, config *Configuration, mapper apimeta.RESTMapper,
+) ([]Permission, error) {
+
+	resolved, err := prepareConfiguration(config)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make([]Permission, 0)
+	for i := range resolved.Applications {
+		app := &resolved.Applications[i]
+		if app.HelmRelease == "" {
+			continue
+		}
+		if _, reason := a.entryNamespaces(app.Namespace); reason != "" {
+			continue
+		}
+
+		release, err := a.getHelmRelease(ctx, app.Namespace, app.HelmRelease)
+		if err != nil {
+			if apierrors.IsForbidden(err) {
+				continue
+			}
+			return nil, err
+		}
+		if release == nil {
+			continue
+		}
+
+		objects, err := parseManifest(release.Manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		reason := fmt.Sprintf("applications[%d] %s manifest", i, path.Join(release.Namespace, release.Name))
+		for j := range objects {
+			p, err := a.manifestPermission(objects[j], release.Namespace, mapper, reason)
+			if err != nil {
+				return nil, err
+			}
+			if p != nil && !containsPermission(permissions, p) {
+				permissions = append(permissions, *p)
+			}
+		}
+	}
+
+	return permissions, nil
+}
+
+// manifestPermission returns the permission needed to get u, an object of a manifest
+// installed in namespace. It returns nil if u is not collected.
+func (a *Collector) manifestPermission(u *unstructured.Unstructured, namespace string, mapper apimeta.RESTMapper,
+	reason string) (*Permission, error) {
+
+	gvk := u.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		if apimeta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	p := &Permission{Verb: verbGet, Group: gvk.Group, Resource: mapping.Resource.Resource, Name: u.GetName(),
+		Reason: fmt.Sprintf("%s %s", reason, gvk.String())}
+	if mapping.Scope.Name() != apimeta.RESTScopeNameNamespace {
+		if a.isNamespaced() {
+			return nil, nil
+		}
+		return p, nil
+	}
+
+	p.Namespace = u.GetNamespace()
+	if p.Namespace == "" {
+		p.Namespace = namespace
+	}
+	if _, reason := a.entryNamespaces(p.Namespace); reason != "" {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// CheckPermissions verifies, using SelfSubjectAccessReviews, the collector has all
+// permissions. It returns the missing ones.
+func (a *Collector) CheckPermissions(ctx context.Context, permissions []Permission) ([]Permission, error) {
+	missing := make([]Permission, 0)
+	for i := range permissions {
+		p := &permissions[i]
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   p.Namespace,
+					Verb:        p.Verb,
+					Group:       p.Group,
+					Resource:    p.Resource,
+					Subresource: p.Subresource,
+					Name:        p.Name,
+				},
+			},
+		}
+
+		result, err := a.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review,
+			metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify %s: %w", p, err)
+		}
+		if !result.Status.Allowed {
+			missing = append(missing, *p)
+		}
+	}
+
+	return missing, nil
+}
+
+// RBACObjects returns the RBAC objects granting permissions to a service account:
+// a ClusterRole and ClusterRoleBinding for cluster-wide permissions and a Role and
+// RoleBinding per namespace. All objects are named name.
+func RBACObjects(permissions []Permission, name, serviceAccountNamespace, serviceAccountName string,
+) []client.Object {
+
+	byNamespace := make(map[string][]Permission)
+	for i := range permissions {
+		p := permissions[i]
+		clusterWide := p
+		clusterWide.Namespace = ""
+		if p.Namespace != "" && containsPermission(permissions, &clusterWide) {
+			// already granted by the ClusterRole
+			continue
+		}
+		byNamespace[p.Namespace] = append(byNamespace[p.Namespace], p)
+	}
+
+	subjects := []rbacv1.Subject{
+		{Kind: rbacv1.ServiceAccountKind, Namespace: serviceAccountNamespace, Name: serviceAccountName},
+	}
+
+	objects := make([]client.Object, 0)
+	if clusterPermissions, ok := byNamespace[""]; ok {
+		objects = append(objects,
+			&rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Rules:      policyRules(clusterPermissions),
+			},
+			&rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: name},
+				Subjects:   subjects,
+			})
+	}
+
+	namespaces := make([]string, 0, len(byNamespace))
+	for namespace := range byNamespace {
+		if namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		objects = append(objects,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+				Rules:      policyRules(byNamespace[namespace]),
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+				Subjects:   subjects,
+			})
+	}
+
+	return objects
+}
+
+// policyRules returns the rules granting permissions. Resources of the same group,
+// needing the same verbs, share a rule.
+func policyRules(permissions []Permission) []rbacv1.PolicyRule {
+	// verbs needed by each group/resource[/subresource]/name
+	type target struct {
+		group, resource, name string
+	}
+	verbs := make(map[target]map[string]bool)
+	for i := range permissions {
+		p := &permissions[i]
+		t := target{group: p.Group, resource: p.Resource, name: p.Name}
+		if p.Subresource != "" {
+			t.resource += "/" + p.Subresource
+		}
+		if verbs[t] == nil {
+			verbs[t] = make(map[string]bool)
+		}
+		verbs[t][p.Verb] = true
+	}
+
+	// resources sharing group, verbs and name
+	type ruleKey struct {
+		group, verbs, name string
+	}
+	resources := make(map[ruleKey][]string)
+	for t := range verbs {
+		k := ruleKey{group: t.group, verbs: strings.Join(sortedKeys(verbs[t]), ","), name: t.name}
+		resources[k] = append(resources[k], t.resource)
+	}
+
+	keys := make([]ruleKey, 0, len(resources))
+	for k := range resources {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].verbs < keys[j].verbs
+	})
+
+	rules := make([]rbacv1.PolicyRule, 0, len(keys))
+	for _, k := range keys {
+		sort.Strings(resources[k])
+		rule := rbacv1.PolicyRule{
+			APIGroups: []string{k.group},
+			Resources: resources[k],
+			Verbs:     strings.Split(k.verbs, ","),
+		}
+		if k.name != "" {
+			rule.ResourceNames = []string{k.name}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("RBAC", func() {
+	var config *utils.Configuration
+	var mapper *apimeta.DefaultRESTMapper
+
+	BeforeEach(func() {
+		config = &utils.Configuration{
+			Resources: []utils.Resource{
+				{Group: "", Version: "v1", Kind: "Pod", Namespace: "default"},
+				{Group: "", Version: "v1", Kind: "Node", Namespace: "default"},
+				{Group: "apps", Version: "v1", Kind: "Deployment"},
+				{Group: "example.com", Version: "v1", Kind: "NotServed"},
+			},
+			Logs: []utils.Log{{Namespace: "kube-system"}},
+		}
+
+		mapper = apimeta.NewDefaultRESTMapper(nil)
+		mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+		mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Node"}, apimeta.RESTScopeRoot)
+		mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			apimeta.RESTScopeNamespace)
+	})
+
+	It("RequiredPermissions uses discovery mappings", func() {
+		permissions, err := utils.RequiredPermissions(config, mapper)
+		Expect(err).To(BeNil())
+
+		descriptions := make([]string, len(permissions))
+		for i := range permissions {
+			descriptions[i] = permissions[i].String()
+		}
+		Expect(descriptions).To(Equal([]string{
+			"list pods in namespace default",
+			"list nodes cluster-wide",
+			"list deployments.apps cluster-wide",
+			"list pods in namespace kube-system",
+			"get pods/log in namespace kube-system",
+		}))
+	})
+
+	It("ManifestPermissions returns access to the objects of Helm release manifests", func() {
+		mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ServiceAccount"}, apimeta.RESTScopeNamespace)
+		config = &utils.Configuration{
+			Applications: []utils.Application{{Namespace: "web", HelmRelease: "nginx"}, {HelmRelease: "missing"}},
+		}
+
+		collector := newTestCollector([]client.Object{helmReleaseSecret("web", "nginx", 1)})
+		permissions, err := collector.ManifestPermissions(context.TODO(), config, mapper)
+		Expect(err).To(BeNil())
+
+		descriptions := make([]string, len(permissions))
+		for i := range permissions {
+			descriptions[i] = permissions[i].String()
+		}
+		Expect(descriptions).To(Equal([]string{
+			"get serviceaccounts nginx in namespace web",
+			"get deployments.apps nginx in namespace web",
+		}))
+		Expect(permissions[0].Reason).To(Equal("applications[0] web/nginx manifest /v1, Kind=ServiceAccount"))
+	})
+
+	It("SourcePermissions returns access to ConfigMap and Secret sources", func() {
+		permissions := utils.SourcePermissions(utils.SelectKeys(utils.NewConfigMapSource("ns/config"), []string{"a"}))
+		Expect(permissions).To(HaveLen(1))
+		Expect(permissions[0].String()).To(Equal("get configmaps config in namespace ns"))
+
+		Expect(utils.SourcePermissions(utils.NewProfileSource([]string{"storage"}))).To(BeEmpty())
+	})
+
+	It("RBACObjects groups permissions in a ClusterRole and one Role per namespace", func() {
+		permissions, err := utils.RequiredPermissions(config, mapper)
+		Expect(err).To(BeNil())
+
+		objects := utils.RBACObjects(permissions, "collector", "monitoring", "collector")
+		Expect(objects).To(HaveLen(6))
+
+		clusterRole, ok := objects[0].(*rbacv1.ClusterRole)
+		Expect(ok).To(BeTrue())
+		Expect(clusterRole.Rules).To(Equal([]rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"list"}},
+			{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"list"}},
+		}))
+
+		binding, ok := objects[1].(*rbacv1.ClusterRoleBinding)
+		Expect(ok).To(BeTrue())
+		Expect(binding.Subjects[0].Namespace).To(Equal("monitoring"))
+
+		role, ok := objects[4].(*rbacv1.Role)
+		Expect(ok).To(BeTrue())
+		Expect(role.Namespace).To(Equal("kube-system"))
+		Expect(role.Rules).To(Equal([]rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"pods/log"}, Verbs: []string{"get"}},
+			{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list"}},
+		}))
+	})
+
+	It("CheckPermissions returns permissions SelfSubjectAccessReviews deny", func() {
+		clientset := k8sfake.NewSimpleClientset()
+		clientset.PrependReactor("create", "selfsubjectaccessreviews",
+			func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				review.Status.Allowed = review.Spec.ResourceAttributes.Subresource != "log"
+				return true, review, nil
+			})
+
+		collector := newTestCollector(nil, utils.WithClientset(clientset))
+
+		permissions, err := utils.RequiredPermissions(config, mapper)
+		Expect(err).To(BeNil())
+
+		missing, err := collector.CheckPermissions(context.TODO(), permissions)
+		Expect(err).To(BeNil())
+		Expect(missing).To(HaveLen(1))
+		Expect(missing[0].String()).To(Equal("get pods/log in namespace kube-system"))
+		Expect(missing[0].Reason).To(Equal("logs[0]"))
+	})
+})
@@ -0,0 +1,232 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// StatusAnnotation is set, on the Job running the collector, to the collection status
+	StatusAnnotation = "k8s-collector.projectsveltos.io/status"
+	// MessageAnnotation is set, on the Job running the collector, to the collection summary message
+	MessageAnnotation = "k8s-collector.projectsveltos.io/message"
+
+	// SummaryKey is the key of the status ConfigMap containing the summary, in YAML format
+	SummaryKey = "summary.yaml"
+
+	// maxMessageLength is the maximum length of the message in the Job annotation and Event
+	maxMessageLength = 1024
+
+	// maxReportedEntries is the maximum number of entries of each list of the summary
+	// reported to the status ConfigMap, as objects are limited to 1 MiB
+	maxReportedEntries = 50
+
+	eventComponent            = "k8s-collector"
+	reasonCollectionSucceeded = "CollectionSucceeded"
+	reasonCollectionFailed    = "CollectionFailed"
+)
+
+// StatusTarget is where the summary of a collection is reported in the cluster.
+// Either reference can be empty.
+type StatusTarget struct {
+	// ConfigMap (<name> or <namespace>/<name>) whose summary.yaml key is set to the summary.
+	// It is created if it does not exist.
+	ConfigMap string
+
+	// Job (<name> or <namespace>/<name>) annotated with the collection status and on
+	// which an Event is emitted. Usually the Job running the collector.
+	Job string
+}
+
+// IsEmpty returns true if the summary is not reported anywhere.
+func (t *StatusTarget) IsEmpty() bool {
+	return t.ConfigMap == "" && t.Job == ""
+}
+
+// Permissions returns the permissions needed to report a summary to t.
+func (t *StatusTarget) Permissions() []Permission {
+	permissions := make([]Permission, 0)
+	if t.ConfigMap != "" {
+		namespace, name := parseReference(t.ConfigMap)
+		namespace = defaultNamespace(namespace)
+		reason := "status ConfigMap " + namespace + "/" + name
+		permissions = append(permissions,
+			Permission{Namespace: namespace, Verb: verbGet, Resource: "configmaps", Name: name, Reason: reason},
+			Permission{Namespace: namespace, Verb: verbUpdate, Resource: "configmaps", Name: name, Reason: reason},
+			Permission{Namespace: namespace, Verb: verbCreate, Resource: "configmaps", Reason: reason})
+	}
+	if t.Job != "" {
+		namespace, name := parseReference(t.Job)
+		namespace = defaultNamespace(namespace)
+		reason := "status Job " + namespace + "/" + name
+		permissions = append(permissions,
+			Permission{Namespace: namespace, Verb: verbGet, Group: batchv1.GroupName, Resource: "jobs", Name: name,
+				Reason: reason},
+			Permission{Namespace: namespace, Verb: verbPatch, Group: batchv1.GroupName, Resource: "jobs", Name: name,
+				Reason: reason},
+			Permission{Namespace: namespace, Verb: verbCreate, Resource: "events", Reason: reason})
+	}
+	return permissions
+}
+
+// ReportSummary stores summary in the ConfigMap of target, annotates the Job of
+// target with the collection status and emits an Event on it. It tries all of
+// them and returns all errors.
+func ReportSummary(ctx context.Context, c client.Client, target *StatusTarget, summary *Summary) error {
+	errs := make([]error, 0)
+
+	if target.ConfigMap != "" {
+		namespace, name := parseReference(target.ConfigMap)
+		if err := reportToConfigMap(ctx, c, defaultNamespace(namespace), name, summary); err != nil {
+			errs = append(errs, fmt.Errorf("failed to report summary to ConfigMap %s: %w", target.ConfigMap, err))
+		}
+	}
+
+	if target.Job != "" {
+		namespace, name := parseReference(target.Job)
+		if err := reportToJob(ctx, c, defaultNamespace(namespace), name, summary); err != nil {
+			errs = append(errs, fmt.Errorf("failed to report summary to Job %s: %w", target.Job, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func reportToConfigMap(ctx context.Context, c client.Client, namespace, name string, summary *Summary) error {
+	data, err := yaml.Marshal(reportedSummary(summary))
+	if err != nil {
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err = c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, configMap)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string]string{SummaryKey: string(data)},
+		}
+		return c.Create(ctx, configMap)
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[SummaryKey] = string(data)
+	return c.Update(ctx, configMap)
+}
+
+// reportedSummary returns a copy of summary whose lists have at most maxReportedEntries
+// entries, and whose errors are truncated to maxMessageLength.
+func reportedSummary(summary *Summary) *Summary {
+	reported := copySummary(summary)
+	limit := func(list string, length int) int {
+		if length <= maxReportedEntries {
+			return length
+		}
+		if reported.Omitted == nil {
+			reported.Omitted = make(map[string]int)
+		}
+		reported.Omitted[list] = length - maxReportedEntries
+		return maxReportedEntries
+	}
+
+	reported.Truncated = reported.Truncated[:limit("truncated", len(reported.Truncated))]
+	reported.Dropped = reported.Dropped[:limit("dropped", len(reported.Dropped))]
+	reported.Errors = reported.Errors[:limit("errors", len(reported.Errors))]
+	reported.TimedOut = reported.TimedOut[:limit("timedOut", len(reported.TimedOut))]
+	reported.Skipped = reported.Skipped[:limit("skipped", len(reported.Skipped))]
+	for i := range reported.Errors {
+		reported.Errors[i] = truncateMessage(reported.Errors[i])
+	}
+	return reported
+}
+
+// truncateMessage truncates message to maxMessageLength bytes, without splitting
+// a multi-byte character.
+func truncateMessage(message string) string {
+	const ellipsis = "..."
+	if len(message) <= maxMessageLength {
+		return message
+	}
+
+	end := maxMessageLength - len(ellipsis)
+	for end > 0 && !utf8.RuneStart(message[end]) {
+		end--
+	}
+	return message[:end] + ellipsis
+}
+
+func reportToJob(ctx context.Context, c client.Client, namespace, name string, summary *Summary) error {
+	job := &batchv1.Job{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, job); err != nil {
+		return err
+	}
+
+	message := truncateMessage(summary.Message())
+
+	patch := client.MergeFrom(job.DeepCopy())
+	annotations := job.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[StatusAnnotation] = summary.Status
+	annotations[MessageAnnotation] = message
+	job.SetAnnotations(annotations)
+	if err := c.Patch(ctx, job, patch); err != nil {
+		return err
+	}
+
+	eventType, reason := corev1.EventTypeNormal, reasonCollectionSucceeded
+	if summary.Status != CollectionSucceeded {
+		eventType, reason = corev1.EventTypeWarning, reasonCollectionFailed
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, GenerateName: name + "-"},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: batchv1.SchemeGroupVersion.String(),
+			Kind:       "Job",
+			Namespace:  namespace,
+			Name:       name,
+			UID:        job.UID,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	return c.Create(ctx, event)
+}
@@ -19,17 +19,16 @@ package utils
 import (
 	"context"
 	"fmt"
-	"os"
 	"path"
-	"path/filepath"
 
 	"github.com/go-logr/logr"
 	"gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/restmapper"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -37,7 +36,11 @@ import (
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 )
 
-func (a *Collector) dumpResources(ctx context.Context, resource *Resource, logger logr.Logger) error {
+// dumpResources collects the resources matching resource, except the ones whose key
+// (see objectKey) is in collected.
+func (a *Collector) dumpResources(ctx context.Context, resource *Resource, collected map[string]bool,
+	logger logr.Logger) error {
+
 	logger = logger.WithValues("gvk", fmt.Sprintf("%s:%s:%s", resource.Group, resource.Version, resource.Kind))
 	logger.Info("collecting resources")
 
@@ -47,16 +50,7 @@ func (a *Collector) dumpResources(ctx context.Context, resource *Resource, logge
 		Kind:    resource.Kind,
 	}
 
-	dc := discovery.NewDiscoveryClientForConfigOrDie(a.restConfig)
-	groupResources, err := restmapper.GetAPIGroupResources(dc)
-	if err != nil {
-		return err
-	}
-	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
-
-	d := dynamic.NewForConfigOrDie(a.restConfig)
-
-	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	dr, mapping, err := a.getDynamicResource(gvk)
 	if err != nil {
 		if apimeta.IsNoMatchError(err) {
 			return nil
@@ -64,52 +58,200 @@ func (a *Collector) dumpResources(ctx context.Context, resource *Resource, logge
 		return err
 	}
 
-	resourceId := schema.GroupVersionResource{
-		Group:    gvk.Group,
-		Version:  gvk.Version,
-		Resource: mapping.Resource.Resource,
+	if a.isNamespaced() && mapping.Scope.Name() != apimeta.RESTScopeNameNamespace {
+		a.skip(SkippedEntry{Kind: gvk.String(), Reason: reasonClusterScoped}, logger)
+		return nil
 	}
 
-	options := metav1.ListOptions{}
+	namespaces, reason := a.entryNamespaces(resource.Namespace)
+	if reason != "" {
+		a.skip(SkippedEntry{Kind: gvk.String(), Namespace: resource.Namespace, Reason: reason}, logger)
+		return nil
+	}
+
+	for _, namespace := range namespaces {
+		namespacedResource := *resource
+		namespacedResource.Namespace = namespace
+
+		ri, options := resourceLister(dr, mapping, &namespacedResource)
+		var list *unstructured.UnstructuredList
+		err := a.doRequest(ctx, fmt.Sprintf("list %s in namespace %q", gvk, namespace),
+			func(ctx context.Context) (err error) {
+				list, err = ri.List(ctx, options)
+				return err
+			})
+		if err != nil {
+			if a.isSkippable(err) {
+				a.skipForbidden(gvk.String(), namespace, "", err, logger)
+				continue
+			}
+			return err
+		}
 
-	if len(resource.LabelFilters) > 0 {
-		labelFilter := ""
-		for i := range resource.LabelFilters {
-			if labelFilter != "" {
-				labelFilter += ","
+		logger.Info(fmt.Sprintf("collected %d resources", len(list.Items)))
+		for i := range list.Items {
+			u := &list.Items[i]
+			if collected[objectKey(gvk.GroupKind(), u.GetNamespace(), u.GetName())] {
+				continue
 			}
-			f := resource.LabelFilters[i]
-			if f.Operation == libsveltosv1alpha1.OperationEqual {
-				labelFilter += fmt.Sprintf("%s=%s", f.Key, f.Value)
-			} else {
-				labelFilter += fmt.Sprintf("%s!=%s", f.Key, f.Value)
+			err = a.dumpObject(u, logger)
+			if err != nil {
+				return err
 			}
 		}
+	}
+
+	return nil
+}
+
+// resourceLister returns the interface and the options to list the resources
+// matching resource namespace and label filters. Namespaced resources are listed
+// in the namespace, so a Role in that namespace is enough to collect them.
+func resourceLister(dr dynamic.NamespaceableResourceInterface, mapping *apimeta.RESTMapping,
+	resource *Resource) (dynamic.ResourceInterface, metav1.ListOptions) {
 
-		options.LabelSelector = labelFilter
+	options := metav1.ListOptions{
+		LabelSelector: labelFiltersSelector(resource.LabelFilters),
 	}
 
-	if resource.Namespace != "" {
-		if options.FieldSelector != "" {
-			options.FieldSelector += ","
+	if resource.Namespace == "" {
+		return dr, options
+	}
+
+	if mapping.Scope.Name() == apimeta.RESTScopeNameNamespace {
+		return dr.Namespace(resource.Namespace), options
+	}
+
+	options.FieldSelector = fmt.Sprintf("metadata.namespace=%s", resource.Namespace)
+	return dr, options
+}
+
+// labelFiltersSelector returns the label selector matching all label filters.
+func labelFiltersSelector(labelFilters []libsveltosv1alpha1.LabelFilter) string {
+	selector := ""
+	for i := range labelFilters {
+		if selector != "" {
+			selector += ","
+		}
+		f := labelFilters[i]
+		if f.Operation == libsveltosv1alpha1.OperationEqual {
+			selector += fmt.Sprintf("%s=%s", f.Key, f.Value)
+		} else {
+			selector += fmt.Sprintf("%s!=%s", f.Key, f.Value)
 		}
-		options.FieldSelector += fmt.Sprintf("metadata.namespace=%s", resource.Namespace)
 	}
+	return selector
+}
+
+// getNamedResource returns a single resource given its GroupVersionKind, namespace and name,
+// nil if it does not exist or is skipped. Namespace is ignored for resources scoped at
+// cluster level (which are skipped in namespaced mode).
+func (a *Collector) getNamedResource(ctx context.Context, mapper apimeta.RESTMapper, gvk schema.GroupVersionKind,
+	namespace, name string, logger logr.Logger) (*unstructured.Unstructured, error) {
 
-	list, err := d.Resource(resourceId).List(ctx, options)
+	dr, mapping, err := a.dynamicResource(mapper, gvk)
 	if err != nil {
-		return err
+		if apimeta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	logger.Info(fmt.Sprintf("collected %d resources", len(list.Items)))
-	for i := range list.Items {
-		err = a.dumpObject(&list.Items[i], logger)
-		if err != nil {
+	var ri dynamic.ResourceInterface = dr
+	if mapping.Scope.Name() == apimeta.RESTScopeNameNamespace {
+		if _, reason := a.entryNamespaces(namespace); reason != "" {
+			a.skip(SkippedEntry{Kind: gvk.String(), Namespace: namespace, Name: name, Reason: reason}, logger)
+			return nil, nil
+		}
+		ri = dr.Namespace(namespace)
+	} else if a.isNamespaced() {
+		a.skip(SkippedEntry{Kind: gvk.String(), Name: name, Reason: reasonClusterScoped}, logger)
+		return nil, nil
+	}
+
+	var u *unstructured.Unstructured
+	err = a.doRequest(ctx, fmt.Sprintf("get %s %s/%s", gvk, namespace, name),
+		func(ctx context.Context) (err error) {
+			u, err = ri.Get(ctx, name, metav1.GetOptions{})
 			return err
+		})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.Info(fmt.Sprintf("resource %s %s/%s not found", gvk.Kind, namespace, name))
+			return nil, nil
 		}
+		if a.isSkippable(err) {
+			a.skipForbidden(gvk.String(), namespace, name, err, logger)
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	return nil
+	return u, nil
+}
+
+// getDynamicResource returns the dynamic client interface and the REST mapping
+// for the given GroupVersionKind.
+func (a *Collector) getDynamicResource(gvk schema.GroupVersionKind,
+) (dynamic.NamespaceableResourceInterface, *apimeta.RESTMapping, error) {
+
+	mapper, err := a.restMapper()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return a.dynamicResource(mapper, gvk)
+}
+
+// restMapper returns the RESTMapper of the running collection or plan. Discovery
+// runs once, when it is first needed, so API resources served later are not seen
+// until the next collection.
+func (a *Collector) restMapper() (apimeta.RESTMapper, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.mapper == nil {
+		mapper, err := a.GetRESTMapper()
+		if err != nil {
+			return nil, err
+		}
+		a.mapper = mapper
+	}
+
+	return a.mapper, nil
+}
+
+// dynamicResource returns the dynamic client interface and the REST mapping,
+// found with mapper, for the given GroupVersionKind.
+func (a *Collector) dynamicResource(mapper apimeta.RESTMapper, gvk schema.GroupVersionKind,
+) (dynamic.NamespaceableResourceInterface, *apimeta.RESTMapping, error) {
+
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if a.dynamic == nil {
+		return nil, nil, fmt.Errorf("cannot list %s: collector has no dynamic client", gvk)
+	}
+
+	resourceId := schema.GroupVersionResource{
+		Group:    gvk.Group,
+		Version:  gvk.Version,
+		Resource: mapping.Resource.Resource,
+	}
+
+	return a.dynamic.Resource(resourceId), mapping, nil
+}
+
+// GetRESTMapper returns a RESTMapper built from the API resources the cluster serves.
+func (a *Collector) GetRESTMapper() (apimeta.RESTMapper, error) {
+	groupResources, err := restmapper.GetAPIGroupResources(a.clientset.Discovery())
+	if err != nil {
+		return nil, err
+	}
+
+	return restmapper.NewDiscoveryRESTMapper(groupResources), nil
 }
 
 // dumpObject is a helper function to generically dump resource definition
@@ -130,6 +272,17 @@ func (a *Collector) dumpObject(resource client.Object, logger logr.Logger) error
 		logger.Info("resource is marked for deletion. Do not collect it.")
 	}
 
+	if a.objectHandler != nil {
+		if err := a.objectHandler(resource); err != nil {
+			return err
+		}
+	}
+
+	if a.sink == nil {
+		a.countObject(resource.GetObjectKind().GroupVersionKind())
+		return nil
+	}
+
 	resourceYAML, err := yaml.Marshal(resource)
 	if err != nil {
 		return err
@@ -144,20 +297,22 @@ func (a *Collector) dumpObject(resource client.Object, logger logr.Logger) error
 	namespace := metaObj.GetNamespace()
 	name := metaObj.GetName()
 
-	resourceFilePath := path.Join(a.directory, "resources", namespace, kind, name+".yaml")
-	err = os.MkdirAll(filepath.Dir(resourceFilePath), permission0755)
+	resourceFilePath := path.Join("resources", namespace, kind, name+".yaml")
+	logger.Info(fmt.Sprintf("storing resource in %s", resourceFilePath))
+	stored, err := a.storeFile(resourceFilePath, resourceYAML)
 	if err != nil {
 		return err
 	}
-
-	f, err := os.OpenFile(resourceFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, permission0644)
-	if err != nil {
-		return err
+	// Objects dropped because of the budget are listed in summary dropped files
+	if !stored {
+		return nil
+	}
+	if err := a.keepForDescription(resource); err != nil {
+		logger.Info(fmt.Sprintf("failed to keep resource for description: %v", err))
 	}
-	defer f.Close()
 
-	logger.Info(fmt.Sprintf("storing resource in %s", resourceFilePath))
-	return os.WriteFile(f.Name(), resourceYAML, permission0600)
+	a.countObject(resource.GetObjectKind().GroupVersionKind())
+	return nil
 }
 
 func (a *Collector) addTypeInformationToObject(obj client.Object) error {
@@ -0,0 +1,97 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+// servingClientset returns a fake clientset containing objects whose discovery
+// serves pods, services and deployments.
+func servingClientset(objects ...client.Object) *k8sfake.Clientset {
+	runtimeObjects := make([]runtime.Object, len(objects))
+	for i := range objects {
+		runtimeObjects[i] = objects[i]
+	}
+
+	clientset := k8sfake.NewSimpleClientset(runtimeObjects...)
+	clientset.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Kind: "Pod", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "services", Kind: "Service", Namespaced: true, Verbs: []string{"get", "list"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: []string{"get", "list"}},
+			},
+		},
+	}
+	return clientset
+}
+
+var _ = Describe("Resources", func() {
+	var pod *corev1.Pod
+	var config *utils.Configuration
+
+	BeforeEach(func() {
+		pod = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"}}
+		config = &utils.Configuration{
+			Resources: []utils.Resource{{Group: "", Version: "v1", Kind: "Pod", Namespace: "kube-system"}},
+		}
+	})
+
+	It("Collect lists resources with the dynamic client", func() {
+		results := utils.NewMemoryResults()
+		options := append(results.Options(), utils.WithClientset(servingClientset(pod)))
+		collector := newTestCollector([]client.Object{pod}, options...)
+
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+		Expect(results.Objects()).To(HaveLen(1))
+		Expect(results.Objects()[0].GetName()).To(Equal("coredns"))
+	})
+
+	It("Collect reports an error when the collector has no dynamic client", func() {
+		collector, err := utils.NewCollector(scheme, nil,
+			utils.WithClient(fake.NewClientBuilder().WithScheme(scheme).Build()),
+			utils.WithClientset(servingClientset(pod)))
+		Expect(err).To(BeNil())
+
+		err = collector.Collect(context.TODO(), config)
+		Expect(err).To(MatchError(ContainSubstring("collector has no dynamic client")))
+	})
+
+	It("NewCollector requires a rest config unless client and clientset are set", func() {
+		_, err := utils.NewCollector(scheme, nil, utils.WithClientset(k8sfake.NewSimpleClientset()))
+		Expect(err).ToNot(BeNil())
+	})
+})
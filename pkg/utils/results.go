@@ -0,0 +1,194 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LogReference identifies the logs of a container.
+type LogReference struct {
+	// Namespace of the pod.
+	Namespace string `json:"namespace" yaml:"namespace"`
+
+	// Pod is the name of the pod.
+	Pod string `json:"pod" yaml:"pod"`
+
+	// Container is the name of the container.
+	Container string `json:"container" yaml:"container"`
+
+	// Previous is true for the logs of the previous run of a restarted container.
+	Previous bool `json:"previous,omitempty" yaml:"previous,omitempty"`
+}
+
+// String returns <namespace>/<pod>/<container>, followed by (previous) for the
+// logs of the previous run.
+func (r *LogReference) String() string {
+	s := path.Join(r.Namespace, r.Pod, r.Container)
+	if r.Previous {
+		s += " (previous)"
+	}
+	return s
+}
+
+// ObjectHandler is called for every collected resource. Resource version is
+// cleared and type information is set. Returning an error stops the collection
+// of the current configuration entry.
+type ObjectHandler func(obj client.Object) error
+
+// LogHandler is called for every collected container log stream. stream is only
+// valid until the handler returns. Returning an error stops the collection of
+// the current configuration entry.
+type LogHandler func(ref LogReference, stream io.Reader) error
+
+// WithObjectHandler sets a handler called for every collected resource.
+// When collecting from multiple clusters, handler is called concurrently.
+func WithObjectHandler(handler ObjectHandler) Option {
+	return func(a *Collector) {
+		a.objectHandler = handler
+	}
+}
+
+// WithLogHandler sets a handler called for every collected log stream.
+// When collecting from multiple clusters, handler is called concurrently.
+func WithLogHandler(handler LogHandler) Option {
+	return func(a *Collector) {
+		a.logHandler = handler
+	}
+}
+
+// Collect collects resources and logs config lists. Built-in profiles config
+// includes are resolved. Collected data is passed to the object and log handlers,
+// if any, and stored in the sink, if any.
+func (a *Collector) Collect(ctx context.Context, config *Configuration) error {
+	resolved, err := prepareConfiguration(config)
+	if err != nil {
+		return err
+	}
+
+	return a.collectData(ctx, resolved, a.logger)
+}
+
+// prepareConfiguration validates a configuration built in code and resolves
+// the built-in profiles it includes.
+func prepareConfiguration(config *Configuration) (*Configuration, error) {
+	if config == nil {
+		return nil, fmt.Errorf("no configuration")
+	}
+
+	if allErrs := validateConfiguration(config); len(allErrs) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %w", allErrs.ToAggregate())
+	}
+
+	return resolveIncludes(config, nil)
+}
+
+// GetPodLogs returns the logs of a container. If tailLines is greater than 0,
+// only the last tailLines lines are returned.
+// Logs are neither passed to the log handler nor stored in the sink.
+// Like in a collection, the stream is bounded by the log stream timeout and
+// transient errors are retried.
+func (a *Collector) GetPodLogs(ctx context.Context, ref LogReference, tailLines int64) ([]byte, error) {
+	log := &Log{}
+	if tailLines > 0 {
+		log.TailLines = &tailLines
+	}
+
+	streamCtx, cancel := a.streamContext(ctx)
+	defer cancel()
+
+	podLogs, err := a.openLogStream(streamCtx, ref, podLogOptions(log, &ref))
+	if err != nil {
+		return nil, err
+	}
+	defer podLogs.Close()
+
+	return io.ReadAll(podLogs)
+}
+
+// MemoryResults keeps collected resources and logs in memory.
+// It is safe for concurrent use.
+type MemoryResults struct {
+	mu      sync.Mutex
+	objects []client.Object
+	logs    map[LogReference][]byte
+}
+
+// NewMemoryResults returns an empty MemoryResults.
+func NewMemoryResults() *MemoryResults {
+	return &MemoryResults{logs: make(map[LogReference][]byte)}
+}
+
+// Options returns the options making a Collector store results in r.
+func (r *MemoryResults) Options() []Option {
+	return []Option{WithObjectHandler(r.addObject), WithLogHandler(r.addLog)}
+}
+
+// Objects returns all collected resources, in collection order.
+func (r *MemoryResults) Objects() []client.Object {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	objects := make([]client.Object, len(r.objects))
+	copy(objects, r.objects)
+	return objects
+}
+
+// Logs returns all collected logs.
+func (r *MemoryResults) Logs() map[LogReference][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	logs := make(map[LogReference][]byte, len(r.logs))
+	for k := range r.logs {
+		logs[k] = r.logs[k]
+	}
+	return logs
+}
+
+func (r *MemoryResults) addObject(obj client.Object) error {
+	copied, ok := obj.DeepCopyObject().(client.Object)
+	if !ok {
+		return fmt.Errorf("unexpected object type %T", obj)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.objects = append(r.objects, copied)
+	return nil
+}
+
+func (r *MemoryResults) addLog(ref LogReference, stream io.Reader) error {
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Followed containers restarting have multiple streams
+	r.logs[ref] = append(r.logs[ref], data...)
+	return nil
+}
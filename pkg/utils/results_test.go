@@ -0,0 +1,85 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Results", func() {
+	var pod *corev1.Pod
+	var collector *utils.Collector
+	var results *utils.MemoryResults
+
+	BeforeEach(func() {
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "coredns", Image: "coredns"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "coredns", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				},
+			},
+		}
+
+		results = utils.NewMemoryResults()
+		collector = newTestCollector([]client.Object{pod}, results.Options()...)
+	})
+
+	It("Collect passes logs to the log handler without a sink", func() {
+		tailLines := int64(200)
+		config := &utils.Configuration{
+			Logs: []utils.Log{{Namespace: "kube-system", TailLines: &tailLines}},
+		}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		ref := utils.LogReference{Namespace: "kube-system", Pod: "coredns", Container: "coredns"}
+		logs := results.Logs()
+		Expect(logs).To(HaveLen(1))
+		Expect(logs).To(HaveKey(ref))
+		Expect(string(logs[ref])).To(Equal("fake logs"))
+		Expect(results.Objects()).To(BeEmpty())
+	})
+
+	It("Collect rejects an invalid configuration", func() {
+		tailLines := int64(0)
+		config := &utils.Configuration{
+			Logs: []utils.Log{{Namespace: "kube-system", TailLines: &tailLines}},
+		}
+		err := collector.Collect(context.TODO(), config)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("logs[0].tailLines"))
+	})
+
+	It("GetPodLogs returns container logs", func() {
+		ref := utils.LogReference{Namespace: "kube-system", Pod: "coredns", Container: "coredns"}
+		logs, err := collector.GetPodLogs(context.TODO(), ref, 200)
+		Expect(err).To(BeNil())
+		Expect(string(logs)).To(Equal("fake logs"))
+	})
+})
@@ -0,0 +1,164 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 500 * time.Millisecond
+	defaultRetryMaxBackoff = 30 * time.Second
+	retryBackoffFactor     = 2
+	retryBackoffJitter     = 0.2
+)
+
+// RetryPolicy defines how list requests and log streams failing with transient
+// errors (429, 5xx, connection reset, ...) are retried. Retries wait with an
+// exponential backoff, with jitter.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	// 1 or less disables retries.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry. It doubles at every retry.
+	Backoff time.Duration
+
+	// MaxBackoff caps the wait between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy returns the policy collectors use by default: 3 attempts,
+// waiting 500ms then 1s (up to 30s).
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: defaultRetryAttempts,
+		Backoff:     defaultRetryBackoff,
+		MaxBackoff:  defaultRetryMaxBackoff,
+	}
+}
+
+// WithRetryPolicy sets how transient errors are retried. Default is DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(a *Collector) {
+		a.retryPolicy = policy
+	}
+}
+
+func (p *RetryPolicy) backoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: p.Backoff,
+		Factor:   retryBackoffFactor,
+		Jitter:   retryBackoffJitter,
+		Steps:    p.MaxAttempts,
+		Cap:      p.MaxBackoff,
+	}
+}
+
+// isRetryable returns true for errors which are likely transient: throttling,
+// server errors and broken connections. Context errors are never retried.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsUnexpectedServerError(err) {
+
+		return true
+	}
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		code := int(status.Status().Code)
+		return code == http.StatusBadGateway || code == http.StatusServiceUnavailable ||
+			code == http.StatusGatewayTimeout
+	}
+
+	return utilnet.IsConnectionReset(err) || utilnet.IsConnectionRefused(err) || utilnet.IsProbableEOF(err) ||
+		utilnet.IsHTTP2ConnectionLost(err) || utilnet.IsTimeout(err)
+}
+
+// retryDelay returns how long to wait before retrying after err: the next backoff
+// step or, if longer, the delay the server suggested.
+func retryDelay(backoff *wait.Backoff, err error) time.Duration {
+	delay := backoff.Step()
+	if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+		if suggested := time.Duration(seconds) * time.Second; suggested > delay {
+			delay = suggested
+		}
+	}
+	return delay
+}
+
+// sleep waits for delay. It returns early, with false, if ctx is done.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retry calls fn until it succeeds, fails with an error that is not retryable or
+// the retry policy is exhausted. It returns the last error.
+func (a *Collector) retry(ctx context.Context, what string, fn func() error) error {
+	attempts := 0
+	backoff := a.retryPolicy.backoff()
+	return a.retryAttempt(ctx, &attempts, &backoff, what, fn)
+}
+
+// retryAttempt is retry for operations spanning multiple calls, like log streams
+// resuming after an error: attempts and backoff are shared by all calls.
+func (a *Collector) retryAttempt(ctx context.Context, attempts *int, backoff *wait.Backoff, what string,
+	fn func() error) error {
+
+	for {
+		*attempts++
+		err := fn()
+		if err == nil || !a.waitRetry(ctx, *attempts, backoff, what, err) {
+			return err
+		}
+	}
+}
+
+// waitRetry returns false if err, returned by the attempt-th attempt, must not be
+// retried. Otherwise it waits before the next attempt and returns true.
+func (a *Collector) waitRetry(ctx context.Context, attempt int, backoff *wait.Backoff, what string, err error) bool {
+	if !isRetryable(err) || attempt >= a.retryPolicy.MaxAttempts {
+		return false
+	}
+
+	delay := retryDelay(backoff, err)
+	a.logger.Info(fmt.Sprintf("%s failed (attempt %d of %d), retrying in %s: %v",
+		what, attempt, a.retryPolicy.MaxAttempts, delay, err))
+	a.metrics.observeRetry()
+	return sleep(ctx, delay)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+// brokenStream returns content, then fails with err
+type brokenStream struct {
+	io.Reader
+	err error
+}
+
+func (s *brokenStream) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if err == io.EOF {
+		return n, s.err
+	}
+	return n, err
+}
+
+func (s *brokenStream) Close() error {
+	return nil
+}
+
+// retries returns the value of the retries metric
+func retries(registry *prometheus.Registry) float64 {
+	families, err := registry.Gather()
+	Expect(err).To(BeNil())
+	for i := range families {
+		if families[i].GetName() == "k8s_collector_retries_total" {
+			return families[i].GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Retry", func() {
+	var pod *corev1.Pod
+	var registry *prometheus.Registry
+	var metrics *utils.Metrics
+	var policy utils.RetryPolicy
+
+	BeforeEach(func() {
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "coredns", Image: "coredns"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "coredns", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				},
+			},
+		}
+
+		registry = prometheus.NewRegistry()
+		var err error
+		metrics, err = utils.NewMetrics(registry)
+		Expect(err).To(BeNil())
+
+		policy = utils.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	})
+
+	It("Collect retries list requests failing with transient errors", func() {
+		failures := []error{
+			apierrors.NewTooManyRequests("throttled", 0),
+			apierrors.NewInternalError(errors.New("etcd unavailable")),
+		}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).WithInterceptorFuncs(
+			interceptor.Funcs{
+				List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+					if len(failures) > 0 {
+						err := failures[0]
+						failures = failures[1:]
+						return err
+					}
+					return c.List(ctx, list, opts...)
+				},
+			}).Build()
+
+		results := utils.NewMemoryResults()
+		options := append(results.Options(), utils.WithClient(c), utils.WithMetrics(metrics), utils.WithRetryPolicy(policy))
+		collector := newTestCollector([]client.Object{pod}, options...)
+
+		config := &utils.Configuration{Logs: []utils.Log{{Namespace: "kube-system"}}}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+		Expect(results.Logs()).To(HaveLen(1))
+		Expect(retries(registry)).To(Equal(float64(2)))
+	})
+
+	It("Collect does not retry errors which are not transient", func() {
+		calls := 0
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).WithInterceptorFuncs(
+			interceptor.Funcs{
+				List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+					calls++
+					return apierrors.NewBadRequest("invalid selector")
+				},
+			}).Build()
+
+		collector := newTestCollector([]client.Object{pod}, utils.WithClient(c), utils.WithMetrics(metrics),
+			utils.WithRetryPolicy(policy))
+
+		config := &utils.Configuration{Logs: []utils.Log{{Namespace: "kube-system"}}}
+		Expect(collector.Collect(context.TODO(), config)).ToNot(Succeed())
+		Expect(calls).To(Equal(1))
+		Expect(retries(registry)).To(BeZero())
+	})
+
+	It("Log streams resume from the last received line", func() {
+		collector := newTestCollector(nil, utils.WithMetrics(metrics), utils.WithRetryPolicy(policy))
+
+		var requested []*corev1.PodLogOptions
+		request := func(ctx context.Context, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
+			requested = append(requested, opts)
+			if len(requested) == 1 {
+				return &brokenStream{
+					Reader: strings.NewReader("2024-05-01T10:00:00.100000000Z first\n" +
+						"2024-05-01T10:00:00.200000000Z second\n" +
+						"2024-05-01T10:00:00.300000000Z thi"),
+					err: syscall.ECONNRESET,
+				}, nil
+			}
+			// Logs are sent again since the second of the last received line
+			return io.NopCloser(strings.NewReader("2024-05-01T10:00:00.100000000Z first\n" +
+				"2024-05-01T10:00:00.200000000Z second\n" +
+				"2024-05-01T10:00:00.300000000Z third\n" +
+				"2024-05-01T10:00:01.000000000Z fourth")), nil
+		}
+
+		tailLines := int64(100)
+		ref := utils.LogReference{Namespace: "kube-system", Pod: "coredns", Container: "coredns"}
+		stream, err := utils.NewLogStream(collector, context.TODO(), ref,
+			&corev1.PodLogOptions{Container: "coredns", TailLines: &tailLines}, request)
+		Expect(err).To(BeNil())
+
+		content, err := io.ReadAll(stream)
+		Expect(err).To(BeNil())
+		Expect(string(content)).To(Equal("first\nsecond\nthird\nfourth"))
+
+		Expect(requested).To(HaveLen(2))
+		Expect(requested[0].Timestamps).To(BeTrue())
+		Expect(*requested[0].TailLines).To(Equal(tailLines))
+		Expect(requested[1].TailLines).To(BeNil())
+		Expect(requested[1].SinceTime.Time).To(Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)))
+		Expect(retries(registry)).To(Equal(float64(1)))
+	})
+
+	It("Log streams resume after the received lines sharing the last timestamp", func() {
+		collector := newTestCollector(nil, utils.WithMetrics(metrics), utils.WithRetryPolicy(policy))
+
+		requests := 0
+		request := func(ctx context.Context, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
+			requests++
+			if requests == 1 {
+				return &brokenStream{
+					Reader: strings.NewReader("2024-05-01T10:00:00Z first\n" +
+						"2024-05-01T10:00:01Z second\n" +
+						"2024-05-01T10:00:01Z third\n"),
+					err: syscall.ECONNRESET,
+				}, nil
+			}
+			// Lines written in the same second were not received before the stream broke
+			return io.NopCloser(strings.NewReader("2024-05-01T10:00:01Z second\n" +
+				"2024-05-01T10:00:01Z third\n" +
+				"2024-05-01T10:00:01Z fourth\n" +
+				"2024-05-01T10:00:01Z fifth\n")), nil
+		}
+
+		ref := utils.LogReference{Namespace: "kube-system", Pod: "coredns", Container: "coredns"}
+		stream, err := utils.NewLogStream(collector, context.TODO(), ref, &corev1.PodLogOptions{Container: "coredns"},
+			request)
+		Expect(err).To(BeNil())
+
+		content, err := io.ReadAll(stream)
+		Expect(err).To(BeNil())
+		Expect(string(content)).To(Equal("first\nsecond\nthird\nfourth\nfifth\n"))
+	})
+})
@@ -0,0 +1,131 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Sink stores the files produced by a collection.
+type Sink interface {
+	// Create creates, or truncates, the file at relPath. relPath is slash
+	// separated and relative to the root of the collection.
+	// Caller must close the returned writer.
+	Create(relPath string) (io.WriteCloser, error)
+}
+
+// NewDirectorySink returns a Sink storing files in directory.
+func NewDirectorySink(directory string) Sink {
+	return &directorySink{directory: directory}
+}
+
+type directorySink struct {
+	directory string
+}
+
+func (s *directorySink) String() string {
+	return s.directory
+}
+
+func (s *directorySink) Create(relPath string) (io.WriteCloser, error) {
+	filename := filepath.Join(s.directory, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(filename), permission0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, permission0644)
+}
+
+// newPrefixSink returns a Sink storing files in the prefix directory of sink.
+func newPrefixSink(sink Sink, prefix string) Sink {
+	return &prefixSink{sink: sink, prefix: prefix}
+}
+
+type prefixSink struct {
+	sink   Sink
+	prefix string
+}
+
+func (s *prefixSink) Create(relPath string) (io.WriteCloser, error) {
+	return s.sink.Create(path.Join(s.prefix, relPath))
+}
+
+func (s *prefixSink) String() string {
+	return path.Join(sinkLocation(s.sink), s.prefix)
+}
+
+// sinkLocation describes where sink stores files. Empty if it is unknown.
+func sinkLocation(sink Sink) string {
+	if s, ok := sink.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return ""
+}
+
+// writeFile stores data in the file at relPath.
+// Without a sink, data is not stored.
+func (a *Collector) writeFile(relPath string, data []byte) error {
+	_, err := a.storeFile(relPath, data)
+	return err
+}
+
+// storeFile stores data in the file at relPath, like writeFile. It returns false
+// if data was not stored: without a sink, or when the budget is exhausted.
+func (a *Collector) storeFile(relPath string, data []byte) (stored bool, err error) {
+	if a.sink == nil {
+		return false, nil
+	}
+	if category := a.budget.reserve(relPath, int64(len(data))); category != "" {
+		a.recordDropped(relPath, category)
+		return false, nil
+	}
+
+	var w io.WriteCloser
+	w, err = a.sink.Create(relPath)
+	if err != nil {
+		return false, err
+	}
+	// close w on exit and check for its returned error
+	defer func() {
+		if cerr := w.Close(); cerr != nil {
+			if err == nil {
+				err = cerr
+			}
+		}
+	}()
+
+	var n int
+	n, err = w.Write(data)
+	a.metrics.observeBytesWritten(relPath, int64(n))
+	return err == nil, err
+}
+
+// writeYAML stores content, in YAML format, in the file at relPath.
+func (a *Collector) writeYAML(relPath string, content interface{}) error {
+	data, err := yaml.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	return a.writeFile(relPath, data)
+}
@@ -0,0 +1,51 @@
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Sink", func() {
+	It("directory sink creates files and parent directories", func() {
+		dir, err := os.MkdirTemp("", "sink")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		sink := utils.NewDirectorySink(dir)
+		w, err := sink.Create("logs/kube-system/coredns-coredns")
+		Expect(err).To(BeNil())
+		_, err = w.Write([]byte("foo"))
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		// Creating the same file again truncates it
+		w, err = sink.Create("logs/kube-system/coredns-coredns")
+		Expect(err).To(BeNil())
+		_, err = w.Write([]byte("bar"))
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		content, err := os.ReadFile(filepath.Join(dir, "logs", "kube-system", "coredns-coredns"))
+		Expect(err).To(BeNil())
+		Expect(string(content)).To(Equal("bar"))
+	})
+
+	It("prefix sink stores files in a sub directory", func() {
+		dir, err := os.MkdirTemp("", "sink")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		sink := utils.NewPrefixSink(utils.NewDirectorySink(dir), "clusters/production")
+		w, err := sink.Create("status.yaml")
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(Succeed())
+
+		_, err = os.Stat(filepath.Join(dir, "clusters", "production", "status.yaml"))
+		Expect(err).To(BeNil())
+	})
+})
@@ -0,0 +1,261 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Stdin is the file name used to read the configuration from standard input
+	Stdin = "-"
+)
+
+// ConfigurationSource is where collector configuration is loaded from.
+type ConfigurationSource interface {
+	// Load returns the content of the source, one entry per key.
+	// Client is used by sources stored in the cluster.
+	Load(ctx context.Context, c client.Client) (map[string]string, error)
+
+	// String describes the source in logs and errors.
+	String() string
+}
+
+// NewConfigMapSource returns a source reading configuration from a ConfigMap.
+// ref is either <name> or <namespace>/<name>. When namespace is not specified, the
+// value of COLLECTOR_NAMESPACE environment variable is used.
+func NewConfigMapSource(ref string) ConfigurationSource {
+	namespace, name := parseReference(ref)
+	return &configMapSource{namespace: namespace, name: name}
+}
+
+// NewSecretSource returns a source reading configuration from a Secret.
+// ref is either <name> or <namespace>/<name>. When namespace is not specified, the
+// value of COLLECTOR_NAMESPACE environment variable is used.
+func NewSecretSource(ref string) ConfigurationSource {
+	namespace, name := parseReference(ref)
+	return &secretSource{namespace: namespace, name: name}
+}
+
+// NewFileSource returns a source reading configuration from a file.
+// If filename is a directory (for instance a mounted ConfigMap), each regular file
+// in it is a key. If filename is Stdin, configuration is read from standard input.
+func NewFileSource(filename string) ConfigurationSource {
+	if filename == Stdin {
+		return &readerSource{name: "stdin", reader: os.Stdin}
+	}
+	return &fileSource{filename: filename}
+}
+
+// NewReaderSource returns a source reading configuration from reader.
+func NewReaderSource(name string, reader io.Reader) ConfigurationSource {
+	return &readerSource{name: name, reader: reader}
+}
+
+// NewProfileSource returns a source whose configuration is the content of the
+// given built-in profiles.
+func NewProfileSource(profiles []string) ConfigurationSource {
+	return &profileSource{profiles: profiles}
+}
+
+// SelectKeys returns a source returning only the given keys of source.
+// Configurations in those keys are merged in the given order.
+func SelectKeys(source ConfigurationSource, keys []string) ConfigurationSource {
+	return &keysSource{ConfigurationSource: source, keys: keys}
+}
+
+type keysSource struct {
+	ConfigurationSource
+	keys []string
+}
+
+func (s *keysSource) Load(ctx context.Context, c client.Client) (map[string]string, error) {
+	content, err := s.ConfigurationSource.Load(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(s.keys))
+	for _, k := range s.keys {
+		v, ok := content[k]
+		if !ok {
+			return nil, fmt.Errorf("%s does not contain key %q", s.ConfigurationSource, k)
+		}
+		data[k] = v
+	}
+
+	return data, nil
+}
+
+// Keys returns the keys in the order configurations must be merged.
+func (s *keysSource) Keys() []string {
+	return s.keys
+}
+
+func parseReference(ref string) (namespace, name string) {
+	if idx := strings.Index(ref, "/"); idx >= 0 {
+		return ref[:idx], ref[idx+1:]
+	}
+	return "", ref
+}
+
+func defaultNamespace(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	return os.Getenv("COLLECTOR_NAMESPACE")
+}
+
+type configMapSource struct {
+	namespace string
+	name      string
+}
+
+func (s *configMapSource) Load(ctx context.Context, c client.Client) (map[string]string, error) {
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: defaultNamespace(s.namespace), Name: s.name}, configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return configMap.Data, nil
+}
+
+func (s *configMapSource) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s", defaultNamespace(s.namespace), s.name)
+}
+
+type secretSource struct {
+	namespace string
+	name      string
+}
+
+func (s *secretSource) Load(ctx context.Context, c client.Client) (map[string]string, error) {
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: defaultNamespace(s.namespace), Name: s.name}, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(secret.Data))
+	for k := range secret.Data {
+		data[k] = string(secret.Data[k])
+	}
+
+	return data, nil
+}
+
+func (s *secretSource) String() string {
+	return fmt.Sprintf("Secret %s/%s", defaultNamespace(s.namespace), s.name)
+}
+
+type fileSource struct {
+	filename string
+}
+
+func (s *fileSource) Load(_ context.Context, _ client.Client) (map[string]string, error) {
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		content, err := os.ReadFile(s.filename)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{filepath.Base(s.filename): string(content)}, nil
+	}
+
+	entries, err := os.ReadDir(s.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string)
+	for _, entry := range entries {
+		// Skip hidden files (a mounted ConfigMap contains ..data and ..<timestamp> entries)
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// Follow symlinks, as used for keys of a mounted ConfigMap
+		filename := filepath.Join(s.filename, entry.Name())
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		data[entry.Name()] = string(content)
+	}
+
+	return data, nil
+}
+
+func (s *fileSource) String() string {
+	return fmt.Sprintf("file %s", s.filename)
+}
+
+type readerSource struct {
+	name   string
+	reader io.Reader
+}
+
+func (s *readerSource) Load(_ context.Context, _ client.Client) (map[string]string, error) {
+	content, err := io.ReadAll(s.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{s.name: string(content)}, nil
+}
+
+func (s *readerSource) String() string {
+	return s.name
+}
+
+type profileSource struct {
+	profiles []string
+}
+
+func (s *profileSource) Load(_ context.Context, _ client.Client) (map[string]string, error) {
+	content, err := yaml.Marshal(&Configuration{Include: s.profiles})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"profiles": string(content)}, nil
+}
+
+func (s *profileSource) String() string {
+	return fmt.Sprintf("profiles %s", strings.Join(s.profiles, ","))
+}
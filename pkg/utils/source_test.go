@@ -0,0 +1,59 @@
+package utils_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Source", func() {
+	It("file source reads a single file", func() {
+		dir, err := os.MkdirTemp("", "source")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		filename := filepath.Join(dir, "config.yaml")
+		Expect(os.WriteFile(filename, []byte(data), 0600)).To(Succeed())
+
+		content, err := utils.NewFileSource(filename).Load(context.TODO(), nil)
+		Expect(err).To(BeNil())
+		Expect(content).To(HaveKeyWithValue("config.yaml", data))
+	})
+
+	It("file source reads a directory skipping hidden files", func() {
+		dir, err := os.MkdirTemp("", "source")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		Expect(os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(data), 0600)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(dir, "..data"), 0700)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, ".hidden"), []byte("foo"), 0600)).To(Succeed())
+
+		content, err := utils.NewFileSource(dir).Load(context.TODO(), nil)
+		Expect(err).To(BeNil())
+		Expect(len(content)).To(Equal(1))
+		Expect(content).To(HaveKey("config.yaml"))
+	})
+
+	It("reader source reads configuration", func() {
+		source := utils.NewReaderSource("stdin", strings.NewReader(data))
+		Expect(source.String()).To(Equal("stdin"))
+
+		content, err := source.Load(context.TODO(), nil)
+		Expect(err).To(BeNil())
+		Expect(content).To(HaveKeyWithValue("stdin", data))
+	})
+
+	It("ConfigMap and Secret sources accept namespace qualified names", func() {
+		Expect(utils.NewConfigMapSource("projectsveltos/collector").String()).To(
+			Equal("ConfigMap projectsveltos/collector"))
+		Expect(utils.NewSecretSource("projectsveltos/collector").String()).To(
+			Equal("Secret projectsveltos/collector"))
+	})
+})
@@ -0,0 +1,304 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	summaryFile = "summary.yaml"
+
+	// CollectionSucceeded indicates a collection completed without errors
+	CollectionSucceeded = "Succeeded"
+	// CollectionFailed indicates collecting any configuration entry failed
+	CollectionFailed = "Failed"
+)
+
+// Summary is the outcome of a collection.
+type Summary struct {
+	// Status is either Succeeded or Failed.
+	Status string `json:"status" yaml:"status"`
+
+	// StartTime is when collection started (RFC3339).
+	StartTime string `json:"startTime" yaml:"startTime"`
+
+	// Duration of the collection.
+	Duration string `json:"duration" yaml:"duration"`
+
+	// Output is where collected data was stored, if anywhere.
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+
+	// Resources is the number of collected objects per GroupVersionKind (<group>/<version>/<kind>).
+	Resources map[string]int `json:"resources,omitempty" yaml:"resources,omitempty"`
+
+	// Objects is the total number of collected objects.
+	Objects int `json:"objects" yaml:"objects"`
+
+	// Pods is the number of pods logs were collected from.
+	Pods int `json:"pods" yaml:"pods"`
+
+	// Containers is the number of collected container logs.
+	Containers int `json:"containers" yaml:"containers"`
+
+	// Captured is the number of pods, captured when they terminated, included from
+	// the capture buffer.
+	Captured int `json:"captured,omitempty" yaml:"captured,omitempty"`
+
+	// Truncated lists the log files truncated because a size budget was exhausted.
+	Truncated []string `json:"truncated,omitempty" yaml:"truncated,omitempty"`
+
+	// Dropped lists the files (logs, resources, events) not stored because a size
+	// budget was exhausted.
+	Dropped []string `json:"dropped,omitempty" yaml:"dropped,omitempty"`
+
+	// Errors contains the errors of the configuration entries that failed.
+	Errors []string `json:"errors,omitempty" yaml:"errors,omitempty"`
+
+	// TimedOut lists the requests and container logs that exceeded their deadline.
+	// Logs received before the deadline are kept.
+	TimedOut []string `json:"timedOut,omitempty" yaml:"timedOut,omitempty"`
+
+	// Interrupted reports why the collection stopped before completing (for
+	// instance timeout or termination signal). Entries not collected yet were skipped.
+	Interrupted string `json:"interrupted,omitempty" yaml:"interrupted,omitempty"`
+
+	// Skipped lists what was not collected in namespaced mode, and containers
+	// whose logs were not collected because they never started.
+	Skipped []SkippedEntry `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+
+	// Clusters contains the status of each cluster, when collecting from multiple clusters.
+	Clusters []ClusterStatus `json:"clusters,omitempty" yaml:"clusters,omitempty"`
+
+	// Omitted is, in the summary reported to the status ConfigMap, the number of entries
+	// left out of each list (e.g. dropped). summary.yaml in collected data has all of them.
+	Omitted map[string]int `json:"omitted,omitempty" yaml:"omitted,omitempty"`
+}
+
+// Message describes the summary in a sentence.
+func (s *Summary) Message() string {
+	message := fmt.Sprintf("collected %d objects and %d container logs from %d pods in %s",
+		s.Objects, s.Containers, s.Pods, s.Duration)
+	if s.Output != "" {
+		message += " to " + s.Output
+	}
+	if s.Captured > 0 {
+		message += fmt.Sprintf(". Included %d captured pods", s.Captured)
+	}
+	if s.Interrupted != "" {
+		message += ". Interrupted: " + s.Interrupted
+	}
+	if len(s.TimedOut) > 0 {
+		message += fmt.Sprintf(". %d timed out", len(s.TimedOut))
+	}
+	if len(s.Truncated) > 0 || len(s.Dropped) > 0 {
+		message += fmt.Sprintf(". Size budget exhausted: %d truncated, %d dropped", len(s.Truncated), len(s.Dropped))
+	}
+	if len(s.Errors) > 0 {
+		message += fmt.Sprintf(". %d errors, first one: %s", len(s.Errors), s.Errors[0])
+	}
+	return message
+}
+
+// Summary returns the summary of the last collection, nil if collection never ran.
+func (a *Collector) Summary() *Summary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary == nil {
+		return nil
+	}
+	return copySummary(a.summary)
+}
+
+func copySummary(s *Summary) *Summary {
+	copied := *s
+	copied.Resources = make(map[string]int, len(s.Resources))
+	for k := range s.Resources {
+		copied.Resources[k] = s.Resources[k]
+	}
+	copied.Errors = append([]string(nil), s.Errors...)
+	copied.Skipped = append([]SkippedEntry(nil), s.Skipped...)
+	copied.TimedOut = append([]string(nil), s.TimedOut...)
+	copied.Truncated = append([]string(nil), s.Truncated...)
+	copied.Dropped = append([]string(nil), s.Dropped...)
+	copied.Clusters = append([]ClusterStatus(nil), s.Clusters...)
+	if s.Omitted != nil {
+		copied.Omitted = make(map[string]int, len(s.Omitted))
+		for k := range s.Omitted {
+			copied.Omitted[k] = s.Omitted[k]
+		}
+	}
+	return &copied
+}
+
+// startSummary starts the summary of a new collection.
+func (a *Collector) startSummary() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.summary = &Summary{
+		StartTime: a.clock.Now().UTC().Format(time.RFC3339),
+		Output:    sinkLocation(a.sink),
+		Resources: make(map[string]int),
+	}
+	a.start = a.clock.Now()
+	a.skipped = nil
+	a.kept = nil
+	a.mapper = nil
+}
+
+// finishSummary completes the summary of the collection and stores it in summary.yaml.
+// err is the outcome of the collection. If no error was recorded, err is.
+func (a *Collector) finishSummary(err error, logger logr.Logger) {
+	a.mu.Lock()
+	a.summary.Duration = a.clock.Since(a.start).Round(time.Second).String()
+	a.summary.Skipped = append([]SkippedEntry(nil), a.skipped...)
+	if err != nil && len(a.summary.Errors) == 0 {
+		a.summary.Errors = append(a.summary.Errors, err.Error())
+	}
+	a.summary.Status = CollectionSucceeded
+	if len(a.summary.Errors) > 0 || a.summary.Interrupted != "" {
+		a.summary.Status = CollectionFailed
+	}
+	summary := copySummary(a.summary)
+	a.mu.Unlock()
+
+	sort.SliceStable(summary.Skipped, func(i, j int) bool {
+		if summary.Skipped[i].Cluster != summary.Skipped[j].Cluster {
+			return summary.Skipped[i].Cluster < summary.Skipped[j].Cluster
+		}
+		if summary.Skipped[i].Namespace != summary.Skipped[j].Namespace {
+			return summary.Skipped[i].Namespace < summary.Skipped[j].Namespace
+		}
+		return summary.Skipped[i].Kind < summary.Skipped[j].Kind
+	})
+
+	if err := a.writeYAML(summaryFile, summary); err != nil {
+		logger.Info(fmt.Sprintf("failed to store summary: %v", err))
+	}
+	if err := a.writeOverview(summary, logger); err != nil {
+		logger.Info(fmt.Sprintf("failed to store overview: %v", err))
+	}
+
+	a.mu.Lock()
+	a.kept = nil
+	a.mu.Unlock()
+}
+
+// recordError adds the error of a configuration entry to the summary.
+func (a *Collector) recordError(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Errors = append(a.summary.Errors, err.Error())
+	}
+}
+
+// countObject adds a collected object to the summary.
+func (a *Collector) countObject(gvk schema.GroupVersionKind) {
+	a.metrics.observeObject(gvk)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Resources[path.Join(gvk.Group, gvk.Version, gvk.Kind)]++
+		a.summary.Objects++
+	}
+}
+
+// countLogs adds pods and the number of their collected container logs to the summary.
+func (a *Collector) countLogs(pods, containers int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Pods += pods
+		a.summary.Containers += containers
+	}
+}
+
+// countCaptured adds the pods included from the capture buffer to the summary.
+func (a *Collector) countCaptured(pods int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Captured += pods
+	}
+}
+
+// mergeClusterSummary adds the summary of the collection from a cluster, and its
+// error if the collection did not even start, to the summary.
+func (a *Collector) mergeClusterSummary(cluster string, s *Summary, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary == nil {
+		return
+	}
+
+	if s == nil {
+		if err != nil {
+			a.summary.Errors = append(a.summary.Errors, fmt.Sprintf("cluster %s: %v", cluster, err))
+		}
+		return
+	}
+
+	for k := range s.Resources {
+		a.summary.Resources[k] += s.Resources[k]
+	}
+	a.summary.Objects += s.Objects
+	a.summary.Pods += s.Pods
+	a.summary.Containers += s.Containers
+	a.summary.Captured += s.Captured
+	for i := range s.Skipped {
+		entry := s.Skipped[i]
+		entry.Cluster = cluster
+		a.skipped = append(a.skipped, entry)
+	}
+	for i := range s.TimedOut {
+		a.summary.TimedOut = append(a.summary.TimedOut, fmt.Sprintf("cluster %s: %s", cluster, s.TimedOut[i]))
+	}
+	for i := range s.Truncated {
+		a.summary.Truncated = append(a.summary.Truncated, fmt.Sprintf("cluster %s: %s", cluster, s.Truncated[i]))
+	}
+	for i := range s.Dropped {
+		a.summary.Dropped = append(a.summary.Dropped, fmt.Sprintf("cluster %s: %s", cluster, s.Dropped[i]))
+	}
+	for i := range s.Errors {
+		a.summary.Errors = append(a.summary.Errors, fmt.Sprintf("cluster %s: %s", cluster, s.Errors[i]))
+	}
+}
+
+// setClusterStatuses sets the status of each cluster in the summary.
+func (a *Collector) setClusterStatuses(statuses []ClusterStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Clusters = statuses
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Summary", func() {
+	It("Collect counts collected container logs", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "coredns", Image: "coredns"}, {Name: "sidecar", Image: "sidecar"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "coredns", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+					{Name: "sidecar", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				},
+			},
+		}
+
+		results := utils.NewMemoryResults()
+		collector := newTestCollector([]client.Object{pod}, results.Options()...)
+		Expect(collector.Summary()).To(BeNil())
+
+		config := &utils.Configuration{Logs: []utils.Log{{Namespace: "kube-system"}}}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		summary := collector.Summary()
+		Expect(summary).ToNot(BeNil())
+		Expect(summary.Status).To(Equal(utils.CollectionSucceeded))
+		Expect(summary.Pods).To(Equal(1))
+		Expect(summary.Containers).To(Equal(2))
+		Expect(summary.Errors).To(BeEmpty())
+		Expect(summary.Message()).To(ContainSubstring("2 container logs from 1 pods"))
+	})
+
+	It("ReportSummary writes the ConfigMap, annotates the Job and emits an Event", func() {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "k8s-collector"}}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(job).Build()
+
+		summary := &utils.Summary{
+			Status:    utils.CollectionFailed,
+			Duration:  "3s",
+			Resources: map[string]int{"apps/v1/Deployment": 2},
+			Objects:   2,
+			Errors:    []string{"forbidden"},
+		}
+		target := &utils.StatusTarget{ConfigMap: "default/status", Job: "default/k8s-collector"}
+		Expect(utils.ReportSummary(context.TODO(), c, target, summary)).To(Succeed())
+
+		configMap := &corev1.ConfigMap{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "status"}, configMap)).To(Succeed())
+		stored := &utils.Summary{}
+		Expect(yaml.Unmarshal([]byte(configMap.Data[utils.SummaryKey]), stored)).To(Succeed())
+		Expect(stored.Resources).To(HaveKeyWithValue("apps/v1/Deployment", 2))
+
+		// Reporting again updates the existing ConfigMap
+		Expect(utils.ReportSummary(context.TODO(), c, target, summary)).To(Succeed())
+
+		Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(job), job)).To(Succeed())
+		Expect(job.Annotations).To(HaveKeyWithValue(utils.StatusAnnotation, utils.CollectionFailed))
+		Expect(job.Annotations[utils.MessageAnnotation]).To(ContainSubstring("first one: forbidden"))
+
+		events := &corev1.EventList{}
+		Expect(c.List(context.TODO(), events, client.InNamespace("default"))).To(Succeed())
+		Expect(events.Items).To(HaveLen(2))
+		Expect(events.Items[0].Type).To(Equal(corev1.EventTypeWarning))
+		Expect(events.Items[0].InvolvedObject.Name).To(Equal("k8s-collector"))
+	})
+
+	It("ReportSummary limits the size of the ConfigMap and of the message", func() {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "k8s-collector"}}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(job).Build()
+
+		summary := &utils.Summary{Status: utils.CollectionFailed, Duration: "3s"}
+		for i := 0; i < 1000; i++ {
+			summary.Dropped = append(summary.Dropped, fmt.Sprintf("logs/kube-system/pod-%d-main", i))
+		}
+		// The message exceeds the maximum length in the middle of a multi-byte character
+		summary.Errors = []string{strings.Repeat("é", 1024)}
+		target := &utils.StatusTarget{ConfigMap: "default/status", Job: "default/k8s-collector"}
+		Expect(utils.ReportSummary(context.TODO(), c, target, summary)).To(Succeed())
+		Expect(summary.Dropped).To(HaveLen(1000))
+
+		configMap := &corev1.ConfigMap{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "status"}, configMap)).To(Succeed())
+		stored := &utils.Summary{}
+		Expect(yaml.Unmarshal([]byte(configMap.Data[utils.SummaryKey]), stored)).To(Succeed())
+		Expect(stored.Dropped).To(HaveLen(50))
+		Expect(stored.Omitted).To(Equal(map[string]int{"dropped": 950}))
+		Expect(utf8.ValidString(stored.Errors[0])).To(BeTrue())
+
+		Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(job), job)).To(Succeed())
+		message := job.Annotations[utils.MessageAnnotation]
+		Expect(len(message)).To(BeNumerically("<=", 1024))
+		Expect(utf8.ValidString(message)).To(BeTrue())
+		Expect(message).To(HaveSuffix("é..."))
+	})
+})
@@ -0,0 +1,128 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	reasonClusterScoped   = "cluster-scoped resources are not collected in namespaced mode"
+	reasonOtherNamespace  = "namespace is not one of the namespaces the collector is restricted to"
+	reasonForbiddenPrefix = "forbidden: "
+)
+
+// SkippedEntry describes data that was not collected because of the namespaces
+// the collector is restricted to, or because access was denied.
+type SkippedEntry struct {
+	// Cluster is set, when collecting from multiple clusters, to the cluster data was skipped in.
+	Cluster string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+
+	// Kind is the GroupVersionKind of the skipped resources, or "Log" for logs.
+	Kind string `json:"kind" yaml:"kind"`
+
+	// Namespace the data was skipped in. Empty for cluster-scoped resources.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+	// Name is set when a single object or pod was skipped (<pod>/<container> for a container).
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Reason explains why data was skipped.
+	Reason string `json:"reason" yaml:"reason"`
+}
+
+// WithNamespaces restricts the collector to namespaces (namespaced mode). This
+// is meant for tenants which only have Roles in their namespaces:
+//   - resources and logs are listed in each namespace, never cluster-wide;
+//   - cluster-scoped resources and entries for other namespaces are skipped;
+//   - requests denied with 403 are skipped instead of failing the collection.
+//
+// Skipped data is logged, returned by Skipped and listed in the collection summary.
+func WithNamespaces(namespaces ...string) Option {
+	return func(a *Collector) {
+		a.namespaces = namespaces
+	}
+}
+
+// Skipped returns what the last collection skipped in namespaced mode, and the
+// containers whose logs were skipped because they never started.
+func (a *Collector) Skipped() []SkippedEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	skipped := make([]SkippedEntry, len(a.skipped))
+	copy(skipped, a.skipped)
+	return skipped
+}
+
+// isNamespaced returns true if the collector is restricted to a set of namespaces.
+func (a *Collector) isNamespaced() bool {
+	return len(a.namespaces) > 0
+}
+
+// entryNamespaces returns the namespaces a configuration entry for namespace is
+// collected from. An empty namespace means all namespaces, so outside namespaced
+// mode it is returned as is and data is listed cluster-wide.
+// If the entry must be skipped, no namespace and the reason are returned.
+func (a *Collector) entryNamespaces(namespace string) (namespaces []string, reason string) {
+	return restrictNamespace(a.namespaces, namespace)
+}
+
+// restrictNamespace returns the namespaces, among allowed, namespace selects.
+// If allowed is empty, all namespaces are allowed.
+func restrictNamespace(allowed []string, namespace string) (namespaces []string, reason string) {
+	if len(allowed) == 0 {
+		return []string{namespace}, ""
+	}
+
+	if namespace == "" {
+		return allowed, ""
+	}
+
+	for i := range allowed {
+		if allowed[i] == namespace {
+			return []string{namespace}, ""
+		}
+	}
+
+	return nil, reasonOtherNamespace
+}
+
+// isSkippable returns true if err can be recorded as skipped data instead of
+// failing the collection.
+func (a *Collector) isSkippable(err error) bool {
+	return a.isNamespaced() && apierrors.IsForbidden(err)
+}
+
+// skip logs and records data that is not collected.
+func (a *Collector) skip(entry SkippedEntry, logger logr.Logger) {
+	logger.Info(fmt.Sprintf("skipping %s (namespace %q, name %q): %s",
+		entry.Kind, entry.Namespace, entry.Name, entry.Reason))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.skipped = append(a.skipped, entry)
+}
+
+// skipForbidden records data not collected because access was denied.
+func (a *Collector) skipForbidden(kind, namespace, name string, err error, logger logr.Logger) {
+	a.skip(SkippedEntry{Kind: kind, Namespace: namespace, Name: name, Reason: reasonForbiddenPrefix + err.Error()},
+		logger)
+}
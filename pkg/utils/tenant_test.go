@@ -0,0 +1,125 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Namespaced mode", func() {
+	newPod := func(namespace string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "app", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				},
+			},
+		}
+	}
+
+	It("Collect lists pods in each namespace and skips forbidden ones", func() {
+		teamA, teamB, other := newPod("team-a"), newPod("team-b"), newPod("other")
+
+		listedNamespaces := make([]string, 0)
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(teamA, teamB, other).WithInterceptorFuncs(
+			interceptor.Funcs{
+				List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+					options := &client.ListOptions{}
+					options.ApplyOptions(opts)
+					listedNamespaces = append(listedNamespaces, options.Namespace)
+					if options.Namespace == "team-b" {
+						return apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", nil)
+					}
+					return c.List(ctx, list, opts...)
+				},
+			}).Build()
+
+		results := utils.NewMemoryResults()
+		options := append(results.Options(), utils.WithClient(c), utils.WithNamespaces("team-a", "team-b"))
+		collector := newTestCollector([]client.Object{teamA, teamB, other}, options...)
+
+		config := &utils.Configuration{
+			Logs: []utils.Log{{}, {Namespace: "other"}},
+		}
+		Expect(collector.Collect(context.TODO(), config)).To(Succeed())
+
+		Expect(listedNamespaces).To(Equal([]string{"team-a", "team-b"}))
+		Expect(results.Logs()).To(HaveLen(1))
+		Expect(results.Logs()).To(HaveKey(utils.LogReference{Namespace: "team-a", Pod: "app", Container: "app"}))
+
+		skipped := collector.Skipped()
+		Expect(skipped).To(HaveLen(2))
+		Expect(skipped[0].Namespace).To(Equal("team-b"))
+		Expect(skipped[0].Reason).To(HavePrefix("forbidden: "))
+		Expect(skipped[1].Namespace).To(Equal("other"))
+	})
+
+	It("RequiredNamespacedPermissions only returns namespaced permissions", func() {
+		config := &utils.Configuration{
+			Resources: []utils.Resource{
+				{Group: "", Version: "v1", Kind: "Node"},
+				{Group: "apps", Version: "v1", Kind: "Deployment"},
+				{Group: "apps", Version: "v1", Kind: "DaemonSet", Namespace: "kube-system"},
+			},
+			Logs: []utils.Log{{Namespace: "team-b"}},
+		}
+
+		mapper := apimeta.NewDefaultRESTMapper(nil)
+		mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Node"}, apimeta.RESTScopeRoot)
+		mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			apimeta.RESTScopeNamespace)
+		mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+			apimeta.RESTScopeNamespace)
+
+		permissions, err := utils.RequiredNamespacedPermissions(config, mapper, []string{"team-a", "team-b"})
+		Expect(err).To(BeNil())
+
+		descriptions := make([]string, len(permissions))
+		for i := range permissions {
+			descriptions[i] = permissions[i].String()
+		}
+		Expect(descriptions).To(Equal([]string{
+			"list deployments.apps in namespace team-a",
+			"list deployments.apps in namespace team-b",
+			"list pods in namespace team-b",
+			"get pods/log in namespace team-b",
+		}))
+
+		objects := utils.RBACObjects(permissions, "collector", "team-a", "collector")
+		for i := range objects {
+			Expect(objects[i].GetNamespace()).ToNot(BeEmpty())
+		}
+	})
+})
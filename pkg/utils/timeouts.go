@@ -0,0 +1,104 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WithListTimeout bounds each list (or get) request. A request exceeding it fails
+// and is reported in the summary as timed out. Default is no timeout.
+func WithListTimeout(timeout time.Duration) Option {
+	return func(a *Collector) {
+		a.listTimeout = timeout
+	}
+}
+
+// WithLogStreamTimeout bounds the time spent collecting each container log. When
+// exceeded, the logs received so far are kept and the container is reported in
+// the summary as timed out. Default is no timeout.
+func WithLogStreamTimeout(timeout time.Duration) Option {
+	return func(a *Collector) {
+		a.logStreamTimeout = timeout
+	}
+}
+
+// doRequest runs a single list or get request, retrying transient errors. Each
+// attempt is bounded by the list timeout.
+// Failures are counted in metrics and timeouts are reported, as what, in the summary.
+func (a *Collector) doRequest(ctx context.Context, what string, request func(ctx context.Context) error) error {
+	return a.retry(ctx, what, func() error {
+		reqCtx, cancel := withOptionalTimeout(ctx, a.listTimeout)
+		defer cancel()
+
+		err := request(reqCtx)
+		if err != nil {
+			a.metrics.observeAPIError(err)
+			if isTimedOut(ctx, reqCtx) {
+				a.recordTimeout(what)
+			}
+		}
+		return err
+	})
+}
+
+// streamContext returns the context of a single log stream.
+func (a *Collector) streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, a.logStreamTimeout)
+}
+
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// isTimedOut returns true if the deadline of reqCtx, derived from ctx, was exceeded.
+// It is false when ctx itself is done: the whole collection is being interrupted.
+func isTimedOut(ctx, reqCtx context.Context) bool {
+	return ctx.Err() == nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded)
+}
+
+// recordTimeout adds what timed out to the summary.
+func (a *Collector) recordTimeout(what string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.TimedOut = append(a.summary.TimedOut, what)
+	}
+}
+
+// recordInterruption records, in the summary, why ctx stopped the collection. It
+// returns the cause, nil if ctx is not done.
+func (a *Collector) recordInterruption(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+
+	cause := context.Cause(ctx)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.summary != nil {
+		a.summary.Interrupted = cause.Error()
+	}
+	return cause
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var _ = Describe("Timeouts", func() {
+	var collector *utils.Collector
+	var results *utils.MemoryResults
+
+	BeforeEach(func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "coredns", Image: "coredns"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "coredns", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				},
+			},
+		}
+
+		// Listing pods in the slow namespace hangs until the request is canceled
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).WithInterceptorFuncs(
+			interceptor.Funcs{
+				List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+					options := &client.ListOptions{}
+					options.ApplyOptions(opts)
+					if options.Namespace == "slow" {
+						<-ctx.Done()
+						return ctx.Err()
+					}
+					return c.List(ctx, list, opts...)
+				},
+			}).Build()
+
+		results = utils.NewMemoryResults()
+		options := append(results.Options(), utils.WithClient(c), utils.WithListTimeout(10*time.Millisecond))
+		collector = newTestCollector([]client.Object{pod}, options...)
+	})
+
+	It("Collect reports requests exceeding the list timeout and goes on", func() {
+		config := &utils.Configuration{
+			Logs: []utils.Log{{Namespace: "slow"}, {Namespace: "kube-system"}},
+		}
+		Expect(collector.Collect(context.TODO(), config)).ToNot(Succeed())
+
+		summary := collector.Summary()
+		Expect(summary.Status).To(Equal(utils.CollectionFailed))
+		Expect(summary.TimedOut).To(Equal([]string{`list pods in namespace "slow"`}))
+		Expect(summary.Interrupted).To(BeEmpty())
+		Expect(summary.Containers).To(Equal(1))
+		Expect(results.Logs()).To(HaveLen(1))
+	})
+
+	It("Collect stops when the context is canceled", func() {
+		ctx, cancel := context.WithCancelCause(context.TODO())
+		cancel(errors.New("received signal terminated"))
+
+		config := &utils.Configuration{
+			Logs: []utils.Log{{Namespace: "kube-system"}},
+		}
+		err := collector.Collect(ctx, config)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("received signal terminated"))
+
+		summary := collector.Summary()
+		Expect(summary.Status).To(Equal(utils.CollectionFailed))
+		Expect(summary.Interrupted).To(Equal("received signal terminated"))
+		Expect(summary.TimedOut).To(BeEmpty())
+		Expect(results.Logs()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,563 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// TriggerCrashLoopBackOff is the reason of collections triggered by a container
+	// in CrashLoopBackOff.
+	TriggerCrashLoopBackOff = "CrashLoopBackOff"
+	// TriggerOOMKilled is the reason of collections triggered by a container killed
+	// because it ran out of memory.
+	TriggerOOMKilled = "OOMKilled"
+	// TriggerJobFailed is the reason of collections triggered by a failed Job.
+	TriggerJobFailed = "JobFailed"
+
+	// Outcome of triggers, triggersTotal label
+	triggerCollected   = "collected"
+	triggerDuplicate   = "duplicate"
+	triggerRateLimited = "rate_limited"
+	triggerDropped     = "dropped"
+
+	triggersDir      = "triggers"
+	triggerFile      = "trigger.yaml"
+	triggerDirLayout = "20060102-150405"
+
+	// triggerQueueSize is the number of triggers waiting to be collected
+	triggerQueueSize = 100
+	// maxOwnerDepth bounds the owner chain walked from a failed object
+	maxOwnerDepth = 10
+
+	defaultTriggerDedupWindow = time.Hour
+	defaultTriggerMaxPerHour  = 10
+	triggerRateLimitWindow    = time.Hour
+
+	podKind   = "Pod"
+	jobKind   = "Job"
+	nodeKind  = "Node"
+	eventKind = "Event"
+)
+
+// Trigger is a failure triggering a targeted collection.
+type Trigger struct {
+	// Reason is one of CrashLoopBackOff, OOMKilled and JobFailed.
+	Reason string `json:"reason" yaml:"reason"`
+
+	// Kind of the failed object, Pod or Job.
+	Kind string `json:"kind" yaml:"kind"`
+
+	Namespace string `json:"namespace" yaml:"namespace"`
+	Name      string `json:"name" yaml:"name"`
+
+	// Container is the failed container of a Pod.
+	Container string `json:"container,omitempty" yaml:"container,omitempty"`
+
+	// Time the failure was detected.
+	Time string `json:"time" yaml:"time"`
+}
+
+// String describes the trigger, e.g. "Pod kube-system/coredns container coredns OOMKilled".
+func (t *Trigger) String() string {
+	s := fmt.Sprintf("%s %s/%s", t.Kind, t.Namespace, t.Name)
+	if t.Container != "" {
+		s += " container " + t.Container
+	}
+	return s + " " + t.Reason
+}
+
+// key identifies the failure, regardless of when it is detected.
+func (t *Trigger) key() string {
+	return strings.Join([]string{t.Reason, t.Kind, t.Namespace, t.Name, t.Container}, "/")
+}
+
+// TriggerPolicy defines how triggers are deduplicated and rate limited.
+type TriggerPolicy struct {
+	// DedupWindow is the time during which the same failure (same reason, object and
+	// container) triggers at most one collection.
+	DedupWindow time.Duration
+
+	// MaxPerHour is the maximum number of collections triggered in any hour.
+	// Triggers exceeding it are dropped. 0 means no limit.
+	MaxPerHour int
+}
+
+// DefaultTriggerPolicy returns the policy used by default: each failure is collected
+// at most once per hour, and at most 10 collections are triggered per hour.
+func DefaultTriggerPolicy() TriggerPolicy {
+	return TriggerPolicy{
+		DedupWindow: defaultTriggerDedupWindow,
+		MaxPerHour:  defaultTriggerMaxPerHour,
+	}
+}
+
+// podTriggers returns the failures of the containers of pod. Containers OOMKilled
+// before since, such as those found when the controller starts, are not failures:
+// they were not detected, and may have been collected, by a previous controller.
+func podTriggers(pod *corev1.Pod, since time.Time) []Trigger {
+	triggers := make([]Trigger, 0)
+	statuses := append(append([]corev1.ContainerStatus(nil), pod.Status.InitContainerStatuses...),
+		pod.Status.ContainerStatuses...)
+	for i := range statuses {
+		status := &statuses[i]
+		trigger := Trigger{Kind: podKind, Namespace: pod.Namespace, Name: pod.Name, Container: status.Name}
+
+		if status.State.Waiting != nil && status.State.Waiting.Reason == TriggerCrashLoopBackOff {
+			trigger.Reason = TriggerCrashLoopBackOff
+			triggers = append(triggers, trigger)
+		}
+
+		if isOOMKilled(status.State.Terminated, since) || isOOMKilled(status.LastTerminationState.Terminated, since) {
+			trigger.Reason = TriggerOOMKilled
+			triggers = append(triggers, trigger)
+		}
+	}
+
+	return triggers
+}
+
+// isOOMKilled returns true if the container was OOMKilled after since.
+func isOOMKilled(state *corev1.ContainerStateTerminated, since time.Time) bool {
+	return state != nil && state.Reason == TriggerOOMKilled && state.FinishedAt.Time.After(since)
+}
+
+// jobTriggers returns the failure of job, if it failed after since.
+func jobTriggers(job *batchv1.Job, since time.Time) []Trigger {
+	for i := range job.Status.Conditions {
+		condition := &job.Status.Conditions[i]
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue &&
+			condition.LastTransitionTime.Time.After(since) {
+
+			return []Trigger{{Reason: TriggerJobFailed, Kind: jobKind, Namespace: job.Namespace, Name: job.Name}}
+		}
+	}
+
+	return nil
+}
+
+// triggerLimiter deduplicates triggers and limits how many collections they start.
+type triggerLimiter struct {
+	clock  clock.PassiveClock
+	policy TriggerPolicy
+
+	mu sync.Mutex
+	// collected contains when each failure was last collected
+	collected map[string]time.Time
+	// recent contains when collections started in the last hour
+	recent []time.Time
+}
+
+func newTriggerLimiter(c clock.PassiveClock, policy TriggerPolicy) *triggerLimiter {
+	return &triggerLimiter{clock: c, policy: policy, collected: make(map[string]time.Time)}
+}
+
+// allow returns whether trigger starts a collection. If not, it returns why.
+func (l *triggerLimiter) allow(trigger *Trigger) (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	key := trigger.key()
+	if last, ok := l.collected[key]; ok && now.Sub(last) < l.policy.DedupWindow {
+		return false, triggerDuplicate
+	}
+
+	recent := l.recent[:0]
+	for _, t := range l.recent {
+		if now.Sub(t) < triggerRateLimitWindow {
+			recent = append(recent, t)
+		}
+	}
+	l.recent = recent
+	if l.policy.MaxPerHour > 0 && len(l.recent) >= l.policy.MaxPerHour {
+		return false, triggerRateLimited
+	}
+
+	l.collected[key] = now
+	l.recent = append(l.recent, now)
+	return true, ""
+}
+
+// RunTriggers runs the collector as a controller: it watches Pods and Jobs and, when
+// a container enters CrashLoopBackOff or is OOMKilled or a Job fails, collects the
+// evidence of the failure in triggers/<time>-<kind>-<namespace>-<name>.
+// Containers OOMKilled and Jobs failed before RunTriggers is called do not trigger
+// collections; containers still in CrashLoopBackOff do.
+// Failures are deduplicated and rate limited according to policy. Triggered
+// collections run one at a time. RunTriggers returns when ctx is done.
+func (a *Collector) RunTriggers(ctx context.Context, policy TriggerPolicy) error {
+	logger := a.logger
+	// Failures which happened before starting, found by the initial list of pods
+	// and jobs, do not trigger collections
+	start := a.clock.Now()
+	limiter := newTriggerLimiter(a.clock, policy)
+	queue := make(chan Trigger, triggerQueueSize)
+
+	enqueue := func(triggers []Trigger) {
+		for i := range triggers {
+			trigger := &triggers[i]
+			allowed, reason := limiter.allow(trigger)
+			if !allowed {
+				if reason == triggerRateLimited {
+					logger.Info(fmt.Sprintf("%s: collection not triggered, rate limit reached", trigger))
+				}
+				a.metrics.observeTrigger(trigger.Reason, reason)
+				continue
+			}
+
+			trigger.Time = a.clock.Now().UTC().Format(time.RFC3339)
+			select {
+			case queue <- *trigger:
+			default:
+				logger.Info(fmt.Sprintf("%s: collection not triggered, too many pending collections", trigger))
+				a.metrics.observeTrigger(trigger.Reason, triggerDropped)
+			}
+		}
+	}
+
+	handler := func(obj interface{}) {
+		switch o := obj.(type) {
+		case *corev1.Pod:
+			enqueue(podTriggers(o, start))
+		case *batchv1.Job:
+			enqueue(jobTriggers(o, start))
+		}
+	}
+
+	namespaces := a.namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	factories := make([]informers.SharedInformerFactory, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(a.clientset, 0, informers.WithNamespace(namespace))
+		eventHandler := cache.ResourceEventHandlerFuncs{
+			AddFunc:    handler,
+			UpdateFunc: func(_, obj interface{}) { handler(obj) },
+		}
+		if _, err := factory.Core().V1().Pods().Informer().AddEventHandler(eventHandler); err != nil {
+			return err
+		}
+		if _, err := factory.Batch().V1().Jobs().Informer().AddEventHandler(eventHandler); err != nil {
+			return err
+		}
+		factories = append(factories, factory)
+	}
+
+	for i := range factories {
+		factories[i].Start(ctx.Done())
+	}
+	defer func() {
+		for i := range factories {
+			factories[i].Shutdown()
+		}
+	}()
+
+	logger.Info(fmt.Sprintf("watching pods and jobs in %d namespace(s)", len(namespaces)))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case trigger := <-queue:
+			a.metrics.observeTrigger(trigger.Reason, triggerCollected)
+			if err := a.collectTrigger(ctx, &trigger, logger.WithValues("trigger", trigger.String())); err != nil {
+				logger.Info(fmt.Sprintf("failed to collect %s: %v", &trigger, err))
+			}
+		}
+	}
+}
+
+// CollectTrigger collects the evidence of a failure: the failed Pod, its logs
+// (including the previous run of restarted containers), events, owners and Node.
+// For a failed Job, the Job, its events and owners and the evidence of each of
+// its pods. Data is stored in triggers/<time>-<kind>-<namespace>-<name>, along
+// with trigger.yaml and summary.yaml.
+func (a *Collector) CollectTrigger(ctx context.Context, trigger *Trigger) error {
+	return a.collectTrigger(ctx, trigger, a.logger.WithValues("trigger", trigger.String()))
+}
+
+func (a *Collector) collectTrigger(ctx context.Context, trigger *Trigger, logger logr.Logger) error {
+	dir := path.Join(triggersDir, fmt.Sprintf("%s-%s-%s-%s", a.clock.Now().UTC().Format(triggerDirLayout),
+		strings.ToLower(trigger.Kind), trigger.Namespace, trigger.Name))
+
+	var sink Sink
+	if a.sink != nil {
+		sink = newPrefixSink(a.sink, dir)
+	}
+	collector, err := a.derive(sink, logger)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("collecting evidence of failure")
+	err = collector.collectTriggerData(ctx, trigger, logger)
+	if a.metrics != nil {
+		a.metrics.ObserveRun(collector.Summary(), a.clock.Now())
+	}
+	return err
+}
+
+// collectTriggerData collects the evidence of trigger. Its summary is stored in summary.yaml.
+func (a *Collector) collectTriggerData(ctx context.Context, trigger *Trigger, logger logr.Logger) error {
+	a.startSummary()
+	a.keepServerVersion(logger)
+
+	err := a.writeYAML(triggerFile, trigger)
+	if err == nil {
+		nodes := make(map[string]bool)
+		switch trigger.Kind {
+		case podKind:
+			err = a.collectPodEvidence(ctx, trigger.Namespace, trigger.Name, nodes, logger)
+		case jobKind:
+			err = a.collectJobEvidence(ctx, trigger.Namespace, trigger.Name, nodes, logger)
+		default:
+			err = fmt.Errorf("unsupported trigger kind %q", trigger.Kind)
+		}
+	}
+	if describeErr := a.writeDescriptions(logger); err == nil {
+		err = describeErr
+	}
+
+	if err != nil {
+		a.recordError(err)
+	}
+	if cause := a.recordInterruption(ctx); cause != nil && err == nil {
+		err = cause
+	}
+
+	a.finishSummary(err, logger)
+	return err
+}
+
+// collectPodEvidence collects a pod, its logs, events, owners and node. Nodes
+// already collected are skipped.
+func (a *Collector) collectPodEvidence(ctx context.Context, namespace, name string, nodes map[string]bool,
+	logger logr.Logger) error {
+
+	pod := &corev1.Pod{}
+	if err := a.getObject(ctx, podKind, namespace, name, pod); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		// Events of deleted pods are still useful
+		logger.Info(fmt.Sprintf("pod %s/%s not found", namespace, name))
+		return a.collectEvents(ctx, podKind, namespace, name, logger)
+	}
+
+	return errors.Join(a.collectPodData(ctx, pod, nodes, logger), a.collectOwners(ctx, pod, logger))
+}
+
+// collectPodData collects a pod, its logs, events and node.
+func (a *Collector) collectPodData(ctx context.Context, pod *corev1.Pod, nodes map[string]bool,
+	logger logr.Logger) error {
+
+	errs := []error{
+		a.dumpObject(pod.DeepCopy(), logger),
+		a.dumpPodLogs(ctx, nil, pod, logger),
+		a.collectEvents(ctx, podKind, pod.Namespace, pod.Name, logger),
+	}
+	if pod.Spec.NodeName != "" && !nodes[pod.Spec.NodeName] {
+		nodes[pod.Spec.NodeName] = true
+		errs = append(errs, a.collectNode(ctx, pod.Spec.NodeName, logger))
+	}
+
+	return errors.Join(errs...)
+}
+
+// collectJobEvidence collects a job, its events and owners and the pods of the job.
+func (a *Collector) collectJobEvidence(ctx context.Context, namespace, name string, nodes map[string]bool,
+	logger logr.Logger) error {
+
+	job := &batchv1.Job{}
+	if err := a.getObject(ctx, jobKind, namespace, name, job); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		logger.Info(fmt.Sprintf("job %s/%s not found", namespace, name))
+		return a.collectEvents(ctx, jobKind, namespace, name, logger)
+	}
+
+	errs := []error{
+		a.dumpObject(job.DeepCopy(), logger),
+		a.collectEvents(ctx, jobKind, namespace, name, logger),
+		a.collectOwners(ctx, job, logger),
+	}
+
+	if job.Spec.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(job.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		pods := &corev1.PodList{}
+		err = a.doRequest(ctx, fmt.Sprintf("list pods of job %s/%s", namespace, name),
+			func(ctx context.Context) error {
+				return a.client.List(ctx, pods, client.InNamespace(namespace),
+					client.MatchingLabelsSelector{Selector: selector})
+			})
+		if err != nil {
+			return err
+		}
+		for i := range pods.Items {
+			errs = append(errs, a.collectPodData(ctx, &pods.Items[i], nodes, logger))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// getObject gets the object kind namespace/name.
+func (a *Collector) getObject(ctx context.Context, kind, namespace, name string, obj client.Object) error {
+	return a.doRequest(ctx, fmt.Sprintf("get %s %s/%s", kind, namespace, name),
+		func(ctx context.Context) error {
+			return a.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj)
+		})
+}
+
+// collectEvents collects the events involving the object kind namespace/name.
+func (a *Collector) collectEvents(ctx context.Context, kind, namespace, name string, logger logr.Logger) error {
+	selector := fields.Set{"involvedObject.kind": kind, "involvedObject.name": name}.AsSelector().String()
+
+	var events *corev1.EventList
+	err := a.doRequest(ctx, fmt.Sprintf("list events of %s %s/%s", kind, namespace, name),
+		func(ctx context.Context) (err error) {
+			events, err = a.clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+			return err
+		})
+	if err != nil {
+		if a.isSkippable(err) {
+			a.skipForbidden(eventKind, namespace, "", err, logger)
+			return nil
+		}
+		return err
+	}
+
+	for i := range events.Items {
+		event := &events.Items[i]
+		// Field selectors are not honored by every client
+		if event.InvolvedObject.Kind != kind || event.InvolvedObject.Name != name {
+			continue
+		}
+		if err := a.dumpObject(event, logger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectOwners collects the chain of controllers of obj, e.g. the ReplicaSet and
+// the Deployment of a Pod.
+func (a *Collector) collectOwners(ctx context.Context, obj client.Object, logger logr.Logger) error {
+	for depth := 0; depth < maxOwnerDepth; depth++ {
+		ref := metav1.GetControllerOfNoCopy(obj)
+		if ref == nil {
+			return nil
+		}
+
+		owner := &unstructured.Unstructured{}
+		owner.SetAPIVersion(ref.APIVersion)
+		owner.SetKind(ref.Kind)
+		if err := a.getObject(ctx, ref.Kind, obj.GetNamespace(), ref.Name, owner); err != nil {
+			if apierrors.IsNotFound(err) {
+				logger.Info(fmt.Sprintf("owner %s %s not found", ref.Kind, ref.Name))
+				return nil
+			}
+			if a.isSkippable(err) {
+				a.skipForbidden(owner.GroupVersionKind().String(), obj.GetNamespace(), ref.Name, err, logger)
+				return nil
+			}
+			return err
+		}
+
+		if err := a.dumpObject(owner.DeepCopy(), logger); err != nil {
+			return err
+		}
+		obj = owner
+	}
+
+	return nil
+}
+
+// collectNode collects the node a pod runs on, including its conditions.
+// In namespaced mode, nodes are skipped.
+func (a *Collector) collectNode(ctx context.Context, name string, logger logr.Logger) error {
+	if a.isNamespaced() {
+		a.skip(SkippedEntry{Kind: nodeKind, Name: name, Reason: reasonClusterScoped}, logger)
+		return nil
+	}
+
+	node := &corev1.Node{}
+	if err := a.getObject(ctx, nodeKind, "", name, node); err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.Info(fmt.Sprintf("node %s not found", name))
+			return nil
+		}
+		return err
+	}
+
+	return a.dumpObject(node, logger)
+}
+
+// TriggerPermissions returns the permissions RunTriggers needs. If namespaces is
+// not empty, permissions are restricted to them and nodes are not collected.
+func TriggerPermissions(namespaces []string) []Permission {
+	const reason = "controller"
+	permissions := []Permission{
+		{Verb: verbList, Resource: "pods", Reason: reason},
+		{Verb: verbWatch, Resource: "pods", Reason: reason},
+		{Verb: verbGet, Resource: "pods", Reason: reason},
+		{Verb: verbGet, Resource: "pods", Subresource: "log", Reason: reason},
+		{Verb: verbList, Group: "batch", Resource: "jobs", Reason: reason},
+		{Verb: verbWatch, Group: "batch", Resource: "jobs", Reason: reason},
+		{Verb: verbGet, Group: "batch", Resource: "jobs", Reason: reason},
+		{Verb: verbList, Resource: "events", Reason: reason},
+	}
+	// Owners of pods and jobs
+	for _, owner := range []struct{ group, resource string }{
+		{"apps", "replicasets"}, {"apps", "deployments"}, {"apps", "statefulsets"}, {"apps", "daemonsets"},
+		{"batch", "cronjobs"},
+	} {
+		permissions = append(permissions,
+			Permission{Verb: verbGet, Group: owner.group, Resource: owner.resource, Reason: reason})
+	}
+
+	if len(namespaces) == 0 {
+		return append(permissions, Permission{Verb: verbGet, Resource: "nodes", Reason: reason})
+	}
+	return restrictPermissions(namespaces, permissions)
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+// triggers returns the value of the triggers metric for outcome
+func triggers(registry *prometheus.Registry, outcome string) float64 {
+	families, err := registry.Gather()
+	Expect(err).To(BeNil())
+	value := 0.0
+	for i := range families {
+		if families[i].GetName() != "k8s_collector_triggers_total" {
+			continue
+		}
+		for _, metric := range families[i].GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "outcome" && label.GetValue() == outcome {
+					value += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return value
+}
+
+func crashingPod(name string, owner *metav1.OwnerReference) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: name, Labels: map[string]string{"app": name}},
+		Spec: corev1.PodSpec{
+			NodeName:   "worker",
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx"}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:         "nginx",
+					RestartCount: 3,
+					State: corev1.ContainerState{
+						Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+					},
+				},
+			},
+		},
+	}
+	if owner != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return pod
+}
+
+var _ = Describe("Triggers", func() {
+	var registry *prometheus.Registry
+	var metrics *utils.Metrics
+	var results *utils.MemoryResults
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		var err error
+		metrics, err = utils.NewMetrics(registry)
+		Expect(err).To(BeNil())
+
+		results = utils.NewMemoryResults()
+	})
+
+	// run runs collector until returned function is called
+	run := func(collector *utils.Collector, policy utils.TriggerPolicy) func() {
+		ctx, cancel := context.WithCancel(context.TODO())
+		done := make(chan error)
+		go func() {
+			done <- collector.RunTriggers(ctx, policy)
+		}()
+		return func() {
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		}
+	}
+
+	// waitWatching waits until pods and jobs are watched: failures happening afterwards
+	// are after the controller started
+	waitWatching := func(clientset *k8sfake.Clientset) {
+		watching := func(resource string) bool {
+			for _, action := range clientset.Actions() {
+				if action.GetVerb() == "watch" && action.GetResource().Resource == resource {
+					return true
+				}
+			}
+			return false
+		}
+		Eventually(func() bool { return watching("pods") && watching("jobs") }).Should(BeTrue())
+	}
+
+	It("RunTriggers collects evidence of a pod in CrashLoopBackOff once", func() {
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "nginx"}}
+		replicaSet := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "web", Name: "nginx-5d8f",
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx", Controller: ptr.To(true)},
+				},
+			},
+		}
+		pod := crashingPod("nginx-5d8f-x2k4", &metav1.OwnerReference{
+			APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-5d8f", Controller: ptr.To(true)})
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker"}}
+		event := &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "web", Name: "nginx-5d8f-x2k4.backoff"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "web", Name: "nginx-5d8f-x2k4"},
+			Reason:         "BackOff",
+		}
+		otherEvent := &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "web", Name: "other.scheduled"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "web", Name: "other"},
+		}
+
+		clientset := k8sfake.NewSimpleClientset(pod, event, otherEvent)
+		options := append(results.Options(), utils.WithClientset(clientset), utils.WithMetrics(metrics))
+		collector := newTestCollector([]client.Object{deployment, replicaSet, pod, node}, options...)
+
+		stop := run(collector, utils.DefaultTriggerPolicy())
+		Eventually(func() int { return len(results.Objects()) }).Should(Equal(5))
+
+		// The same failure does not trigger another collection
+		updated := pod.DeepCopy()
+		updated.Status.ContainerStatuses[0].RestartCount++
+		_, err := clientset.CoreV1().Pods("web").UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{})
+		Expect(err).To(BeNil())
+		Eventually(func() float64 { return triggers(registry, "duplicate") }).Should(BeNumerically(">=", 1))
+		stop()
+
+		kinds := make([]string, 0)
+		for _, obj := range results.Objects() {
+			kinds = append(kinds, obj.GetObjectKind().GroupVersionKind().Kind+"/"+obj.GetName())
+		}
+		Expect(kinds).To(ConsistOf("Pod/nginx-5d8f-x2k4", "Event/nginx-5d8f-x2k4.backoff",
+			"ReplicaSet/nginx-5d8f", "Deployment/nginx", "Node/worker"))
+
+		current := utils.LogReference{Namespace: "web", Pod: "nginx-5d8f-x2k4", Container: "nginx"}
+		previous := current
+		previous.Previous = true
+		Expect(results.Logs()).To(HaveKey(current))
+		Expect(results.Logs()).To(HaveKey(previous))
+		Expect(triggers(registry, "collected")).To(Equal(float64(1)))
+	})
+
+	It("RunTriggers collects evidence of a failed Job and its pods", func() {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "migrate"},
+			Spec: batchv1.JobSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "migrate"}},
+			},
+		}
+		pod := crashingPod("migrate", &metav1.OwnerReference{
+			APIVersion: "batch/v1", Kind: "Job", Name: "migrate", Controller: ptr.To(true)})
+		pod.Status.ContainerStatuses[0].State = corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1},
+		}
+
+		clientset := k8sfake.NewSimpleClientset(job)
+		options := append(results.Options(), utils.WithClientset(clientset), utils.WithMetrics(metrics),
+			utils.WithNamespaces("web"))
+		collector := newTestCollector([]client.Object{job, pod}, options...)
+
+		stop := run(collector, utils.DefaultTriggerPolicy())
+		waitWatching(clientset)
+		job.Status.Conditions = []batchv1.JobCondition{
+			{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: metav1.Now()},
+		}
+		_, err := clientset.BatchV1().Jobs("web").UpdateStatus(context.TODO(), job, metav1.UpdateOptions{})
+		Expect(err).To(BeNil())
+		Eventually(func() int { return len(results.Objects()) }).Should(Equal(2))
+		stop()
+
+		kinds := make([]string, 0)
+		for _, obj := range results.Objects() {
+			kinds = append(kinds, obj.GetObjectKind().GroupVersionKind().Kind+"/"+obj.GetName())
+		}
+		// In namespaced mode nodes are not collected
+		Expect(kinds).To(ConsistOf("Job/migrate", "Pod/migrate"))
+		Expect(results.Logs()).To(HaveLen(2))
+	})
+
+	It("RunTriggers limits the number of collections per hour", func() {
+		oomKilled := crashingPod("oom", nil)
+		oomKilled.Status.ContainerStatuses[0].State = corev1.ContainerState{
+			Running: &corev1.ContainerStateRunning{},
+		}
+		crashing := crashingPod("crashing", nil)
+
+		clientset := k8sfake.NewSimpleClientset(crashing)
+		options := append(results.Options(), utils.WithClientset(clientset), utils.WithMetrics(metrics))
+		collector := newTestCollector([]client.Object{oomKilled, crashing}, options...)
+
+		stop := run(collector, utils.TriggerPolicy{DedupWindow: time.Hour, MaxPerHour: 1})
+		waitWatching(clientset)
+		oomKilled.Status.ContainerStatuses[0].LastTerminationState = corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137, FinishedAt: metav1.Now()},
+		}
+		_, err := clientset.CoreV1().Pods("web").Create(context.TODO(), oomKilled, metav1.CreateOptions{})
+		Expect(err).To(BeNil())
+		Eventually(func() float64 { return triggers(registry, "rate_limited") }).Should(Equal(float64(1)))
+		stop()
+
+		Expect(triggers(registry, "collected")).To(Equal(float64(1)))
+	})
+
+	It("RunTriggers ignores containers OOMKilled and Jobs failed before it started", func() {
+		yesterday := metav1.NewTime(time.Now().Add(-24 * time.Hour))
+		oomKilled := crashingPod("oom", nil)
+		oomKilled.Status.ContainerStatuses[0].State = corev1.ContainerState{
+			Running: &corev1.ContainerStateRunning{},
+		}
+		oomKilled.Status.ContainerStatuses[0].LastTerminationState = corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137, FinishedAt: yesterday},
+		}
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "migrate"},
+			Status: batchv1.JobStatus{
+				Conditions: []batchv1.JobCondition{
+					{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: yesterday},
+				},
+			},
+		}
+
+		clientset := k8sfake.NewSimpleClientset(oomKilled, job)
+		options := append(results.Options(), utils.WithClientset(clientset), utils.WithMetrics(metrics))
+		collector := newTestCollector([]client.Object{oomKilled, job}, options...)
+
+		stop := run(collector, utils.DefaultTriggerPolicy())
+		defer stop()
+		waitWatching(clientset)
+		Consistently(func() float64 { return triggers(registry, "collected") }, time.Second/2).Should(BeZero())
+
+		// The container is OOMKilled again
+		oomKilled.Status.ContainerStatuses[0].RestartCount++
+		oomKilled.Status.ContainerStatuses[0].LastTerminationState.Terminated.FinishedAt = metav1.Now()
+		_, err := clientset.CoreV1().Pods("web").UpdateStatus(context.TODO(), oomKilled, metav1.UpdateOptions{})
+		Expect(err).To(BeNil())
+		Eventually(func() float64 { return triggers(registry, "collected") }).Should(Equal(float64(1)))
+	})
+})
@@ -19,60 +19,195 @@ package utils
 import (
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/go-logr/logr"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/utils/clock"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // Collector is the client that implements methods to collect resources and logs
 type Collector struct {
-	client        client.Client
-	restConfig    *rest.Config
-	clientset     *kubernetes.Clientset
-	scheme        *runtime.Scheme
-	configMapName string
-	directory     string
+	client       client.Client
+	restConfig   *rest.Config
+	clientset    kubernetes.Interface
+	dynamic      dynamic.Interface
+	scheme       *runtime.Scheme
+	configSource ConfigurationSource
+	sink         Sink
+	logger       logr.Logger
+	clock        clock.PassiveClock
+
+	objectHandler ObjectHandler
+	logHandler    LogHandler
+
+	metrics *Metrics
+
+	listTimeout      time.Duration
+	logStreamTimeout time.Duration
+	retryPolicy      RetryPolicy
+
+	// namespaces, when set, restricts collection to these namespaces
+	namespaces []string
+
+	// captureDirectory, when set, is the capture buffer included in collected data
+	captureDirectory string
+
+	// logCompression is the compression of log files of the running collection
+	logCompression *LogCompression
+	// budget limits the size of the running collection
+	budget *budget
+	// inheritBudget is set when budget is shared with the collector of a multi-cluster collection
+	inheritBudget bool
+
+	// mu protects the state of the running collection
+	mu      sync.Mutex
+	start   time.Time
+	summary *Summary
+	skipped []SkippedEntry
+	// kept is what the running collection saw, to describe objects and write the cluster overview
+	kept *keptObjects
+	// mapper is the RESTMapper of the running collection or plan, built on first use
+	mapper apimeta.RESTMapper
 }
 
-var (
-	collectorInstance *Collector
-	mux               sync.Mutex
-)
+// Option configures a Collector.
+type Option func(*Collector)
+
+// WithClient sets the client used to access resources.
+// Default is a client created from restConfig.
+func WithClient(c client.Client) Option {
+	return func(a *Collector) {
+		a.client = c
+	}
+}
+
+// WithClientset sets the clientset used to collect logs.
+// Default is a clientset created from restConfig.
+func WithClientset(cs kubernetes.Interface) Option {
+	return func(a *Collector) {
+		a.clientset = cs
+	}
+}
+
+// WithDynamicClient sets the dynamic client used to list resources.
+// Default is a dynamic client created from restConfig.
+func WithDynamicClient(d dynamic.Interface) Option {
+	return func(a *Collector) {
+		a.dynamic = d
+	}
+}
+
+// WithLogger sets the logger. Default discards all logs.
+func WithLogger(logger logr.Logger) Option {
+	return func(a *Collector) {
+		a.logger = logger
+	}
+}
+
+// WithSink sets where collected data is stored.
+func WithSink(sink Sink) Option {
+	return func(a *Collector) {
+		a.sink = sink
+	}
+}
+
+// WithDirectory stores collected data in directory.
+// It is a shortcut for WithSink(NewDirectorySink(directory)).
+func WithDirectory(directory string) Option {
+	return WithSink(NewDirectorySink(directory))
+}
 
-// GetCollectorInstance return k8sAccess instance used to access resources in the
-// management cluster.
-func GetCollectorInstance(scheme *runtime.Scheme, restConfig *rest.Config,
-	directory, configMapName string) (*Collector, error) {
+// WithClock sets the clock used to measure collections. Default is the real clock.
+func WithClock(c clock.PassiveClock) Option {
+	return func(a *Collector) {
+		a.clock = c
+	}
+}
+
+// WithConfigurationSource sets where configuration is loaded from.
+func WithConfigurationSource(source ConfigurationSource) Option {
+	return func(a *Collector) {
+		a.configSource = source
+	}
+}
+
+// NewCollector returns a Collector accessing the cluster restConfig points to.
+// Every call returns an independent instance.
+// restConfig can be nil when the client and the clientset are set with options;
+// resources are then listed only if the dynamic client is set too.
+func NewCollector(scheme *runtime.Scheme, restConfig *rest.Config, options ...Option) (*Collector, error) {
+	a := &Collector{
+		scheme:      scheme,
+		restConfig:  restConfig,
+		logger:      logr.Discard(),
+		clock:       clock.RealClock{},
+		retryPolicy: DefaultRetryPolicy(),
+	}
+
+	for _, option := range options {
+		option(a)
+	}
 
-	mux.Lock()
-	defer mux.Unlock()
+	if restConfig == nil && (a.clientset == nil || a.client == nil) {
+		return nil, fmt.Errorf("a rest config is required unless both client and clientset are set")
+	}
 
-	if collectorInstance == nil {
+	if a.clientset == nil {
 		cs, err := kubernetes.NewForConfig(restConfig)
 		if err != nil {
 			werr := fmt.Errorf("error in getting access to K8S: %w", err)
 			return nil, werr
 		}
+		a.clientset = cs
+	}
 
+	if a.client == nil {
 		c, err := client.New(restConfig, client.Options{Scheme: scheme})
 		if err != nil {
 			werr := fmt.Errorf("failed to connect: %w", err)
 			return nil, werr
 		}
+		a.client = c
+	}
 
-		collectorInstance = &Collector{
-			scheme:        scheme,
-			client:        c,
-			clientset:     cs,
-			restConfig:    restConfig,
-			configMapName: configMapName,
-			directory:     directory,
+	if a.dynamic == nil && restConfig != nil {
+		d, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			werr := fmt.Errorf("failed to create dynamic client: %w", err)
+			return nil, werr
 		}
+		a.dynamic = d
 	}
 
-	return collectorInstance, nil
+	return a, nil
+}
+
+// derive returns a collector accessing the same cluster, with the same options,
+// storing data in sink.
+func (a *Collector) derive(sink Sink, logger logr.Logger) (*Collector, error) {
+	return a.deriveFor(a.restConfig, sink, logger, WithClient(a.client), WithClientset(a.clientset),
+		WithDynamicClient(a.dynamic))
+}
+
+// deriveFor returns a collector accessing the cluster restConfig points to, with the
+// same options, storing data in sink. The capture buffer is not inherited: it contains
+// pods of the cluster the collector runs in.
+func (a *Collector) deriveFor(restConfig *rest.Config, sink Sink, logger logr.Logger,
+	options ...Option) (*Collector, error) {
+
+	options = append([]Option{
+		WithSink(sink), WithLogger(logger), WithClock(a.clock), WithObjectHandler(a.objectHandler),
+		WithLogHandler(a.logHandler), WithNamespaces(a.namespaces...), WithMetrics(a.metrics),
+		WithListTimeout(a.listTimeout), WithLogStreamTimeout(a.logStreamTimeout), WithRetryPolicy(a.retryPolicy),
+		WithConfigurationSource(a.configSource),
+	}, options...)
+	return NewCollector(a.scheme, restConfig, options...)
 }
 
 // GetScheme returns scheme
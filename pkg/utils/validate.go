@@ -0,0 +1,341 @@
+/*
+Copyright 2023. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+var (
+	versionRegexp = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+)
+
+// parseConfiguration strictly decodes content into a Configuration and validates it.
+// Content can be either YAML or JSON. Unknown fields are rejected.
+// Returned error lists all problems found, each one reporting the key and, when
+// possible, the line where the problem is.
+func parseConfiguration(key, content string) (*Configuration, error) {
+	config := &Configuration{}
+
+	decoder := yaml.NewDecoder(strings.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("key %q: configuration is empty", key)
+		}
+		return nil, fmt.Errorf("key %q: %w", key, err)
+	}
+
+	allErrs := validateConfiguration(config)
+	if len(allErrs) == 0 {
+		return config, nil
+	}
+
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(content), root); err != nil {
+		root = nil
+	}
+
+	errs := make([]error, len(allErrs))
+	for i := range allErrs {
+		if line := findLine(root, allErrs[i].Field); line > 0 {
+			errs[i] = fmt.Errorf("key %q line %d: %w", key, line, allErrs[i])
+		} else {
+			errs[i] = fmt.Errorf("key %q: %w", key, allErrs[i])
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// validateConfiguration verifies configuration is semantically valid.
+func validateConfiguration(config *Configuration) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if len(config.Resources) == 0 && len(config.Logs) == 0 && len(config.Applications) == 0 &&
+		len(config.Include) == 0 {
+
+		allErrs = append(allErrs, field.Required(field.NewPath("resources"),
+			"at least one of include, resources, logs or applications must be set"))
+	}
+
+	for i, name := range config.Include {
+		if !isProfile(name) {
+			allErrs = append(allErrs, field.NotSupported(field.NewPath("include").Index(i), name,
+				ProfileNames()))
+		}
+	}
+
+	for i := range config.Resources {
+		allErrs = append(allErrs, validateResource(&config.Resources[i],
+			field.NewPath("resources").Index(i))...)
+	}
+
+	for i := range config.Logs {
+		allErrs = append(allErrs, validateLog(&config.Logs[i], field.NewPath("logs").Index(i))...)
+	}
+
+	for i := range config.Applications {
+		allErrs = append(allErrs, validateApplication(&config.Applications[i],
+			field.NewPath("applications").Index(i))...)
+	}
+
+	if config.LogCompression != nil {
+		allErrs = append(allErrs, validateLogCompression(config.LogCompression, field.NewPath("logCompression"))...)
+	}
+
+	if config.Budget != nil {
+		allErrs = append(allErrs, validateBudget(config.Budget, field.NewPath("budget"))...)
+	}
+
+	return allErrs
+}
+
+func validateResource(resource *Resource, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if resource.Kind == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("kind"), ""))
+	}
+
+	if resource.Version == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("version"), ""))
+	} else if !versionRegexp.MatchString(resource.Version) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("version"), resource.Version,
+			"must be a valid API version (e.g. v1, v1beta1)"))
+	}
+
+	if resource.Group != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(resource.Group) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("group"), resource.Group, msg))
+		}
+	}
+
+	allErrs = append(allErrs, validateNamespace(resource.Namespace, fldPath.Child("namespace"))...)
+	allErrs = append(allErrs, validateLabelFilters(resource.LabelFilters, fldPath.Child("labelFilters"))...)
+
+	return allErrs
+}
+
+func validateLog(log *Log, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	allErrs = append(allErrs, validateNamespace(log.Namespace, fldPath.Child("namespace"))...)
+	allErrs = append(allErrs, validateLabelFilters(log.LabelFilters, fldPath.Child("labelFilters"))...)
+	allErrs = append(allErrs, validateSinceSeconds(log.SinceSeconds, fldPath.Child("sinceSeconds"))...)
+	if log.TailLines != nil && *log.TailLines <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("tailLines"), *log.TailLines,
+			"must be greater than 0"))
+	}
+	if log.Follow != nil {
+		allErrs = append(allErrs, validateFollow(log.Follow, fldPath.Child("follow"))...)
+	}
+
+	return allErrs
+}
+
+func validateFollow(follow *Follow, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if follow.DurationSeconds <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("durationSeconds"), follow.DurationSeconds,
+			"must be greater than 0"))
+	}
+	if follow.MaxFileBytes != nil && *follow.MaxFileBytes <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxFileBytes"), *follow.MaxFileBytes,
+			"must be greater than 0"))
+	}
+
+	return allErrs
+}
+
+func validateLogCompression(compression *LogCompression, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if !isCompressionAlgorithm(compression.Algorithm) {
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("algorithm"), compression.Algorithm,
+			[]string{CompressionGzip, CompressionZstd}))
+	}
+	if compression.ThresholdBytes != nil && *compression.ThresholdBytes < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("thresholdBytes"), *compression.ThresholdBytes,
+			"must be greater than or equal to 0"))
+	}
+
+	return allErrs
+}
+
+func validateBudget(budget *Budget, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	limits := []struct {
+		name  string
+		value *int64
+	}{
+		{"totalBytes", budget.TotalBytes}, {"logsBytes", budget.LogsBytes},
+		{"resourcesBytes", budget.ResourcesBytes}, {"eventsBytes", budget.EventsBytes},
+	}
+	for i := range limits {
+		if limits[i].value != nil && *limits[i].value <= 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(limits[i].name), *limits[i].value,
+				"must be greater than 0"))
+		}
+	}
+
+	return allErrs
+}
+
+func validateApplication(app *Application, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if app.HelmRelease == "" && app.Instance == "" {
+		allErrs = append(allErrs, field.Required(fldPath, "one of helmRelease or instance must be set"))
+	}
+
+	if app.Instance != "" {
+		for _, msg := range validation.IsValidLabelValue(app.Instance) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("instance"), app.Instance, msg))
+		}
+	}
+
+	allErrs = append(allErrs, validateNamespace(app.Namespace, fldPath.Child("namespace"))...)
+	allErrs = append(allErrs, validateSinceSeconds(app.SinceSeconds, fldPath.Child("sinceSeconds"))...)
+
+	return allErrs
+}
+
+func validateNamespace(namespace string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if namespace == "" {
+		return allErrs
+	}
+
+	for _, msg := range validation.IsDNS1123Label(namespace) {
+		allErrs = append(allErrs, field.Invalid(fldPath, namespace, msg))
+	}
+
+	return allErrs
+}
+
+func validateSinceSeconds(sinceSeconds *int64, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if sinceSeconds != nil && *sinceSeconds <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath, *sinceSeconds, "must be greater than 0"))
+	}
+
+	return allErrs
+}
+
+func validateLabelFilters(labelFilters []libsveltosv1alpha1.LabelFilter, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	for i := range labelFilters {
+		f := &labelFilters[i]
+		idxPath := fldPath.Index(i)
+
+		for _, msg := range validation.IsQualifiedName(f.Key) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("key"), f.Key, msg))
+		}
+
+		for _, msg := range validation.IsValidLabelValue(f.Value) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("value"), f.Value, msg))
+		}
+
+		if f.Operation != libsveltosv1alpha1.OperationEqual &&
+			f.Operation != libsveltosv1alpha1.OperationDifferent {
+
+			allErrs = append(allErrs, field.NotSupported(idxPath.Child("operation"), f.Operation,
+				[]string{string(libsveltosv1alpha1.OperationEqual), string(libsveltosv1alpha1.OperationDifferent)}))
+		}
+	}
+
+	return allErrs
+}
+
+// findLine returns the line, in the YAML document represented by root, of the
+// element identified by the field path (e.g. resources[1].version).
+// If the element is not found, the line of the closest parent is returned.
+// Returns 0 if root is nil.
+func findLine(root *yaml.Node, path string) int {
+	if root == nil {
+		return 0
+	}
+
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, segment := range strings.Split(path, ".") {
+		name := segment
+		indexes := make([]int, 0)
+		if idx := strings.Index(segment, "["); idx >= 0 {
+			name = segment[:idx]
+			for _, s := range strings.Split(strings.TrimSuffix(segment[idx+1:], "]"), "][") {
+				if n, err := strconv.Atoi(s); err == nil {
+					indexes = append(indexes, n)
+				}
+			}
+		}
+
+		if name != "" {
+			node = mappingValue(node, name)
+			if node == nil {
+				return line
+			}
+			line = node.Line
+		}
+
+		for _, n := range indexes {
+			if node.Kind != yaml.SequenceNode || n >= len(node.Content) {
+				return line
+			}
+			node = node.Content[n]
+			line = node.Line
+		}
+	}
+
+	return line
+}
+
+// mappingValue returns the value node for key in a YAML mapping node.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/gianlucam76/k8s_collector/pkg/utils"
+)
+
+var (
+	invalidData = `resources:
+- group: ""
+  version: v"
+  kind: Secret
+- group: apps
+  version: v1
+  kind: Deployment
+  labelFilters:
+  - key: app
+    operation: Matches
+    value: nginx
+logs:
+- namespace: kube_system
+  sinceSeconds: 0`
+)
+
+var _ = Describe("Validate", func() {
+	It("parseConfiguration accepts a valid YAML configuration", func() {
+		config, err := utils.ParseConfiguration("config.yaml", data)
+		Expect(err).To(BeNil())
+		Expect(len(config.Resources)).To(Equal(2))
+		Expect(len(config.Logs)).To(Equal(1))
+		Expect(*config.Logs[0].SinceSeconds).To(Equal(int64(600)))
+	})
+
+	It("parseConfiguration accepts a valid JSON configuration", func() {
+		content := `{"resources":[{"group":"","version":"v1","kind":"Secret"}],"logs":[{"namespace":"kube-system","sinceSeconds":600}]}`
+		config, err := utils.ParseConfiguration("config.json", content)
+		Expect(err).To(BeNil())
+		Expect(len(config.Resources)).To(Equal(1))
+	})
+
+	It("parseConfiguration rejects unknown fields", func() {
+		content := `resources:
+- group: ""
+  version: v1
+  kind: Secret
+  namespaces: default`
+		_, err := utils.ParseConfiguration("config.yaml", content)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(`key "config.yaml"`))
+		Expect(err.Error()).To(ContainSubstring("line 5"))
+		Expect(err.Error()).To(ContainSubstring("namespaces"))
+	})
+
+	It("parseConfiguration reports all semantic errors with line", func() {
+		_, err := utils.ParseConfiguration("config.yaml", invalidData)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(`key "config.yaml" line 3: resources[0].version`))
+		Expect(err.Error()).To(ContainSubstring(`key "config.yaml" line 10: resources[1].labelFilters[0].operation`))
+		Expect(err.Error()).To(ContainSubstring(`key "config.yaml" line 13: logs[0].namespace`))
+		Expect(err.Error()).To(ContainSubstring(`key "config.yaml" line 14: logs[0].sinceSeconds`))
+	})
+
+	It("parseConfiguration reports malformed YAML with line", func() {
+		content := `logs:
+- namespace: kube-system
+  sinceSeconds:600
+resources:
+- group: ""
+  version: v1
+  kind: Secret`
+		_, err := utils.ParseConfiguration("config.yaml", content)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(`key "config.yaml"`))
+		Expect(err.Error()).To(ContainSubstring("line 3"))
+	})
+
+	It("parseConfiguration rejects empty configuration", func() {
+		_, err := utils.ParseConfiguration("config.yaml", "")
+		Expect(err).ToNot(BeNil())
+
+		_, err = utils.ParseConfiguration("config.yaml", "resources: []")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("parseConfiguration validates log compression", func() {
+		content := `logs:
+- namespace: kube-system
+logCompression:
+  algorithm: lz4
+  thresholdBytes: -1`
+		_, err := utils.ParseConfiguration("config.yaml", content)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("logCompression.algorithm"))
+		Expect(err.Error()).To(ContainSubstring("logCompression.thresholdBytes"))
+	})
+
+	It("parseConfiguration validates budget", func() {
+		content := `logs:
+- namespace: kube-system
+budget:
+  totalBytes: 0
+  eventsBytes: 1024`
+		_, err := utils.ParseConfiguration("config.yaml", content)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("budget.totalBytes"))
+		Expect(err.Error()).ToNot(ContainSubstring("budget.eventsBytes"))
+	})
+})